@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/interceptors"
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpAccessLogDropped counts access log entries dropped because the buffer was full
+var httpAccessLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "http_access_log_dropped_total",
+	Help: "Total number of HTTP access log entries dropped because the buffer was full",
+})
+
+const (
+	// AccessLogFormatJSON emits access logs through the coldbrew logger as structured logs
+	AccessLogFormatJSON = "json"
+	// AccessLogFormatCommon emits access logs in the Apache Common Log Format
+	AccessLogFormatCommon = "common"
+	// AccessLogFormatCombined emits access logs in the Apache Combined Log Format
+	AccessLogFormatCombined = "combined"
+)
+
+// clfTimeFormat is the time format used by the Common and Combined Log Formats
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogEntry is a single HTTP access log line
+type accessLogEntry struct {
+	ctx        context.Context
+	start      time.Time
+	remoteAddr string
+	user       string
+	method     string
+	path       string
+	requestURI string
+	proto      string
+	referer    string
+	userAgent  string
+	status     int
+	size       int
+	took       time.Duration
+}
+
+// accessLogger writes HTTP access log entries, either synchronously or through a buffered channel drained by a worker
+type accessLogger struct {
+	format  string
+	level   loggers.Level
+	out     io.Writer
+	entries chan accessLogEntry
+	stop    chan struct{}
+	done    chan struct{}
+	// mu guards closed, entries are queued under the read lock so that none is queued once Close stopped the worker
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newAccessLogger creates an access logger, when bufferSize is greater than zero entries are written asynchronously
+// and entries that do not fit in the buffer are dropped instead of blocking the request
+// format is one of AccessLogFormatJSON, AccessLogFormatCommon or AccessLogFormatCombined, it defaults to AccessLogFormatJSON
+// level is the level json entries are logged at, it defaults to info
+func newAccessLogger(bufferSize int, format, level string) *accessLogger {
+	a := &accessLogger{
+		format: strings.ToLower(format),
+		level:  loggers.InfoLevel,
+		out:    os.Stdout,
+	}
+	if level != "" {
+		ll, err := loggers.ParseLevel(level)
+		if err != nil {
+			log.Warn(context.Background(), "msg", "invalid HTTP access log level, using info", "access_log_level", level, "err", err)
+		} else {
+			a.level = ll
+		}
+	}
+	if bufferSize > 0 {
+		registerCollector(httpAccessLogDropped)
+		a.entries = make(chan accessLogEntry, bufferSize)
+		a.stop = make(chan struct{})
+		a.done = make(chan struct{})
+		go a.run()
+	}
+	return a
+}
+
+// write emits the entry in the configured format
+// Common and Combined Log Format lines are written as is to stdout, everything else goes through the coldbrew logger
+func (a *accessLogger) write(e accessLogEntry) {
+	switch a.format {
+	case AccessLogFormatCommon, AccessLogFormatCombined:
+		line := clfLine(e)
+		if a.format == AccessLogFormatCombined {
+			line += fmt.Sprintf(" %s %s", clfQuote(e.referer), clfQuote(e.userAgent))
+		}
+		fmt.Fprintln(a.out, line)
+	default:
+		log.GetLogger().Log(e.ctx, a.level, 1, "msg", "http request", "method", e.method, "path", e.path, "status", e.status, "size", e.size, "took", e.took)
+	}
+}
+
+// clfLine formats the entry in the Common Log Format
+// https://httpd.apache.org/docs/current/logs.html#common
+func clfLine(e accessLogEntry) string {
+	host := e.remoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	size := "-"
+	if e.size > 0 {
+		size = strconv.Itoa(e.size)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s",
+		clfValue(host),
+		clfValue(e.user),
+		e.start.Format(clfTimeFormat),
+		strconv.Quote(e.method+" "+e.requestURI+" "+e.proto),
+		e.status,
+		size,
+	)
+}
+
+// clfValue returns the value or - when it is empty
+func clfValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// clfQuote returns the quoted value or "-" when it is empty
+func clfQuote(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
+
+// run writes buffered entries until the logger is closed and then flushes what is left in the buffer
+func (a *accessLogger) run() {
+	defer close(a.done)
+	for {
+		select {
+		case e := <-a.entries:
+			a.write(e)
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.entries:
+					a.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// log writes the entry or queues it when the logger is asynchronous
+func (a *accessLogger) log(e accessLogEntry) {
+	if a.entries == nil {
+		a.write(e)
+		return
+	}
+	a.mu.RLock()
+	if a.closed {
+		a.mu.RUnlock()
+		// worker is gone, nothing left to do but write it ourselves
+		a.write(e)
+		return
+	}
+	select {
+	case a.entries <- e:
+	default:
+		httpAccessLogDropped.Inc()
+	}
+	a.mu.RUnlock()
+}
+
+// Close stops the worker and waits for buffered entries to be flushed
+func (a *accessLogger) Close() error {
+	if a.entries == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.stop)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return nil
+}
+
+// handler returns a middleware that logs method, path, status, size and duration of every request
+func (a *accessLogger) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !interceptors.FilterMethodsFunc(r.Context(), r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		begin := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		user := ""
+		if r.URL.User != nil {
+			user = r.URL.User.Username()
+		} else if u, _, ok := r.BasicAuth(); ok {
+			user = u
+		}
+		a.log(accessLogEntry{
+			ctx:        r.Context(),
+			start:      begin,
+			remoteAddr: r.RemoteAddr,
+			user:       user,
+			method:     r.Method,
+			path:       r.URL.Path,
+			requestURI: r.RequestURI,
+			proto:      r.Proto,
+			referer:    r.Referer(),
+			userAgent:  r.UserAgent(),
+			status:     rec.status,
+			size:       rec.size,
+			took:       time.Since(begin),
+		})
+	})
+}
+
+// responseRecorder is a http.ResponseWriter that records the status code and the number of bytes written
+// it implements http.Flusher and http.Hijacker so that streaming and upgraded connections keep working
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported by the underlying http.ResponseWriter")
+}
+
+// Unwrap returns the underlying http.ResponseWriter, it is used by http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes, write blocks while gate is set and not closed
+type syncBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	if b.gate != nil {
+		b.entered <- struct{}{}
+		<-b.gate
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func TestAccessLoggerFlushesOnClose(t *testing.T) {
+	out := &syncBuffer{}
+	a := newAccessLogger(100, AccessLogFormatCommon, "")
+	a.out = out
+	h := a.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/items", nil))
+	}
+	a.Close()
+	lines := out.lines()
+	if len(lines) != 3 {
+		t.Fatalf("Close did not flush the buffered entries, got %q", lines)
+	}
+	for _, line := range lines {
+		if !strings.HasSuffix(line, `"POST /v1/items HTTP/1.1" 201 5`) {
+			t.Errorf("unexpected access log line %q", line)
+		}
+	}
+}
+
+func TestAccessLoggerDropsWhenBufferIsFull(t *testing.T) {
+	SetPrometheusRegistry(prometheus.NewRegistry())
+	out := &syncBuffer{gate: make(chan struct{}), entered: make(chan struct{}, 10)}
+	a := newAccessLogger(1, AccessLogFormatCommon, "")
+	a.out = out
+	entry := accessLogEntry{method: http.MethodGet, requestURI: "/", proto: "HTTP/1.1", status: http.StatusOK}
+	before := testutil.ToFloat64(httpAccessLogDropped)
+
+	// the worker blocks writing the first entry, the second one fills the buffer
+	a.log(entry)
+	<-out.entered
+	a.log(entry)
+	a.log(entry)
+	if got := testutil.ToFloat64(httpAccessLogDropped) - before; got != 1 {
+		t.Fatalf("counted %v dropped entries, want 1", got)
+	}
+	close(out.gate)
+	a.Close()
+	if lines := out.lines(); len(lines) != 2 {
+		t.Fatalf("wrote %d entries, want the 2 that were not dropped", len(lines))
+	}
+}
+
+func TestAccessLoggerLogRacingClose(t *testing.T) {
+	out := &syncBuffer{}
+	a := newAccessLogger(1000, AccessLogFormatCommon, "")
+	a.out = out
+	entry := accessLogEntry{method: http.MethodGet, requestURI: "/", proto: "HTTP/1.1", status: http.StatusOK}
+	before := testutil.ToFloat64(httpAccessLogDropped)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				a.log(entry)
+			}
+		}()
+	}
+	a.Close()
+	wg.Wait()
+	// entries logged after Close are written by the caller, none is left in the buffer
+	if got, dropped := len(out.lines()), int(testutil.ToFloat64(httpAccessLogDropped)-before); got+dropped != 500 {
+		t.Fatalf("wrote %d and dropped %d of 500 entries", got, dropped)
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	start := time.Date(2024, time.March, 5, 14, 3, 9, 0, time.FixedZone("", -7*3600))
+	entry := accessLogEntry{
+		start:      start,
+		remoteAddr: "10.0.0.1:51234",
+		user:       "frank",
+		method:     http.MethodGet,
+		requestURI: "/v1/items?page=2",
+		proto:      "HTTP/1.1",
+		referer:    "https://example.com/",
+		userAgent:  `curl/8.0 "quoted"`,
+		status:     http.StatusOK,
+		size:       2326,
+	}
+	tests := []struct {
+		format string
+		entry  accessLogEntry
+		want   string
+	}{
+		{
+			format: AccessLogFormatCommon,
+			entry:  entry,
+			want:   `10.0.0.1 - frank [05/Mar/2024:14:03:09 -0700] "GET /v1/items?page=2 HTTP/1.1" 200 2326`,
+		},
+		{
+			format: AccessLogFormatCombined,
+			entry:  entry,
+			want:   `10.0.0.1 - frank [05/Mar/2024:14:03:09 -0700] "GET /v1/items?page=2 HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0 \"quoted\""`,
+		},
+		{
+			// missing values are written as -
+			format: "COMBINED",
+			entry:  accessLogEntry{start: start, method: http.MethodGet, requestURI: "/", proto: "HTTP/2.0", status: http.StatusNoContent},
+			want:   `- - - [05/Mar/2024:14:03:09 -0700] "GET / HTTP/2.0" 204 - "-" "-"`,
+		},
+	}
+	for _, tt := range tests {
+		out := &syncBuffer{}
+		a := newAccessLogger(0, tt.format, "")
+		a.out = out
+		a.log(tt.entry)
+		if got := out.lines(); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s access log = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+// levelRecorder is a loggers.BaseLogger recording the level and the arguments of every message it is asked to log
+type levelRecorder struct {
+	mu     sync.Mutex
+	level  loggers.Level
+	levels []loggers.Level
+	args   [][]interface{}
+}
+
+func (r *levelRecorder) Log(_ context.Context, level loggers.Level, _ int, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.levels = append(r.levels, level)
+	r.args = append(r.args, args)
+}
+
+// find returns the key value pairs of the first message logged with msg
+func (r *levelRecorder) find(msg string) map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, args := range r.args {
+		kv := make(map[string]interface{})
+		for i := 0; i+1 < len(args); i += 2 {
+			if k, ok := args[i].(string); ok {
+				kv[k] = args[i+1]
+			}
+		}
+		if kv["msg"] == msg {
+			return kv
+		}
+	}
+	return nil
+}
+
+func (r *levelRecorder) SetLevel(level loggers.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.level = level
+}
+
+func (r *levelRecorder) GetLevel() loggers.Level {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.level
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	previous := log.GetLogger()
+	t.Cleanup(func() { log.SetLogger(previous) })
+	tests := []struct {
+		level string
+		want  loggers.Level
+	}{
+		{level: "", want: loggers.InfoLevel},
+		{level: "info", want: loggers.InfoLevel},
+		{level: "debug", want: loggers.DebugLevel},
+		{level: "WARN", want: loggers.WarnLevel},
+		{level: "loud", want: loggers.InfoLevel},
+	}
+	for _, tt := range tests {
+		rec := &levelRecorder{}
+		l := log.NewLogger(rec)
+		l.SetLevel(loggers.DebugLevel)
+		a := newAccessLogger(0, AccessLogFormatJSON, tt.level)
+		log.SetLogger(l)
+		a.log(accessLogEntry{ctx: context.Background(), method: http.MethodGet, path: "/", status: http.StatusOK})
+		if len(rec.levels) != 1 || rec.levels[0] != tt.want {
+			t.Errorf("access log level %q logged at %v, want [%v]", tt.level, rec.levels, tt.want)
+		}
+	}
+
+	// entries below the logger level are not written
+	rec := &levelRecorder{}
+	l := log.NewLogger(rec)
+	l.SetLevel(loggers.InfoLevel)
+	log.SetLogger(l)
+	newAccessLogger(0, AccessLogFormatJSON, "debug").log(accessLogEntry{ctx: context.Background(), method: http.MethodGet, path: "/", status: http.StatusOK})
+	if len(rec.levels) != 0 {
+		t.Errorf("debug access log was written by an info logger, got %v", rec.levels)
+	}
+}
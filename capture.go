@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/interceptors"
+	"github.com/go-coldbrew/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// capturedRequest is a single request recorded by the capture interceptor
+type capturedRequest struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Request []byte    `json:"request"`
+}
+
+// requestCapturer writes a sample of the requests to a file as JSON lines
+type requestCapturer struct {
+	mu         sync.Mutex
+	file       *os.File
+	sampleRate float64
+}
+
+// newRequestCapturer creates a capturer appending to the file at path
+func newRequestCapturer(path string, sampleRate float64) (*requestCapturer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open request capture file: %w", err)
+	}
+	return &requestCapturer{
+		file:       f,
+		sampleRate: sampleRate,
+	}, nil
+}
+
+// capture records the request if it is sampled
+func (r *requestCapturer) capture(ctx context.Context, method string, req interface{}) {
+	if r.sampleRate < 1 && rand.Float64() >= r.sampleRate {
+		return
+	}
+	data, err := encoding.GetCodec("proto").Marshal(req)
+	if err != nil {
+		log.Error(ctx, "msg", "could not marshal request for capture", "method", method, "err", err)
+		return
+	}
+	line, err := json.Marshal(capturedRequest{
+		Time:    time.Now(),
+		Method:  method,
+		Request: data,
+	})
+	if err != nil {
+		log.Error(ctx, "msg", "could not encode captured request", "method", method, "err", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Error(ctx, "msg", "could not write captured request", "method", method, "err", err)
+	}
+}
+
+// Close closes the capture file
+func (r *requestCapturer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// interceptor returns a unary server interceptor capturing the requests
+func (r *requestCapturer) interceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if interceptors.FilterMethodsFunc(ctx, info.FullMethod) {
+			r.capture(ctx, info.FullMethod, req)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Replay sends the requests recorded by the capture interceptor in the file at path to conn
+// Requests are sent in the order they were captured, responses are discarded
+// It returns the first error encountered reading the file or calling the server
+func Replay(path string, conn grpc.ClientConnInterface) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	scanner := bufio.NewScanner(f)
+	// captured requests can be larger than the default token size
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		cr := capturedRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), &cr); err != nil {
+			return fmt.Errorf("could not decode captured request: %w", err)
+		}
+		req := &rawMessage{data: cr.Request}
+		resp := &rawMessage{}
+		if err := conn.Invoke(ctx, cr.Method, req, resp, grpc.ForceCodec(rawCodec{})); err != nil {
+			return fmt.Errorf("replaying %s: %w", cr.Method, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// rawMessage holds an already marshaled message
+type rawMessage struct {
+	data []byte
+}
+
+// rawCodec sends and receives rawMessage as is, it allows replaying requests without knowing their types
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return nil, errors.New("raw codec can only marshal raw messages")
+	}
+	return m.data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return errors.New("raw codec can only unmarshal raw messages")
+	}
+	m.data = append(m.data[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	// messages are protobuf encoded on the wire
+	return "proto"
+}
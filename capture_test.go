@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// echoMethod is the method of echoServiceDesc, it answers with the string it receives
+const echoMethod = "/coldbrew.test.Echo/Echo"
+
+// echoServiceDesc describes a gRPC service whose only method echoes a wrapperspb.StringValue, served by an echoServer
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "coldbrew.test.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(wrapperspb.StringValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(*echoServer).echo(ctx, req.(*wrapperspb.StringValue)), nil
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: echoMethod}, handler)
+		},
+	}},
+}
+
+// echoServer records the values it echoes and the context of the last call
+type echoServer struct {
+	mu       sync.Mutex
+	received []string
+	ctx      context.Context
+}
+
+func (s *echoServer) echo(ctx context.Context, in *wrapperspb.StringValue) *wrapperspb.StringValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, in.GetValue())
+	s.ctx = ctx
+	return in
+}
+
+func (s *echoServer) values() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func (s *echoServer) lastContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx
+}
+
+// runEchoServer runs a server with an echoServer registered until the test ends
+func runEchoServer(t *testing.T, c *cb) *echoServer {
+	t.Helper()
+	srv := &echoServer{}
+	c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&echoServiceDesc, srv)
+		return nil
+	}})
+	runTestServer(t, c)
+	return srv
+}
+
+func TestRequestCaptureReplay(t *testing.T) {
+	cfg := testConfig()
+	cfg.RequestCaptureFile = filepath.Join(t.TempDir(), "capture.jsonl")
+	cfg.RequestCaptureSampleRate = 1
+	captured := newTestCB(t, cfg)
+	runEchoServer(t, captured)
+	conn, err := grpc.NewClient(captured.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sent := []string{"first", "second"}
+	for _, v := range sent {
+		if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String(v), &wrapperspb.StringValue{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := newTestCB(t, testConfig())
+	srv := runEchoServer(t, replayed)
+	replayConn, err := grpc.NewClient(replayed.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayConn.Close()
+	if err := Replay(cfg.RequestCaptureFile, replayConn); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.values(); !reflect.DeepEqual(got, sent) {
+		t.Fatalf("replayed %v, want the captured requests %v", got, sent)
+	}
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-coldbrew/interceptors"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gatewayLimiterKey is the metadata key the gateway marks its calls to the gRPC server with
+// the calls are counted by the HTTP request they serve and must not take a second slot
+const gatewayLimiterKey = "x-coldbrew-gateway-limiter"
+
+// concurrencyLimitRejected counts the requests rejected because MaxConcurrentRequests was reached
+var concurrencyLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coldbrew_concurrency_limit_rejected_total",
+	Help: "Total number of requests rejected because the maximum number of concurrent requests was reached",
+}, []string{"transport"})
+
+// concurrencyLimiter bounds the number of requests served concurrently across the gRPC server and the HTTP gateway
+type concurrencyLimiter struct {
+	sem chan struct{}
+	// token identifies the calls made by the gateway, it is random so that clients can not skip the limit
+	token string
+}
+
+// newConcurrencyLimiter returns a limiter allowing up to max concurrent requests
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	registerCollector(concurrencyLimitRejected)
+	return &concurrencyLimiter{
+		sem:   make(chan struct{}, max),
+		token: uuid.NewString(),
+	}
+}
+
+// acquire takes a slot without waiting, it returns false when all slots are taken
+func (l *concurrencyLimiter) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives back a slot taken by acquire
+func (l *concurrencyLimiter) release() {
+	<-l.sem
+}
+
+// exempt reports whether the call does not take a slot
+// calls made by the gateway and methods excluded by interceptors.FilterMethods (e.g. health checks) are exempt
+func (l *concurrencyLimiter) exempt(ctx context.Context, method string) bool {
+	if !interceptors.FilterMethodsFunc(ctx, method) {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(gatewayLimiterKey) {
+		if subtle.ConstantTimeCompare([]byte(v), []byte(l.token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// concurrencyLimitExceeded returns the error of calls exceeding the limit
+func concurrencyLimitExceeded() error {
+	return status.Error(codes.ResourceExhausted, "too many concurrent requests")
+}
+
+// interceptor rejects unary calls with ResourceExhausted when the limit is reached
+func (l *concurrencyLimiter) interceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if l.exempt(ctx, info.FullMethod) {
+			return handler(ctx, req)
+		}
+		if !l.acquire() {
+			concurrencyLimitRejected.WithLabelValues("grpc").Inc()
+			return nil, concurrencyLimitExceeded()
+		}
+		defer l.release()
+		return handler(ctx, req)
+	}
+}
+
+// streamInterceptor rejects streams with ResourceExhausted when the limit is reached, a stream holds its slot until it ends
+func (l *concurrencyLimiter) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if l.exempt(stream.Context(), info.FullMethod) {
+			return handler(srv, stream)
+		}
+		if !l.acquire() {
+			concurrencyLimitRejected.WithLabelValues("grpc").Inc()
+			return concurrencyLimitExceeded()
+		}
+		defer l.release()
+		return handler(srv, stream)
+	}
+}
+
+// gatewayInterceptor marks the unary calls made by the gateway so that the gRPC server does not count them twice
+func (l *concurrencyLimiter) gatewayInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, gatewayLimiterKey, l.token), method, req, reply, cc, opts...)
+	}
+}
+
+// gatewayStreamInterceptor is the stream equivalent of gatewayInterceptor
+func (l *concurrencyLimiter) gatewayStreamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(metadata.AppendToOutgoingContext(ctx, gatewayLimiterKey, l.token), desc, cc, method, opts...)
+	}
+}
+
+// handler rejects HTTP requests with 503 when the limit is reached
+// paths excluded by interceptors.FilterMethods (e.g. /healthcheck) are not limited
+func (l *concurrencyLimiter) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !interceptors.FilterMethodsFunc(r.Context(), r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire() {
+			concurrencyLimitRejected.WithLabelValues("http").Inc()
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		h.ServeHTTP(w, r)
+	})
+}
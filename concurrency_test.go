@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// blockingMethod is the method of blockingServiceDesc, it waits for the release channel of the server
+const blockingMethod = "/coldbrew.test.Blocking/Wait"
+
+// blockingServiceDesc describes a gRPC service whose only method blocks until the server, a blockingServer, is released
+var blockingServiceDesc = grpc.ServiceDesc{
+	ServiceName: "coldbrew.test.Blocking",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Wait",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(emptypb.Empty)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				srv.(*blockingServer).wait()
+				return &emptypb.Empty{}, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: blockingMethod}, handler)
+		},
+	}},
+}
+
+// blockingServer holds the gRPC and HTTP requests it serves until release is closed
+type blockingServer struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingServer() *blockingServer {
+	return &blockingServer{entered: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (s *blockingServer) wait() {
+	s.entered <- struct{}{}
+	<-s.release
+}
+
+func (s *blockingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.wait()
+}
+
+// waitEntered waits for a request to be held by the server
+func (s *blockingServer) waitEntered(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not reach the server")
+	}
+}
+
+func TestConcurrencyLimitAcrossTransports(t *testing.T) {
+	for _, holder := range []string{"grpc", "http"} {
+		t.Run("held by "+holder, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MaxConcurrentRequests = 1
+			c := newTestCB(t, cfg)
+			srv := newBlockingServer()
+			c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+				server.RegisterService(&blockingServiceDesc, srv)
+				return nil
+			}})
+			// the custom route is not wrapped, it is limited all the same
+			c.SetHTTPHandler("/block", srv)
+			runTestServer(t, c)
+			conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			callGRPC := func() error {
+				return conn.Invoke(context.Background(), blockingMethod, &emptypb.Empty{}, &emptypb.Empty{})
+			}
+			callHTTP := func() (int, error) {
+				resp, err := http.Get("http://" + c.httpAddr + "/block")
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			}
+
+			held := make(chan error, 1)
+			go func() {
+				if holder == "grpc" {
+					held <- callGRPC()
+					return
+				}
+				_, err := callHTTP()
+				held <- err
+			}()
+			srv.waitEntered(t)
+
+			grpcRejected := testutil.ToFloat64(concurrencyLimitRejected.WithLabelValues("grpc"))
+			httpRejected := testutil.ToFloat64(concurrencyLimitRejected.WithLabelValues("http"))
+			if err := callGRPC(); status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("gRPC call over the limit returned %v, want ResourceExhausted", err)
+			}
+			if code, err := callHTTP(); err != nil || code != http.StatusServiceUnavailable {
+				t.Errorf("HTTP request over the limit returned %d, %v, want 503", code, err)
+			}
+			if got := testutil.ToFloat64(concurrencyLimitRejected.WithLabelValues("grpc")) - grpcRejected; got != 1 {
+				t.Errorf("counted %v rejected gRPC calls, want 1", got)
+			}
+			if got := testutil.ToFloat64(concurrencyLimitRejected.WithLabelValues("http")) - httpRejected; got != 1 {
+				t.Errorf("counted %v rejected HTTP requests, want 1", got)
+			}
+
+			close(srv.release)
+			if err := <-held; err != nil {
+				t.Fatalf("request holding the slot failed: %v", err)
+			}
+			if err := callGRPC(); err != nil {
+				t.Errorf("gRPC call after the slot was released returned %v", err)
+			}
+		})
+	}
+}
@@ -18,11 +18,15 @@ type Config struct {
 	LogLevel string `envconfig:"LOG_LEVEL" default:"info"`
 	// Should logs be emitted in json format, defaults to true
 	JSONLogs bool `envconfig:"JSON_LOGS" default:"true"`
+	// LogFormat is the format of the logs, "json" (the default, see JSONLogs) or "gcp" for GCP Cloud Logging structured logs
+	LogFormat string `envconfig:"LOG_FORMAT" default:"json"`
+	// GCPProjectID is the GCP project used to link logs to Cloud Trace when LogFormat is gcp
+	GCPProjectID string `envconfig:"GCP_PROJECT_ID" default:""`
 	// Should we disable swagger at /swagger/, defaults to false
 	DisableSwagger bool `envconfig:"DISABLE_SWAGGER" default:"false"`
 	// SwaggerURL is the URL at which swagger is served, defaults to /swagger/
 	SwaggerURL string `envconfig:"SWAGGER_URL" default:"/swagger/"`
-	// Should we disable go debug at /debug/, defaults to false
+	// Should we disable go debug at /debug/ (pprof, the interceptor chain at /debug/interceptors the runtime stats at /debug/stats and the forced garbage collection at /debug/gc) and the feature flags at /features, defaults to false
 	DisableDebug bool `envconfig:"DISABLE_DEBUG" default:"false"`
 	// Should we disable prometheus at /metrics, defaults to false
 	DisablePormetheus bool `envconfig:"DISABLE_PROMETHEUS" default:"false"`
@@ -38,8 +42,13 @@ type Config struct {
 	NewRelicOpentelemetrySample float64 `envconfig:"NEW_RELIC_OPENTELEMETRY_SAMPLE" default:"0.2"`
 	// The name of the application in NewRelic
 	NewRelicAppname string `envconfig:"NEW_RELIC_APPNAME" default:""`
+	// NewRelicShutdownTimeoutSeconds is how long the New Relic agent can take to send its buffered data when the service stops
+	NewRelicShutdownTimeoutSeconds int `envconfig:"NEW_RELIC_SHUTDOWN_TIMEOUT_SECONDS" default:"5"`
 	// DSN for reporting errors to sentry
 	SentryDSN string `envconfig:"SENTRY_DSN" default:""`
+	// RequireSentry makes startup fail when SentryDSN is not set or invalid
+	// defaults to false, in which case the service starts without reporting errors to Sentry
+	RequireSentry bool `envconfig:"REQUIRE_SENTRY" default:"false"`
 	// Name of this release
 	ReleaseName string `envconfig:"RELEASE_NAME" default:""`
 	// When set disable the GRPC reflecttion server which can be useful for tools like grpccurl, default false
@@ -58,6 +67,15 @@ type Config struct {
 	DisableSignalHandler bool `envconfig:"DISABLE_SIGNAL_HANDLER" default:"false"`
 	// Duration for which CB will wait for calls to complete before shutting down the server
 	ShutdownDurationInSeconds int `envconfig:"SHUTDOWN_DURATION_IN_SECONDS" default:"15"`
+	// ShutdownReportFile is where Stop writes the report of the graceful shutdown, the next process started with the same file
+	// records it in the shutdown metrics and removes the file, as /metrics is no longer served once the shutdown completes
+	ShutdownReportFile string `envconfig:"SHUTDOWN_REPORT_FILE" default:""`
+	// ForceStopGraceMs is the extra time in milliseconds given to in flight gRPC calls after ShutdownDurationInSeconds
+	// before the server is forcefully stopped, defaults to 0
+	ForceStopGraceMs int `envconfig:"FORCE_STOP_GRACE_MS" default:"0"`
+	// ServiceStopTimeoutInSeconds is the time given to the services to stop once the servers are drained
+	// the services stop concurrently, defaults to 0 which uses the shutdown duration
+	ServiceStopTimeoutInSeconds int `envconfig:"SERVICE_STOP_TIMEOUT_IN_SECONDS" default:"0"`
 	// Duration for which CB will wait for healthcheck fail to be propagated before initiating server shutdown
 	// once shutdown is initiated all new calls will fail
 	HealthcheckWaitDurationInSeconds int `envconfig:"GRPC_GRACEFUL_DURATION_IN_SECONDS" default:"7"`
@@ -85,6 +103,9 @@ type Config struct {
 	// DisableAutoMaxProcs disables the automatic setting of GOMAXPROCS
 	// This is useful when running in a container where the container runtime sets GOMAXPROCS for you already
 	DisableAutoMaxProcs bool `envconfig:"DISABLE_AUTO_MAX_PROCS" default:"false"`
+	// MaxProcs when greater than zero sets GOMAXPROCS to this value and skips the automatic setting
+	// This is useful when the container CPU quota detection is not accurate, e.g. with fractional CPUs
+	MaxProcs int `envconfig:"MAX_PROCS" default:"0"`
 
 	// GRPCTLSKeyFile and GRPCTLSCertFile are the paths to the key and cert files for the GRPC server
 	// If these are set, the server will be started with TLS enabled
@@ -95,7 +116,290 @@ type Config struct {
 	// GRPCTLSInsecureSkipVerify is used to skip verification of the server's certificate chain and host name
 	// Only set this to true if you are sure you want to disable TLS verification for the server
 	GRPCTLSInsecureSkipVerify bool `envconfig:"GRPC_TLS_INSECURE_SKIP_VERIFY" default:"false"`
+	// GRPCTLSClientCAFile is the path to the CA certificates verifying the client certificates of the GRPC server (mTLS)
+	// If this is set, clients must present a certificate signed by one of them, LogPeerIdentity then reports its identity
+	// the HTTP gateway presents the server certificate, it must be signed by one of them and allow client authentication
+	GRPCTLSClientCAFile string `envconfig:"GRPC_TLS_CLIENT_CA_FILE"`
+	// GRPCTLSClientCertOptional accepts clients without a certificate when GRPCTLSClientCAFile is set,
+	// certificates presented by clients are still verified
+	GRPCTLSClientCertOptional bool `envconfig:"GRPC_TLS_CLIENT_CERT_OPTIONAL" default:"false"`
+	// HTTPTLSKeyFile and HTTPTLSCertFile are the paths to the key and cert files for the HTTP gateway server
+	// If these are set, the HTTP server will be started with TLS enabled
+	HTTPTLSKeyFile string `envconfig:"HTTP_TLS_KEY_FILE"`
+	// HTTPTLSCertFile and HTTPTLSKeyFile are the paths to the key and cert files for the HTTP gateway server
+	// If these are set, the HTTP server will be started with TLS enabled
+	HTTPTLSCertFile string `envconfig:"HTTP_TLS_CERT_FILE"`
+	// ReuseGRPCTLSForHTTP starts the HTTP gateway server with TLS using GRPCTLSCertFile and GRPCTLSKeyFile
+	// when HTTPTLSCertFile and HTTPTLSKeyFile are not set
+	ReuseGRPCTLSForHTTP bool `envconfig:"REUSE_GRPC_TLS_FOR_HTTP" default:"false"`
 	// DisableVTProtobuf disables the use of the vtprotobuf marshaller and unmarshaller for GRPC
 	// https://github.com/planetscale/vtprotobuf
 	DisableVTProtobuf bool `envconfig:"DISABLE_VT_PROTOBUF" default:"false"`
+	// EnableInterceptorMetrics enables the grpc_interceptor_duration_seconds and grpc_handler_duration_seconds histograms
+	// which report the time spent in interceptors and in the handler separately, defaults to false
+	EnableInterceptorMetrics bool `envconfig:"ENABLE_INTERCEPTOR_METRICS" default:"false"`
+	// HTTPTrailingSlashMode normalizes gateway request paths ending with a trailing slash before routing
+	// "redirect" sends a permanent redirect to the path without the slash, "strip" removes the slash and serves the request
+	// empty (the default) leaves the path untouched
+	HTTPTrailingSlashMode string `envconfig:"HTTP_TRAILING_SLASH_MODE" default:""`
+	// HTTPMethodNotAllowed makes the gateway answer requests with a wrong method with 405 and an Allow header
+	// instead of the grpc-gateway default of 501, defaults to false
+	HTTPMethodNotAllowed bool `envconfig:"HTTP_METHOD_NOT_ALLOWED" default:"false"`
+	// HTTPUnknownQueryParams is how the gateway handles query parameters that do not match a field of the request
+	// "ignore" (the default) drops them and "reject" answers the request with 400
+	HTTPUnknownQueryParams string `envconfig:"HTTP_UNKNOWN_QUERY_PARAMS" default:"ignore"`
+	// GRPCServiceConfig is a JSON encoded gRPC service config (method configs with timeouts, retry policies etc)
+	// It is applied to the gateway dial as the default service config. gRPC servers can not advertise a service config
+	// by themselves, external clients need to receive it through their resolver (e.g. DNS TXT records or xDS)
+	// https://github.com/grpc/grpc/blob/master/doc/service_config.md
+	GRPCServiceConfig string `envconfig:"GRPC_SERVICE_CONFIG" default:""`
+	// OTLPEndpoint is the host:port of an OTLP collector to send traces to
+	// traces are sent to it in addition to New Relic when NewRelicOpentelemetry is enabled with a license key
+	OTLPEndpoint string `envconfig:"OTLP_ENDPOINT" default:""`
+	// OTLPHeaders are the headers sent with every OTLP export, e.g. authentication headers
+	OTLPHeaders map[string]string `envconfig:"OTLP_HEADERS" default:""`
+	// OTLPCompression is the compression used for OTLP exports, "gzip" or "none", defaults to gzip
+	OTLPCompression string `envconfig:"OTLP_COMPRESSION" default:"gzip"`
+	// OTLPProtocol is the transport used for OTLP exports, "grpc" or "http/protobuf", defaults to grpc
+	OTLPProtocol string `envconfig:"OTLP_PROTOCOL" default:"grpc"`
+	// OTLPInsecure disables TLS when connecting to the OTLP collector
+	OTLPInsecure bool `envconfig:"OTLP_INSECURE" default:"false"`
+	// OTLPSamplingRatio is the sampling ratio for traces sent to the OTLP collector
+	OTLPSamplingRatio float64 `envconfig:"OTLP_SAMPLING_RATIO" default:"0.2"`
+	// OTLPDisableRetry disables retrying failed OTLP exports
+	OTLPDisableRetry bool `envconfig:"OTLP_DISABLE_RETRY" default:"false"`
+	// OTLPRetryInitialIntervalSeconds is the time to wait before retrying a failed OTLP export, defaults to 5
+	OTLPRetryInitialIntervalSeconds int `envconfig:"OTLP_RETRY_INITIAL_INTERVAL_SECONDS" default:"5"`
+	// OTLPRetryMaxIntervalSeconds is the upper bound of the backoff between OTLP export retries, defaults to 30
+	OTLPRetryMaxIntervalSeconds int `envconfig:"OTLP_RETRY_MAX_INTERVAL_SECONDS" default:"30"`
+	// OTLPRetryMaxElapsedTimeSeconds is the maximum time spent retrying an OTLP export before the spans are dropped, defaults to 60
+	OTLPRetryMaxElapsedTimeSeconds int `envconfig:"OTLP_RETRY_MAX_ELAPSED_TIME_SECONDS" default:"60"`
+	// OTLPEnableMetrics exports OpenTelemetry metrics to OTLPEndpoint and New Relic in addition to traces, not to JaegerOTLPEndpoint
+	OTLPEnableMetrics bool `envconfig:"OTLP_ENABLE_METRICS" default:"false"`
+	// OTLPMetricsIntervalSeconds is the interval between OTLP metric exports, defaults to 60
+	OTLPMetricsIntervalSeconds int `envconfig:"OTLP_METRICS_INTERVAL_SECONDS" default:"60"`
+	// OTLPMetricsCompression is the compression used for OTLP metric exports, "gzip" or "none", defaults to gzip
+	// it is independent from OTLPCompression so that the more frequent metric exports can be compressed differently
+	OTLPMetricsCompression string `envconfig:"OTLP_METRICS_COMPRESSION" default:"gzip"`
+	// OTLPEnableLogs exports the service logs to OTLPEndpoint and New Relic in addition to writing them to stdout, not to JaegerOTLPEndpoint
+	// logs written within a span carry its trace and span ids
+	OTLPEnableLogs bool `envconfig:"OTLP_ENABLE_LOGS" default:"false"`
+	// JaegerOTLPEndpoint is the host:port of the OTLP gRPC receiver of a Jaeger collector, traces are sent to it
+	// in addition to OTLPEndpoint and New Relic, e.g. while migrating between them
+	// when an OTLP exporter is configured the jaeger client configured with the JAEGER_* environment variables is not used
+	JaegerOTLPEndpoint string `envconfig:"JAEGER_OTLP_ENDPOINT" default:""`
+	// JaegerOTLPInsecure disables TLS when connecting to JaegerOTLPEndpoint
+	JaegerOTLPInsecure bool `envconfig:"JAEGER_OTLP_INSECURE" default:"true"`
+	// OTLPForceSampleHeader is the request header, e.g. x-force-sample, that forces the sampling decision of HTTP requests
+	// true samples the request and false drops it regardless of the sampling ratio, empty disables it
+	OTLPForceSampleHeader string `envconfig:"OTLP_FORCE_SAMPLE_HEADER" default:""`
+	// OTLPDisableOpenTracingBridge traces the HTTP gateway and the gRPC server with the OpenTelemetry instrumentation
+	// instead of the OpenTracing bridge, spans started with OpenTracing (e.g. by the coldbrew interceptors) are not exported
+	// the gateway marshal spans and the gateway calls to the gRPC server are then traced with OpenTelemetry as well
+	OTLPDisableOpenTracingBridge bool `envconfig:"OTLP_DISABLE_OPENTRACING_BRIDGE" default:"false"`
+	// RequireTracing makes startup fail when tracing is not configured or the OTLP collector is unreachable
+	// defaults to false, in which case the service starts without tracing
+	RequireTracing bool `envconfig:"REQUIRE_TRACING" default:"false"`
+	// DisableHTTPAccessLog disables the access log emitted for every HTTP gateway request, defaults to false
+	DisableHTTPAccessLog bool `envconfig:"DISABLE_HTTP_ACCESS_LOG" default:"false"`
+	// HTTPAccessLogBufferSize when greater than zero writes HTTP access logs asynchronously through a buffer of this size
+	// entries are dropped (and counted in http_access_log_dropped_total) when the buffer is full instead of blocking requests
+	HTTPAccessLogBufferSize int `envconfig:"HTTP_ACCESS_LOG_BUFFER_SIZE" default:"0"`
+	// HTTPAccessLogFormat is the format of the HTTP access log, one of "json", "common" or "combined", defaults to json
+	// json logs go through the coldbrew logger, common and combined emit Apache Common/Combined Log Format lines to stdout
+	HTTPAccessLogFormat string `envconfig:"HTTP_ACCESS_LOG_FORMAT" default:"json"`
+	// HTTPAccessLogLevel is the level json HTTP access logs are written at, e.g. debug to only see them when debugging, defaults to info
+	HTTPAccessLogLevel string `envconfig:"HTTP_ACCESS_LOG_LEVEL" default:"info"`
+	// HTTP2MaxConcurrentStreams is the maximum number of concurrent streams per HTTP/2 connection on the gateway
+	// zero uses the golang.org/x/net/http2 default
+	HTTP2MaxConcurrentStreams uint32 `envconfig:"HTTP2_MAX_CONCURRENT_STREAMS" default:"0"`
+	// HTTP2MaxReadFrameSize is the largest HTTP/2 frame the gateway is willing to read, valid values are between 16k and 16M
+	// zero uses the golang.org/x/net/http2 default
+	HTTP2MaxReadFrameSize uint32 `envconfig:"HTTP2_MAX_READ_FRAME_SIZE" default:"0"`
+	// PprofPort when set serves /debug/pprof/ on this port instead of the HTTP gateway port
+	PprofPort int `envconfig:"PPROF_PORT" default:"0"`
+	// PprofAuthToken is the token required to access pprof on PprofPort, either as a bearer token or as the basic auth password
+	// it takes precedence over the debug credentials on PprofPort
+	PprofAuthToken string `envconfig:"PPROF_AUTH_TOKEN" default:""`
+	// DebugAuthUsername and DebugAuthPassword are the basic auth credentials required to access /debug/ and /features
+	// requests without valid credentials get a 401 for any path under /debug/, no credentials leaves the routes open
+	// except for /debug/gc which is only served when credentials are configured
+	DebugAuthUsername string `envconfig:"DEBUG_AUTH_USERNAME" default:""`
+	// DebugAuthPassword is the basic auth password required to access /debug/ and /features, see DebugAuthUsername
+	DebugAuthPassword string `envconfig:"DEBUG_AUTH_PASSWORD" default:""`
+	// DebugBearerToken is a bearer token accepted to access /debug/ and /features, alternatively to the basic auth credentials
+	DebugBearerToken string `envconfig:"DEBUG_BEARER_TOKEN" default:""`
+	// HystrixTimeoutInMilliseconds is the default timeout of hystrix commands, e.g. the gRPC client calls, zero uses the hystrix default of 1000
+	// the hystrix defaults are process wide, they also apply to the hystrix commands of other libraries
+	HystrixTimeoutInMilliseconds int `envconfig:"HYSTRIX_TIMEOUT_IN_MILLISECONDS" default:"0"`
+	// HystrixMaxConcurrentRequests is the default number of concurrent executions of a hystrix command, zero uses the hystrix default of 10
+	HystrixMaxConcurrentRequests int `envconfig:"HYSTRIX_MAX_CONCURRENT_REQUESTS" default:"0"`
+	// HystrixErrorPercentThreshold is the default error percentage opening the circuit of a hystrix command, zero uses the hystrix default of 50
+	HystrixErrorPercentThreshold int `envconfig:"HYSTRIX_ERROR_PERCENT_THRESHOLD" default:"0"`
+	// HystrixCommandTimeoutsInMilliseconds overrides HystrixTimeoutInMilliseconds per command, commands of the gRPC client
+	// interceptors are named after the method, e.g. /package.Service/Method:500
+	HystrixCommandTimeoutsInMilliseconds map[string]int `envconfig:"HYSTRIX_COMMAND_TIMEOUTS_IN_MILLISECONDS" default:""`
+	// HystrixCommandMaxConcurrentRequests overrides HystrixMaxConcurrentRequests per command
+	HystrixCommandMaxConcurrentRequests map[string]int `envconfig:"HYSTRIX_COMMAND_MAX_CONCURRENT_REQUESTS" default:""`
+	// HystrixCommandErrorPercentThresholds overrides HystrixErrorPercentThreshold per command
+	HystrixCommandErrorPercentThresholds map[string]int `envconfig:"HYSTRIX_COMMAND_ERROR_PERCENT_THRESHOLDS" default:""`
+	// TracePropagatorsInbound are the formats used to extract the trace context from incoming requests
+	// supported values are b3, tracecontext (or w3c), baggage and xray, defaults to b3, tracecontext and baggage
+	TracePropagatorsInbound []string `envconfig:"TRACE_PROPAGATORS_INBOUND" default:""`
+	// TracePropagatorsOutbound are the formats used to inject the trace context into outgoing requests
+	// supported values are b3, tracecontext (or w3c), baggage and xray, defaults to b3, tracecontext and baggage
+	TracePropagatorsOutbound []string `envconfig:"TRACE_PROPAGATORS_OUTBOUND" default:""`
+	// DisableReadyz disables the readiness endpoint at /readyz, defaults to false
+	// The endpoint reports not ready while services implementing CBWarmup are warming up and once shutdown has started
+	DisableReadyz bool `envconfig:"DISABLE_READYZ" default:"false"`
+	// RequestCaptureFile when set records a sample of the gRPC requests (method and marshaled request) to this file
+	// The recorded requests can be sent to a server with core.Replay, this is meant for debugging and should not be left on
+	RequestCaptureFile string `envconfig:"REQUEST_CAPTURE_FILE" default:""`
+	// RequestCaptureSampleRate is the ratio of requests recorded to RequestCaptureFile, between 0 and 1
+	RequestCaptureSampleRate float64 `envconfig:"REQUEST_CAPTURE_SAMPLE_RATE" default:"0.01"`
+	// HTTPGzipContentTypes is the list of content types eligible for gzip compression on the gateway
+	// e.g. application/json,text/plain, a type without parameters matches that type with any parameters
+	// empty (the default) compresses all content types
+	HTTPGzipContentTypes []string `envconfig:"HTTP_GZIP_CONTENT_TYPES" default:""`
+	// HTTPGzipLevel is the gzip compression level of the gateway responses, from 1 (best speed) to 9 (best compression)
+	// -1 and 0 are the default level, invalid values fall back to it
+	HTTPGzipLevel int `envconfig:"HTTP_GZIP_LEVEL" default:"-1"`
+	// HTTPGzipMinSize is the minimum size in bytes of a gateway response to be compressed, zero uses the default of 1400
+	HTTPGzipMinSize int `envconfig:"HTTP_GZIP_MIN_SIZE" default:"1400"`
+	// DisableHTTPGzip disables gzip compression of the gateway responses
+	DisableHTTPGzip bool `envconfig:"DISABLE_HTTP_GZIP" default:"false"`
+	// ContextValues are static key value pairs (e.g. region:us-east-1,cluster:main) injected into the context of every call
+	// handlers can read them with core.ContextValue(ctx, key)
+	ContextValues map[string]string `envconfig:"CONTEXT_VALUES" default:""`
+	// MaxNewConnectionsPerSecond limits the rate at which new connections are accepted on each of the gRPC and HTTP ports
+	// connections above the rate wait in the listen backlog, zero (the default) disables the limit
+	MaxNewConnectionsPerSecond int `envconfig:"MAX_NEW_CONNECTIONS_PER_SECOND" default:"0"`
+	// DisableGatewayUpstreamMetrics disables grpc_gateway_upstream_duration_seconds, the latency of the gRPC calls made by the HTTP gateway
+	DisableGatewayUpstreamMetrics bool `envconfig:"DISABLE_GATEWAY_UPSTREAM_METRICS" default:"false"`
+	// GatewaySlowCallThresholdMs logs the gRPC calls made by the HTTP gateway that take longer than this many milliseconds
+	// zero (the default) disables logging
+	GatewaySlowCallThresholdMs int `envconfig:"GATEWAY_SLOW_CALL_THRESHOLD_MS" default:"0"`
+	// StaticFilesDir when set serves the files in this directory on the HTTP gateway under StaticFilesPath
+	StaticFilesDir string `envconfig:"STATIC_FILES_DIR" default:""`
+	// StaticFilesPath is the path prefix under which StaticFilesDir is served, e.g. /static/
+	// swagger, pprof, readyz, startupz and metrics take precedence over the static files, it should not overlap with gateway routes
+	// an empty or / path would shadow every other route and is refused unless StaticFilesAllowRoot is set
+	// directories are only served when they contain an index.html, there are no directory listings
+	StaticFilesPath string `envconfig:"STATIC_FILES_PATH" default:"/static/"`
+	// StaticFilesAllowRoot allows serving StaticFilesDir at / in which case the gateway routes are no longer reachable
+	StaticFilesAllowRoot bool `envconfig:"STATIC_FILES_ALLOW_ROOT" default:"false"`
+	// TracingRedactTags are span tag keys (e.g. http.url or a forwarded header) whose values are replaced by a hash before being attached to spans
+	// keys are case insensitive, hashing keeps equal values correlatable without exposing them
+	// the attributes of the OpenTelemetry spans, with or without the OpenTracing bridge, are redacted before they are exported
+	TracingRedactTags []string `envconfig:"TRACING_REDACT_TAGS" default:""`
+	// MaxConcurrentRequests is the maximum number of requests served concurrently across the gRPC server and the HTTP gateway
+	// requests over the limit fail with ResourceExhausted on gRPC and 503 on HTTP, gateway requests only take one slot
+	// methods excluded by interceptors.FilterMethods (e.g. health checks) are not limited, zero (the default) disables the limit
+	// on HTTP the gateway, the SetHTTPHandler routes and the static files are limited, the metrics, debug, swagger and probe endpoints are not
+	MaxConcurrentRequests int `envconfig:"MAX_CONCURRENT_REQUESTS" default:"0"`
+	// MaxRequestDurationSeconds caps the duration of every gRPC call regardless of the client deadline
+	// calls running longer are cancelled and fail with DeadlineExceeded, zero (the default) disables the cap
+	// the cap cancels the context of the call, handlers that do not honour their context keep running past it
+	MaxRequestDurationSeconds int `envconfig:"MAX_REQUEST_DURATION_SECONDS" default:"0"`
+	// DependencyHealthTargets are downstream gRPC dependencies checked with the grpc.health.v1 protocol, e.g. users:9090,orders:9090/orders.Orders
+	// the service is not ready on /readyz while any of them is not serving, connections are made without TLS
+	DependencyHealthTargets []string `envconfig:"DEPENDENCY_HEALTH_TARGETS" default:""`
+	// DependencyHealthIntervalSeconds is the interval between two health checks of each dependency
+	DependencyHealthIntervalSeconds int `envconfig:"DEPENDENCY_HEALTH_INTERVAL_SECONDS" default:"10"`
+	// EnableGRPCResponseCompression compresses unary responses with gzip when the client advertises gzip support in grpc-accept-encoding
+	EnableGRPCResponseCompression bool `envconfig:"ENABLE_GRPC_RESPONSE_COMPRESSION" default:"false"`
+	// GRPCResponseCompressionMinBytes is the minimum size of a response to be compressed with EnableGRPCResponseCompression
+	GRPCResponseCompressionMinBytes int `envconfig:"GRPC_RESPONSE_COMPRESSION_MIN_BYTES" default:"1024"`
+	// DefaultServerCompressor is the compressor, e.g. gzip, used for gRPC responses when the client supports it
+	// handlers can still override it with grpc.SetSendCompressor, empty disables it
+	DefaultServerCompressor string `envconfig:"DEFAULT_SERVER_COMPRESSOR" default:""`
+	// LogMetadataKeys are incoming gRPC metadata keys whose values are added to the log context of every call, e.g. x-client-id
+	LogMetadataKeys []string `envconfig:"LOG_METADATA_KEYS" default:""`
+	// LogMetadataMaskedKeys are metadata keys added to the log context with their values replaced by a hash, e.g. authorization
+	LogMetadataMaskedKeys []string `envconfig:"LOG_METADATA_MASKED_KEYS" default:""`
+	// GatewayKeepaliveTimeSeconds is the interval of the keepalive pings sent by the HTTP gateway on its gRPC connection when idle
+	// zero (the default) disables keepalive pings, servers reject pings more frequent than their enforcement policy (5 minutes by default)
+	// so the enforcement policy of the coldbrew gRPC server is lowered to this interval when it is shorter
+	GatewayKeepaliveTimeSeconds int `envconfig:"GATEWAY_KEEPALIVE_TIME_SECONDS" default:"0"`
+	// GatewayKeepaliveTimeoutSeconds is how long the gateway waits for a keepalive ping ack before closing the connection
+	GatewayKeepaliveTimeoutSeconds int `envconfig:"GATEWAY_KEEPALIVE_TIMEOUT_SECONDS" default:"20"`
+	// TracingSamplingRatioByEnvironment overrides the tracing sampling ratio for the current Environment, e.g. production:0.01,staging:1
+	// it applies to both OTLPSamplingRatio and NewRelicOpentelemetrySample, environments not listed use those values
+	TracingSamplingRatioByEnvironment map[string]float64 `envconfig:"TRACING_SAMPLING_RATIO_BY_ENVIRONMENT" default:""`
+	// AdminAuthToken enables the admin endpoints on the HTTP gateway, requests must carry it as a bearer token or basic auth password
+	// /admin/sampling temporarily overrides the OpenTelemetry trace sampling ratio, e.g. POST ratio=1&duration=10m
+	AdminAuthToken string `envconfig:"ADMIN_AUTH_TOKEN" default:""`
+	// SamplingOverrideDefaultSeconds is how long a sampling override lasts when no duration is provided
+	SamplingOverrideDefaultSeconds int `envconfig:"SAMPLING_OVERRIDE_DEFAULT_SECONDS" default:"600"`
+	// LogPeerIdentity adds the authenticated identity of the caller (SPIFFE ID, certificate common name or ALTS service account)
+	// to the log context of every call as peer_identity, it requires mTLS (see GRPCTLSClientCAFile) or ALTS
+	LogPeerIdentity bool `envconfig:"LOG_PEER_IDENTITY" default:"false"`
+	// DisableProtoMarshaller stops the HTTP gateway from serving application/proto and application/protobuf,
+	// requests with those content types are then handled by the default JSON marshaller
+	DisableProtoMarshaller bool `envconfig:"DISABLE_PROTO_MARSHALLER" default:"false"`
+	// MetricsLabelsFromMetadata maps label names to incoming metadata keys, e.g. tenant:x-tenant-id,api_version:x-api-version
+	// when set grpc_server_labeled_handled_total and grpc_server_labeled_handling_seconds are recorded with these extra labels
+	// every distinct combination of values creates new series, only use metadata with a small bounded set of values
+	MetricsLabelsFromMetadata map[string]string `envconfig:"METRICS_LABELS_FROM_METADATA" default:""`
+	// EnableGracefulRestart restarts the service without downtime on SIGHUP, a new process is started with the listening sockets
+	// of this one which then shuts down gracefully, it requires the signal handler and a platform supporting file descriptor passing
+	EnableGracefulRestart bool `envconfig:"ENABLE_GRACEFUL_RESTART" default:"false"`
+	// GRPCMaxRecvMsgSize is the maximum size in bytes of a message the gRPC server can receive, zero uses the gRPC default of 4MB
+	// it also sets the maximum size of the requests sent by the HTTP gateway
+	GRPCMaxRecvMsgSize int `envconfig:"GRPC_MAX_RECV_MSG_SIZE" default:"0"`
+	// GRPCMaxSendMsgSize is the maximum size in bytes of a message the gRPC server can send, zero uses the gRPC default (unlimited)
+	// it also sets the maximum size of the responses received by the HTTP gateway, which is 4MB by default
+	GRPCMaxSendMsgSize int `envconfig:"GRPC_MAX_SEND_MSG_SIZE" default:"0"`
+	// GatewayMaxRecvMsgSize is the maximum size in bytes of a response the HTTP gateway accepts from the gRPC server
+	// it overrides the limit derived from GRPCMaxSendMsgSize so that the trusted gateway can receive larger responses than external clients
+	GatewayMaxRecvMsgSize int `envconfig:"GATEWAY_MAX_RECV_MSG_SIZE" default:"0"`
+	// EnableGRPCStatusClassMetrics records grpc_server_handled_by_class_total, completed calls classified as ok, client_error or server_error
+	// the class follows the HTTP status of the code, e.g. InvalidArgument and FailedPrecondition are client errors
+	EnableGRPCStatusClassMetrics bool `envconfig:"ENABLE_GRPC_STATUS_CLASS_METRICS" default:"false"`
+	// DisableGRPCHealth stops registering the grpc.health.v1 service on the gRPC server, its status is set with CB.Health()
+	// and is shared with /readyz, it is not registered either when a service registers grpc.health.v1 itself
+	DisableGRPCHealth bool `envconfig:"DISABLE_GRPC_HEALTH" default:"false"`
+	// WrapHTTPHandlers wraps the routes registered with CB.SetHTTPHandler with the gateway tracing and gzip handlers
+	WrapHTTPHandlers bool `envconfig:"WRAP_HTTP_HANDLERS" default:"false"`
+	// PanicChannelSize enables CB.PanicChannel, panics recovered in gRPC handlers are delivered to a channel of this size
+	// in addition to being logged and notified, events are dropped when the channel is full
+	PanicChannelSize int `envconfig:"PANIC_CHANNEL_SIZE" default:"0"`
+	// EchoTraceIDInResponse sends the trace id of every gRPC call, received or generated, back to the client
+	// in the response header metadata under TraceHeaderName
+	EchoTraceIDInResponse bool `envconfig:"ECHO_TRACE_ID_IN_RESPONSE" default:"false"`
+	// GenerateRequestIDIfMissing generates a UUID for HTTP requests without TraceHeaderName, the id is added to the logs,
+	// forwarded to the gRPC server and sent back in the response header, gRPC calls get it back as with EchoTraceIDInResponse
+	GenerateRequestIDIfMissing bool `envconfig:"GENERATE_REQUEST_ID_IF_MISSING" default:"false"`
+	// DisableStartupz disables the startup endpoint at /startupz, meant for the Kubernetes startupProbe
+	// The endpoint reports not started until the servers are initialized and services implementing CBWarmup are warmed up, then always started
+	DisableStartupz bool `envconfig:"DISABLE_STARTUPZ" default:"false"`
+	// EnableH2C serves HTTP/2 without TLS (h2c) on the HTTP port, both with prior knowledge and with the HTTP/1.1 upgrade
+	// so that clients can send gRPC-Web or gRPC to it without TLS, HTTP/1.1 requests keep working
+	EnableH2C bool `envconfig:"ENABLE_H2C" default:"false"`
+	// EnableGatewayMarshalSpans adds gateway.unmarshal and gateway.marshal spans to HTTP gateway requests
+	// so that the time spent decoding the request body and encoding the response shows apart from the upstream call
+	EnableGatewayMarshalSpans bool `envconfig:"ENABLE_GATEWAY_MARSHAL_SPANS" default:"false"`
+	// DefaultContentType is used as the Content-Type and Accept of HTTP gateway requests that do not send them, e.g. application/json
+	// or application/proto, it selects the marshaler used for those requests, empty leaves them to the grpc-gateway default
+	DefaultContentType string `envconfig:"DEFAULT_CONTENT_TYPE" default:""`
+	// LogGatewayMarshaler logs the MIME types of the marshalers selected for every HTTP gateway request at debug level
+	// together with its Content-Type and Accept headers, it helps debugging content negotiation
+	LogGatewayMarshaler bool `envconfig:"LOG_GATEWAY_MARSHALER" default:"false"`
+	// DefaultRequestTimeoutInSeconds is the deadline applied to gRPC calls whose client did not set one, zero disables it
+	// calls with a client deadline are left untouched and methods excluded by interceptors.FilterMethods are not affected
+	DefaultRequestTimeoutInSeconds int `envconfig:"DEFAULT_REQUEST_TIMEOUT_IN_SECONDS" default:"0"`
+	// TracePropagationSuppressedTargets are downstream gRPC targets (host or host:port) that do not receive trace context or baggage
+	// it applies to the clients dialed with the options returned by CB.TracePropagationDialOptions
+	TracePropagationSuppressedTargets []string `envconfig:"TRACE_PROPAGATION_SUPPRESSED_TARGETS" default:""`
+	// TLSDisableSessionTickets disables TLS session tickets on the gRPC and HTTP servers, resumed sessions are then not supported
+	TLSDisableSessionTickets bool `envconfig:"TLS_DISABLE_SESSION_TICKETS" default:"false"`
+	// TLSSessionTicketKeyRotationSeconds rotates the TLS session ticket keys of the gRPC and HTTP servers at this interval
+	// a ticket can be resumed for at most two intervals, zero leaves the keys to crypto/tls which rotates them daily
+	TLSSessionTicketKeyRotationSeconds int `envconfig:"TLS_SESSION_TICKET_KEY_ROTATION_SECONDS" default:"0"`
+	// TLSNextProtos are the ALPN protocols advertised by the gRPC and HTTP servers with TLS, e.g. h2
+	// gRPC always advertises h2 and the HTTP server always advertises http/1.1, the defaults are used when empty
+	TLSNextProtos []string `envconfig:"TLS_NEXT_PROTOS" default:""`
+	// MethodLogLevels overrides the log level of the calls to some gRPC methods, including their request log
+	// e.g. /pkg.Service/HighVolume:error,/pkg.Admin/Update:debug
+	MethodLogLevels map[string]string `envconfig:"METHOD_LOG_LEVELS" default:""`
 }
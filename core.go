@@ -8,40 +8,79 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/http/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
+	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-coldbrew/core/config"
 	"github.com/go-coldbrew/interceptors"
 	"github.com/go-coldbrew/log"
 	"github.com/go-coldbrew/log/loggers"
 	"github.com/go-coldbrew/options"
+	nrutil "github.com/go-coldbrew/tracing/newrelic"
 	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
 )
 
 type cb struct {
-	svc            []CBService
-	openAPIHandler http.Handler
-	config         config.Config
-	closers        []io.Closer
-	grpcServer     *grpc.Server
-	httpServer     *http.Server
-	cancelFunc     context.CancelFunc
-	gracefulWait   sync.WaitGroup
-	creds          credentials.TransportCredentials
+	svc                     []CBService
+	openAPIHandler          http.Handler
+	notFoundHandler         http.Handler
+	methodNotAllowedHandler http.Handler
+	config                  config.Config
+	closers                 []io.Closer
+	serversMu               sync.RWMutex
+	grpcServer              *grpc.Server
+	httpServer              *http.Server
+	pprofServer             *http.Server
+	cancelFunc              context.CancelFunc
+	gracefulWait            sync.WaitGroup
+	creds                   credentials.TransportCredentials
+	customCreds             credentials.TransportCredentials
+	grpcServerOptions       []grpc.ServerOption
+	health                  *HealthManager
+	httpHandlers            *http.ServeMux
+	subscribers             []func(Event)
+	subscribersMu           sync.RWMutex
+	setupErr                error
+	inFlight                atomic.Int64
+	shutdownReport          atomic.Pointer[ShutdownReport]
+	shuttingDown            atomic.Bool
+	capturer                *requestCapturer
+	dependencies            []*dependencyHealth
+	panics                  chan PanicEvent
+	limiter                 *concurrencyLimiter
+	serveMuxOptions         []runtime.ServeMuxOption
+	initialized             atomic.Bool
+	started                 atomic.Bool
+	unknownServiceHandler   grpc.StreamHandler
+	interceptorChain        interceptorChain
+	serversReady            chan struct{}
+	listening               chan struct{}
+	ticketRotator           *sessionTicketRotator
+	grpcAddr                string
+	httpAddr                string
+	listeners               *restartListeners
+	stopRestartWatcher      context.CancelFunc
+	tracing                 tracingMode
 }
 
 func (c *cb) SetService(svc CBService) error {
@@ -59,9 +98,104 @@ func (c *cb) SetOpenAPIHandler(handler http.Handler) {
 	c.openAPIHandler = handler
 }
 
+// SetNotFoundHandler sets the handler used by the gateway for requests that do not match any route
+// This is optional, when not set the grpc-gateway default is used
+func (c *cb) SetNotFoundHandler(handler http.Handler) {
+	c.notFoundHandler = handler
+}
+
+// SetTransportCredentials sets the credentials of the gRPC server, e.g. SPIFFE based mTLS or ALTS
+// They are used instead of GRPCTLSCertFile/GRPCTLSKeyFile and by the gateway to dial the gRPC server,
+// so they must support client handshakes as well, it has to be called before Run
+func (c *cb) SetTransportCredentials(creds credentials.TransportCredentials) {
+	c.customCreds = creds
+}
+
+// TracePropagationDialOptions returns the dial options removing trace context and baggage from calls to TracePropagationSuppressedTargets
+// they must be used by the clients of the downstream services, after the coldbrew client interceptors which inject the trace context
+func (c *cb) TracePropagationDialOptions() []grpc.DialOption {
+	return TracePropagationDialOptions(c.config.TracePropagationSuppressedTargets...)
+}
+
+// Health returns the health manager driving the grpc.health.v1 service and the readiness endpoint
+func (c *cb) Health() *HealthManager {
+	return c.health
+}
+
+// GRPCServer returns the gRPC server created by Run, e.g. to inspect the registered services
+// It is nil until Run has initialized the servers, wait on ServersReady before using it, it stays nil when Run failed to initialize them
+// gRPC does not allow registering services once the server is serving, services registered from InitGRPC are always safe
+func (c *cb) GRPCServer() *grpc.Server {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.grpcServer
+}
+
+// HTTPServer returns the HTTP gateway server created by Run
+// It is nil until Run has initialized the servers, wait on ServersReady before using it, it stays nil when Run failed to initialize them
+func (c *cb) HTTPServer() *http.Server {
+	c.serversMu.RLock()
+	defer c.serversMu.RUnlock()
+	return c.httpServer
+}
+
+// ServersReady returns a channel that is closed once Run has initialized the gRPC and HTTP servers, before they start serving
+// it is closed as well when Run returns before, GRPCServer and HTTPServer then return nil
+func (c *cb) ServersReady() <-chan struct{} {
+	return c.serversReady
+}
+
+// SetHTTPHandler registers an additional route on the HTTP gateway server, e.g. /livez or a webhook receiver
+// pattern follows the http.ServeMux syntax, the routes are checked after swagger, pprof, readyz, startupz and metrics
+// and before the gateway mux, they are wrapped with the gateway tracing and gzip handlers when WrapHTTPHandlers is set
+// It has to be called before Run
+func (c *cb) SetHTTPHandler(pattern string, handler http.Handler) {
+	if c.httpHandlers == nil {
+		c.httpHandlers = http.NewServeMux()
+	}
+	c.httpHandlers.Handle(pattern, handler)
+}
+
+// SetGRPCServerOptions sets additional options for the gRPC server, e.g. grpc.MaxConcurrentStreams or a stats handler
+// They are applied after the options derived from the config (interceptors, keepalive, credentials) so they take precedence
+// for options that can only be set once, interceptor options are chained after the default interceptors
+// It has to be called before Run
+func (c *cb) SetGRPCServerOptions(opts ...grpc.ServerOption) {
+	c.grpcServerOptions = append(c.grpcServerOptions, opts...)
+}
+
+// SetServeMuxOptions sets additional options for the grpc-gateway ServeMux, e.g. runtime.WithForwardResponseOption
+// They are applied after the options derived from the config so they take precedence where grpc-gateway allows overriding,
+// e.g. runtime.WithErrorHandler replaces the default error handler and runtime.WithMarshalerOption the marshaler of a content type
+// It has to be called before Run
+func (c *cb) SetServeMuxOptions(opts ...runtime.ServeMuxOption) {
+	c.serveMuxOptions = append(c.serveMuxOptions, opts...)
+}
+
+// SetUnknownServiceHandler sets the handler for calls to services that are not registered on the gRPC server, e.g. to proxy them
+// The handler is called as a stream handler, through the stream interceptors, instead of returning Unimplemented
+// It has to be called before Run
+func (c *cb) SetUnknownServiceHandler(handler grpc.StreamHandler) {
+	c.unknownServiceHandler = handler
+}
+
+// SetMethodNotAllowedHandler sets the handler used by the gateway for requests that match a route with a different method
+// The Allow header is set before the handler is called
+// This is optional, when not set the grpc-gateway default is used unless HTTPMethodNotAllowed is configured
+func (c *cb) SetMethodNotAllowedHandler(handler http.Handler) {
+	c.methodNotAllowedHandler = handler
+}
+
 // processConfig processes the config and sets up the logger, newrelic, sentry, environment, release name, jaeger, hystrix prometheus and signal handler
-func (c *cb) processConfig() {
-	SetupLogger(c.config.LogLevel, c.config.JSONLogs)
+// It returns an error if a component that is configured as required could not be set up
+func (c *cb) processConfig() error {
+	setupLogger(c.config.LogFormat, c.config.LogLevel, c.config.JSONLogs, c.config.GCPProjectID)
+	if (c.config.GRPCTLSCertFile == "") != (c.config.GRPCTLSKeyFile == "") {
+		return errors.New("GRPCTLSCertFile and GRPCTLSKeyFile must be set together")
+	}
+	if (c.config.HTTPTLSCertFile == "") != (c.config.HTTPTLSKeyFile == "") {
+		return errors.New("HTTPTLSCertFile and HTTPTLSKeyFile must be set together")
+	}
 
 	if !c.config.DisableVTProtobuf {
 		InitializeVTProto()
@@ -70,58 +204,211 @@ func (c *cb) processConfig() {
 	if nrName == "" {
 		nrName = c.config.AppName
 	}
-	if !c.config.DisableAutoMaxProcs {
+	if c.config.MaxProcs > 0 {
+		SetupMaxProcs(c.config.MaxProcs)
+	} else if !c.config.DisableAutoMaxProcs {
 		SetupAutoMaxProcs()
 	}
+	// GOMAXPROCS is reported even when it is left to the Go runtime
+	registerCollector(goMaxProcs)
 	SetupNewRelic(nrName, c.config.NewRelicLicenseKey, c.config.NewRelicDistributedTracing)
-	SetupSentry(c.config.SentryDSN)
+	if nrutil.GetNewRelicApp() != nil {
+		c.closers = append(c.closers, newRelicCloser{timeout: time.Duration(c.config.NewRelicShutdownTimeoutSeconds) * time.Second})
+	}
+	if err := setupSentry(c.config.SentryDSN); err != nil && c.config.RequireSentry {
+		return err
+	} else if c.config.SentryDSN == "" && c.config.RequireSentry {
+		return errors.New("sentry is required but no DSN is configured")
+	}
 	SetupEnvironment(c.config.Environment)
 	SetupReleaseName(c.config.ReleaseName)
-	cls := setupJaeger(c.config.AppName)
-	if cls != nil {
-		c.closers = append(c.closers, cls)
+	if err := SetupTracePropagators(c.config.TracePropagatorsInbound, c.config.TracePropagatorsOutbound); err != nil {
+		return err
+	}
+	if len(c.otlpConfigs()) == 0 {
+		// the OpenTelemetry tracer replaces the jaeger tracer, JaegerOTLPEndpoint sends the traces to jaeger with it
+		cls := setupJaeger(c.config.AppName, c.config.TracePropagatorsInbound, c.config.TracePropagatorsOutbound)
+		if cls != nil {
+			c.closers = append(c.closers, cls)
+		}
 	}
 	SetupHystrixPrometheus()
+	SetupHystrix(hystrix.CommandConfig{
+		Timeout:               c.config.HystrixTimeoutInMilliseconds,
+		MaxConcurrentRequests: c.config.HystrixMaxConcurrentRequests,
+		ErrorPercentThreshold: c.config.HystrixErrorPercentThreshold,
+	}, hystrixCommands(c.config.HystrixCommandTimeoutsInMilliseconds, c.config.HystrixCommandMaxConcurrentRequests, c.config.HystrixCommandErrorPercentThresholds))
 	ConfigureInterceptors(c.config.DoNotLogGRPCReflection, c.config.TraceHeaderName)
 	if !c.config.DisableSignalHandler {
-		dur := time.Second * 10
-		if c.config.ShutdownDurationInSeconds > 0 {
-			dur = time.Second * time.Duration(c.config.ShutdownDurationInSeconds)
-		}
+		dur := c.shutdownDuration()
 		startSignalHandler(c, dur)
+		if c.config.EnableGracefulRestart {
+			ctx, cancel := context.WithCancel(context.Background())
+			c.stopRestartWatcher = cancel
+			go restartWatcher(ctx, c, dur)
+		}
 	}
 	if c.config.EnablePrometheusGRPCHistogram {
 		grpc_prometheus.EnableHandlingTimeHistogram()
 	}
-	if c.config.NewRelicOpentelemetry {
-		SetupNROpenTelemetry(nrName, c.config.NewRelicLicenseKey, c.config.ReleaseName, c.config.NewRelicOpentelemetrySample)
+	// grpc_prometheus registers its metrics with the default registry on init
+	registerCollector(grpc_prometheus.DefaultServerMetrics)
+	if c.config.EnableInterceptorMetrics {
+		setupInterceptorMetrics()
+	}
+	if err := validateMetricsLabels(c.config.MetricsLabelsFromMetadata); err != nil {
+		return err
+	}
+	setupShutdownMetrics()
+	if c.config.ShutdownReportFile != "" {
+		loadShutdownReport(c.config.ShutdownReportFile)
 	}
+	if otlpConfigs := c.otlpConfigs(); len(otlpConfigs) > 0 {
+		if err := SetupOpenTelemetryExporters(otlpConfigs...); err != nil {
+			if c.config.RequireTracing {
+				return err
+			}
+		} else if c.config.OTLPDisableOpenTracingBridge {
+			c.tracing = tracingNative
+		} else {
+			c.tracing = tracingBridge
+		}
+		if otelMeterProvider != nil {
+			c.closers = append(c.closers, otelProviderCloser{provider: otelMeterProvider, timeout: otelShutdownTimeout})
+		}
+		if otelLoggerProvider != nil {
+			c.closers = append(c.closers, otelProviderCloser{provider: otelLoggerProvider, timeout: otelShutdownTimeout})
+		}
+	} else if c.config.RequireTracing {
+		return errors.New("tracing is required but no OTLP endpoint is configured")
+	}
+	if len(c.config.TracingRedactTags) > 0 && c.tracing == tracingOpenTracing {
+		// the OpenTelemetry spans, including the ones of the bridge, are redacted by the exporters
+		opentracing.SetGlobalTracer(newRedactingTracer(opentracing.GlobalTracer(), c.config.TracingRedactTags))
+	}
+	return nil
+}
+
+// otlpConfigs returns the configs of the OTLP collectors traces are exported to, the first one sets the service name and sampling ratio
+// metrics and logs are only exported to OTLPEndpoint and New Relic, jaeger only receives traces
+func (c *cb) otlpConfigs() []OTLPConfig {
+	var configs []OTLPConfig
+	if c.config.OTLPEndpoint != "" {
+		configs = append(configs, OTLPConfig{
+			Endpoint:           c.config.OTLPEndpoint,
+			Headers:            c.config.OTLPHeaders,
+			ServiceName:        c.config.AppName,
+			ServiceVersion:     c.config.ReleaseName,
+			SamplingRatio:      c.config.OTLPSamplingRatio,
+			Compression:        c.config.OTLPCompression,
+			Insecure:           c.config.OTLPInsecure,
+			Protocol:           c.config.OTLPProtocol,
+			EnableMetrics:      c.config.OTLPEnableMetrics,
+			MetricsCompression: c.config.OTLPMetricsCompression,
+			EnableLogs:         c.config.OTLPEnableLogs,
+		})
+	}
+	if c.config.NewRelicOpentelemetry && c.config.AppName != "" && c.config.NewRelicLicenseKey != "" {
+		nr := newRelicOTLPConfig(c.config.AppName, c.config.NewRelicLicenseKey, c.config.ReleaseName, c.config.NewRelicOpentelemetrySample)
+		// OTLPEndpoint may already point at New Relic, it must not receive everything twice
+		if nr.Endpoint != c.config.OTLPEndpoint {
+			nr.EnableMetrics = c.config.OTLPEnableMetrics
+			nr.EnableLogs = c.config.OTLPEnableLogs
+			configs = append(configs, nr)
+		}
+	}
+	if c.config.JaegerOTLPEndpoint != "" {
+		configs = append(configs, OTLPConfig{
+			Endpoint:       c.config.JaegerOTLPEndpoint,
+			ServiceName:    c.config.AppName,
+			ServiceVersion: c.config.ReleaseName,
+			SamplingRatio:  c.config.OTLPSamplingRatio,
+			Compression:    c.config.OTLPCompression,
+			Insecure:       c.config.JaegerOTLPInsecure,
+		})
+	}
+	for i := range configs {
+		if ratio, ok := c.config.TracingSamplingRatioByEnvironment[c.config.Environment]; ok {
+			configs[i].SamplingRatio = ratio
+		}
+		configs[i].VerifyConnection = c.config.RequireTracing
+		configs[i].DisableRetry = c.config.OTLPDisableRetry
+		configs[i].RetryInitialInterval = time.Duration(c.config.OTLPRetryInitialIntervalSeconds) * time.Second
+		configs[i].RetryMaxInterval = time.Duration(c.config.OTLPRetryMaxIntervalSeconds) * time.Second
+		configs[i].RetryMaxElapsedTime = time.Duration(c.config.OTLPRetryMaxElapsedTimeSeconds) * time.Second
+		configs[i].MetricsInterval = time.Duration(c.config.OTLPMetricsIntervalSeconds) * time.Second
+		configs[i].ForceSampleHeader = c.config.OTLPForceSampleHeader
+		configs[i].DisableOpenTracingBridge = c.config.OTLPDisableOpenTracingBridge
+		configs[i].RedactAttributes = c.config.TracingRedactTags
+	}
+	return configs
 }
 
 // https://grpc-ecosystem.github.io/grpc-gateway/docs/operations/tracing/#opentracing-support
 var grpcGatewayTag = opentracing.Tag{Key: string(ext.Component), Value: "grpc-gateway"}
 
+// tracingMode is how the servers trace the requests
+type tracingMode int
+
+const (
+	// tracingOpenTracing traces with the global OpenTracing tracer, e.g. jaeger
+	tracingOpenTracing tracingMode = iota
+	// tracingBridge traces with OpenTelemetry, the spans are visible to OpenTracing through the bridge
+	tracingBridge
+	// tracingNative traces with the OpenTelemetry instrumentation only, the OpenTracing bridge is disabled
+	tracingNative
+)
+
 // tracingWrapper is a middleware that creates a new span for each incoming request.
+// the span is started with OpenTelemetry directly when the OpenTracing bridge is disabled
+// the trace context of the request is extracted with the inbound propagators, see SetupTracePropagators
 // It also adds the span to the context so it can be used by other middlewares or handlers to add additional tags.
-func tracingWrapper(h http.Handler) http.Handler {
+func (c *cb) tracingWrapper(h http.Handler) http.Handler {
+	if c.tracing == tracingNative {
+		return otelHTTPHandler(httpLogContext(h))
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.tracing == tracingBridge {
+			// the bridge would extract with the global propagator, the inbound propagators are used explicitly instead
+			if interceptors.FilterMethodsFunc(r.Context(), r.URL.Path) {
+				var span trace.Span
+				r, span = startBridgeHTTPSpan(r)
+				defer span.End()
+			}
+			httpLogContext(h).ServeHTTP(w, r)
+			return
+		}
+		// the jaeger tracer extracts with the extractors of the inbound formats, see setupJaeger
 		parentSpanContext, err := opentracing.GlobalTracer().Extract(
 			opentracing.HTTPHeaders,
 			opentracing.HTTPHeadersCarrier(r.Header))
 		if err == nil || err == opentracing.ErrSpanContextNotFound {
 			if interceptors.FilterMethodsFunc(r.Context(), r.URL.Path) {
-				serverSpan := opentracing.GlobalTracer().StartSpan(
-					"ServeHTTP",
+				opts := []opentracing.StartSpanOption{
 					// this is magical, it attaches the new span to the parent parentSpanContext, and creates an unparented one if empty.
 					ext.RPCServerOption(parentSpanContext),
 					grpcGatewayTag,
 					opentracing.Tag{Key: string(ext.HTTPUrl), Value: r.URL.Path},
 					opentracing.Tag{Key: string(ext.HTTPMethod), Value: r.Method},
-				)
+				}
+				if key := forceSamplingKey; key != "" {
+					if v := r.Header.Get(key); v != "" {
+						// read by the sampler to force the sampling decision
+						opts = append(opts, opentracing.Tag{Key: strings.ToLower(key), Value: v})
+					}
+				}
+				serverSpan := opentracing.GlobalTracer().StartSpan("ServeHTTP", opts...)
 				r = r.WithContext(opentracing.ContextWithSpan(r.Context(), serverSpan))
 				defer serverSpan.Finish()
 			}
 		}
+		httpLogContext(h).ServeHTTP(w, r)
+	})
+}
+
+// httpLogContext is a middleware that starts the New Relic transaction of the request and adds its path to the log context
+func httpLogContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, han := interceptors.NRHttpTracer("", h.ServeHTTP)
 		// add this info to log
 		ctx := r.Context()
@@ -152,12 +439,19 @@ func getCustomHeaderMatcher(prefixes []string, header string) func(string) (stri
 	}
 }
 
+// gatewayOpenTracingFilter returns the methods the OpenTracing client interceptor of the gateway traces
+// none when the OpenTracing bridge is disabled, the calls are then traced by otelgrpc
+func (c *cb) gatewayOpenTracingFilter() grpc_opentracing.FilterFunc {
+	if c.tracing == tracingNative {
+		return func(context.Context, string) bool { return false }
+	}
+	return interceptors.FilterMethodsFunc
+}
+
 func (c *cb) initHTTP(ctx context.Context) (*http.Server, error) {
 	// Register gRPC server endpoint
 	// Note: Make sure the gRPC server is running properly and accessible
-	grpcServerEndpoint := fmt.Sprintf("%s:%d", c.config.ListenHost, c.config.GRPCPort)
-
-	pMar := &runtime.ProtoMarshaller{}
+	grpcServerEndpoint := c.gatewayEndpoint()
 
 	allowedHttpHeaderPrefixes := c.config.HTTPHeaderPrefixes
 	// maintaining backward compatibility
@@ -167,15 +461,34 @@ func (c *cb) initHTTP(ctx context.Context) (*http.Server, error) {
 
 	muxOpts := []runtime.ServeMuxOption{
 		runtime.WithIncomingHeaderMatcher(getCustomHeaderMatcher(allowedHttpHeaderPrefixes, c.config.TraceHeaderName)),
-		runtime.WithMarshalerOption("application/proto", pMar),
-		runtime.WithMarshalerOption("application/protobuf", pMar),
+		runtime.WithRoutingErrorHandler(c.routingErrorHandler),
+		runtime.WithErrorHandler(gatewayErrorHandler),
+		runtime.WithMiddlewares(routeProbeMiddleware),
+		queryParameterParser(c.config.HTTPUnknownQueryParams),
+	}
+	if c.config.EnableGatewayMarshalSpans {
+		muxOpts = append(muxOpts,
+			runtime.WithMiddlewares(c.marshalSpanMiddleware),
+			runtime.WithForwardResponseOption(startMarshalSpan),
+		)
+	}
+	if !c.config.DisableProtoMarshaller {
+		pMar := &runtime.ProtoMarshaller{}
+		muxOpts = append(muxOpts,
+			runtime.WithMarshalerOption("application/proto", pMar),
+			runtime.WithMarshalerOption("application/protobuf", pMar),
+		)
 	}
 
 	if c.config.UseJSONBuiltinMarshaller {
 		muxOpts = append(muxOpts, runtime.WithMarshalerOption(c.config.JSONBuiltinMarshallerMime, &runtime.JSONBuiltin{}))
 	}
 
-	mux := runtime.NewServeMux(muxOpts...)
+	muxOpts = append(muxOpts, c.serveMuxOptions...)
+
+	registerCollector(gatewayDeadlineExceeded)
+	mux := c.newServeMux(muxOpts...)
+	var handler http.Handler = mux
 
 	creds := c.creds
 	if creds == nil {
@@ -187,61 +500,341 @@ func (c *cb) initHTTP(ctx context.Context) (*http.Server, error) {
 		grpc.WithUnaryInterceptor(
 			interceptors.DefaultClientInterceptor(
 				grpc_opentracing.WithTraceHeaderName(c.config.TraceHeaderName),
-				grpc_opentracing.WithFilterFunc(interceptors.FilterMethodsFunc),
+				grpc_opentracing.WithFilterFunc(c.gatewayOpenTracingFilter()),
 				interceptors.WithoutHystrix(),
 			),
 		),
 	}
+	if c.tracing == tracingNative {
+		// propagates the span of the HTTP request to the gRPC server
+		opts = append(opts, grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	}
+	if c.limiter != nil {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(c.limiter.gatewayInterceptor()),
+			grpc.WithChainStreamInterceptor(c.limiter.gatewayStreamInterceptor()),
+		)
+	}
+	if !c.config.DisableGatewayUpstreamMetrics {
+		registerCollector(gatewayUpstreamDuration)
+		slow := time.Millisecond * time.Duration(c.config.GatewaySlowCallThresholdMs)
+		opts = append(opts, grpc.WithChainUnaryInterceptor(gatewayLatencyInterceptor(slow)))
+	}
+	// the gateway sends what the server receives and receives what the server sends
+	var callOpts []grpc.CallOption
+	if c.config.GRPCMaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(c.config.GRPCMaxRecvMsgSize))
+	}
+	if c.config.GatewayMaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(c.config.GatewayMaxRecvMsgSize))
+	} else if c.config.GRPCMaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(c.config.GRPCMaxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	if c.config.GatewayKeepaliveTimeSeconds > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    time.Duration(c.config.GatewayKeepaliveTimeSeconds) * time.Second,
+			Timeout: time.Duration(c.config.GatewayKeepaliveTimeoutSeconds) * time.Second,
+		}))
+	}
+	if c.config.GRPCServiceConfig != "" {
+		// service config is a client side concept, the server can not advertise it without a resolver (e.g. xds)
+		// so we apply it to the gateway dial which is the only client we control
+		opts = append(opts, grpc.WithDefaultServiceConfig(c.config.GRPCServiceConfig))
+	}
+	svcMuxes := serviceMuxes{fallback: mux}
 	for _, s := range c.svc {
-		if err := s.InitHTTP(ctx, mux, grpcServerEndpoint, opts); err != nil {
+		svcMux := mux
+		if o, ok := s.(CBServeMuxOptioner); ok {
+			// services with their own options get a dedicated mux so that their marshalers only apply to their routes
+			svcMux = c.newServeMux(append(muxOpts[:len(muxOpts):len(muxOpts)], o.ServeMuxOptions()...)...)
+			svcMuxes.muxes = append(svcMuxes.muxes, svcMux)
+		}
+		if err := s.InitHTTP(ctx, svcMux, grpcServerEndpoint, opts); err != nil {
 			return nil, err
 		}
 	}
+	if len(svcMuxes.muxes) > 0 {
+		handler = svcMuxes
+	}
+
+	gwHandler, err := c.gzipHandler(c.tracingWrapper(trailingSlashHandler(c.config.HTTPTrailingSlashMode, defaultContentTypeHandler(c.config.DefaultContentType, handler))))
+	if err != nil {
+		return nil, err
+	}
+	if c.limiter != nil {
+		gwHandler = c.limiter.handler(gwHandler)
+	}
+	if !c.config.DisableHTTPAccessLog {
+		al := newAccessLogger(c.config.HTTPAccessLogBufferSize, c.config.HTTPAccessLogFormat, c.config.HTTPAccessLogLevel)
+		c.closers = append(c.closers, al)
+		gwHandler = al.handler(gwHandler)
+	}
+	if c.config.GenerateRequestIDIfMissing {
+		gwHandler = requestIDHandler(c.traceHeaderName(), gwHandler)
+	}
+
+	pprofHandler := pprofHandler()
+	staticPath, staticHandler := c.staticFilesHandler()
+	var customHandler http.Handler
+	if c.httpHandlers != nil {
+		customHandler = c.httpHandlers
+		if c.config.WrapHTTPHandlers {
+			if customHandler, err = c.gzipHandler(c.tracingWrapper(c.httpHandlers)); err != nil {
+				return nil, err
+			}
+		}
+		// the custom routes are limited whether they are wrapped or not
+		if c.limiter != nil {
+			customHandler = c.limiter.handler(customHandler)
+		}
+		if c.config.WrapHTTPHandlers && c.config.GenerateRequestIDIfMissing {
+			customHandler = requestIDHandler(c.traceHeaderName(), customHandler)
+		}
+	}
+	if staticHandler != nil && c.limiter != nil {
+		staticHandler = c.limiter.handler(staticHandler)
+	}
+	metricsHandler := promhttp.Handler()
+	if reg := prometheusRegistry(); reg != nil {
+		metricsHandler = promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	}
+	var samplingAdmin http.Handler
+	if c.config.AdminAuthToken != "" {
+		samplingAdmin = tokenAuth(c.config.AdminAuthToken, samplingHandler(time.Duration(c.config.SamplingOverrideDefaultSeconds)*time.Second))
+	}
 
 	// Start HTTP server (and proxy calls to gRPC server endpoint)
 	gatewayAddr := fmt.Sprintf("%s:%d", c.config.ListenHost, c.config.HTTPPort)
 	gwServer := &http.Server{
 		Addr: gatewayAddr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !c.config.DisableSwagger && c.openAPIHandler != nil && strings.HasPrefix(r.URL.Path, c.config.SwaggerURL) {
+			if !c.config.DisableDebug && c.debugAuthEnabled() && isDebugPath(r.URL.Path) && !c.debugAuthorized(r) {
+				unauthorized(w)
+				return
+			} else if !c.config.DisableSwagger && c.openAPIHandler != nil && strings.HasPrefix(r.URL.Path, c.config.SwaggerURL) {
 				http.StripPrefix(c.config.SwaggerURL, c.openAPIHandler).ServeHTTP(w, r)
 				return
-			} else if !c.config.DisableDebug && strings.HasPrefix(r.URL.Path, "/debug/pprof/cmdline") {
-				pprof.Cmdline(w, r)
+			} else if !c.config.DisableDebug && c.config.PprofPort == 0 && strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+				pprofHandler.ServeHTTP(w, r)
+				return
+			} else if !c.config.DisableDebug && r.URL.Path == "/features" {
+				featuresHandler(w, r)
+				return
+			} else if !c.config.DisableDebug && r.URL.Path == "/debug/interceptors" {
+				c.interceptorsHandler(w, r)
+				return
+			} else if !c.config.DisableDebug && r.URL.Path == "/debug/stats" {
+				statsHandler(w, r)
 				return
-			} else if !c.config.DisableDebug && strings.HasPrefix(r.URL.Path, "/debug/pprof/profile") {
-				pprof.Profile(w, r)
+			} else if !c.config.DisableDebug && c.debugAuthEnabled() && r.URL.Path == "/debug/gc" {
+				// only served with debug credentials configured, forcing collections is too disruptive to leave open
+				gcHandler(w, r)
 				return
-			} else if !c.config.DisableDebug && strings.HasPrefix(r.URL.Path, "/debug/pprof/symbol") {
-				pprof.Symbol(w, r)
+			} else if samplingAdmin != nil && r.URL.Path == "/admin/sampling" {
+				samplingAdmin.ServeHTTP(w, r)
 				return
-			} else if !c.config.DisableDebug && strings.HasPrefix(r.URL.Path, "/debug/pprof/trace") {
-				pprof.Trace(w, r)
+			} else if !c.config.DisableReadyz && r.URL.Path == "/readyz" {
+				c.readyzHandler(w, r)
 				return
-			} else if !c.config.DisableDebug && strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
-				pprof.Index(w, r)
+			} else if !c.config.DisableStartupz && r.URL.Path == "/startupz" {
+				c.startupzHandler(w, r)
 				return
 			} else if !c.config.DisablePormetheus && strings.HasPrefix(r.URL.Path, "/metrics") {
-				promhttp.Handler().ServeHTTP(w, r)
+				metricsHandler.ServeHTTP(w, r)
+				return
+			} else if customHandler != nil && hasHandler(c.httpHandlers, r) {
+				customHandler.ServeHTTP(w, r)
+				return
+			} else if staticHandler != nil && (strings.HasPrefix(r.URL.Path, staticPath) || r.URL.Path+"/" == staticPath) {
+				staticHandler.ServeHTTP(w, r)
 				return
 			}
-			gziphandler.GzipHandler(tracingWrapper(mux)).ServeHTTP(w, r)
+			gwHandler.ServeHTTP(w, r)
 		}),
 	}
+	if h2 := c.newHTTP2Server(); h2 != nil {
+		if err := http2.ConfigureServer(gwServer, h2); err != nil {
+			return nil, err
+		}
+	}
+	if certFile, keyFile := c.httpTLSFiles(); certFile != "" && keyFile != "" {
+		tlsConfig, err := loadTLSConfig(certFile, keyFile, c.config.GRPCTLSInsecureSkipVerify, c.config.TLSNextProtos)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.configureSessionTickets(tlsConfig); err != nil {
+			return nil, err
+		}
+		gwServer.TLSConfig = tlsConfig
+	}
+	if c.config.EnableH2C {
+		h2 := c.newHTTP2Server()
+		if h2 == nil {
+			h2 = &http2.Server{}
+		}
+		// HTTP/1.1 requests are passed through to the handler as is
+		gwServer.Handler = h2c.NewHandler(gwServer.Handler, h2)
+	}
 	log.Info(ctx, "msg", "Starting HTTP server", "address", gatewayAddr)
 	return gwServer, nil
 }
 
-func (c *cb) runHTTP(_ context.Context, svr *http.Server) error {
-	return svr.ListenAndServe()
+func (c *cb) runHTTP(_ context.Context, svr *http.Server, lis net.Listener) error {
+	lis = newRateLimitedListener(lis, c.config.MaxNewConnectionsPerSecond)
+	if svr.TLSConfig != nil {
+		// the certificates are in the TLS config
+		return svr.ServeTLS(lis, "", "")
+	}
+	return svr.Serve(lis)
+}
+
+// httpTLSFiles returns the cert and key files of the HTTP gateway server, empty when it does not use TLS
+func (c *cb) httpTLSFiles() (string, string) {
+	if c.config.HTTPTLSCertFile != "" || c.config.HTTPTLSKeyFile != "" {
+		return c.config.HTTPTLSCertFile, c.config.HTTPTLSKeyFile
+	}
+	if c.config.ReuseGRPCTLSForHTTP {
+		return c.config.GRPCTLSCertFile, c.config.GRPCTLSKeyFile
+	}
+	return "", ""
+}
+
+// listen announces on the tcp address provided
+// permission errors are annotated with a hint as they are usually caused by binding to a privileged port
+// listeners inherited from a graceful restart are reused instead of binding the address again
+func (c *cb) listen(addr string) (net.Listener, error) {
+	if lis := c.listeners.adopt(addr); lis != nil {
+		return lis, nil
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil && errors.Is(err, syscall.EACCES) {
+		return nil, fmt.Errorf("permission denied binding to %s, ports below 1024 are privileged and require running as root or the CAP_NET_BIND_SERVICE capability: %w", addr, err)
+	}
+	if err == nil {
+		c.listeners.track(addr, lis)
+	}
+	return lis, err
+}
+
+// initPprof creates the server serving pprof on its own port, it returns nil when no pprof port is configured
+func (c *cb) initPprof(ctx context.Context) *http.Server {
+	if c.config.DisableDebug || c.config.PprofPort == 0 {
+		return nil
+	}
+	handler := tokenAuth(c.config.PprofAuthToken, pprofHandler())
+	if c.config.PprofAuthToken == "" {
+		handler = c.debugAuth(pprofHandler())
+		if !c.debugAuthEnabled() {
+			log.Warn(ctx, "msg", "pprof is served without authentication, set PprofAuthToken or the debug credentials to protect it")
+		}
+	}
+	addr := fmt.Sprintf("%s:%d", c.config.ListenHost, c.config.PprofPort)
+	log.Info(ctx, "msg", "Starting pprof server", "address", addr)
+	return &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
 }
 
 func (c *cb) getGRPCServerOptions() []grpc.ServerOption {
 	so := make([]grpc.ServerOption, 0)
+	unary := interceptors.DefaultInterceptors()
+	stream := interceptors.DefaultStreamInterceptors()
+	if len(c.config.ContextValues) > 0 {
+		unary = append([]grpc.UnaryServerInterceptor{contextValuesInterceptor(c.config.ContextValues)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{contextValuesStreamInterceptor(c.config.ContextValues)}, stream...)
+	}
+	if c.capturer != nil {
+		unary = append([]grpc.UnaryServerInterceptor{c.capturer.interceptor()}, unary...)
+	}
+	if c.config.DefaultRequestTimeoutInSeconds > 0 {
+		// before the default interceptors so that they all see the deadline
+		timeout := time.Duration(c.config.DefaultRequestTimeoutInSeconds) * time.Second
+		unary = append([]grpc.UnaryServerInterceptor{defaultTimeoutInterceptor(timeout)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{defaultTimeoutStreamInterceptor(timeout)}, stream...)
+	}
+	if c.config.MaxRequestDurationSeconds > 0 {
+		limit := time.Duration(c.config.MaxRequestDurationSeconds) * time.Second
+		unary = append([]grpc.UnaryServerInterceptor{maxDurationInterceptor(limit)}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{maxDurationStreamInterceptor(limit)}, stream...)
+	}
+	unary = append([]grpc.UnaryServerInterceptor{c.inFlightInterceptor()}, unary...)
+	stream = append([]grpc.StreamServerInterceptor{c.inFlightStreamInterceptor()}, stream...)
+	if c.limiter != nil {
+		// outermost so that rejected calls do not run any other interceptor
+		unary = append([]grpc.UnaryServerInterceptor{c.limiter.interceptor()}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{c.limiter.streamInterceptor()}, stream...)
+	}
+	if c.config.EnableGRPCStatusClassMetrics {
+		// outside the limiter and the recovery interceptor so that rejected calls and panics are counted
+		registerCollector(grpcHandledByClass)
+		unary = append([]grpc.UnaryServerInterceptor{statusClassInterceptor()}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{statusClassStreamInterceptor()}, stream...)
+	}
+	if len(c.config.MetricsLabelsFromMetadata) > 0 {
+		// outside the limiter and the recovery interceptor so that rejected calls and panics are recorded
+		m := newLabeledMetrics(c.config.MetricsLabelsFromMetadata)
+		unary = append([]grpc.UnaryServerInterceptor{m.interceptor()}, unary...)
+		stream = append([]grpc.StreamServerInterceptor{m.streamInterceptor()}, stream...)
+	}
+	if len(c.config.MethodLogLevels) > 0 {
+		levels := parseMethodLogLevels(c.config.MethodLogLevels)
+		unary = append(unary, methodLogLevelInterceptor(levels))
+		stream = append(stream, methodLogLevelStreamInterceptor(levels))
+	}
+	if c.config.LogPeerIdentity {
+		unary = append(unary, peerIdentityInterceptor())
+		stream = append(stream, peerIdentityStreamInterceptor())
+	}
+	if len(c.config.LogMetadataKeys) > 0 || len(c.config.LogMetadataMaskedKeys) > 0 {
+		unary = append(unary, metadataLoggingInterceptor(c.config.LogMetadataKeys, c.config.LogMetadataMaskedKeys))
+		stream = append(stream, metadataLoggingStreamInterceptor(c.config.LogMetadataKeys, c.config.LogMetadataMaskedKeys))
+	}
+	if c.config.EchoTraceIDInResponse || c.config.GenerateRequestIDIfMissing {
+		// the default interceptors generate a trace id when the request does not have one
+		unary = append(unary, traceIDHeaderInterceptor())
+		stream = append(stream, traceIDHeaderStreamInterceptor())
+	}
+	if name := c.config.DefaultServerCompressor; name != "" {
+		if encoding.GetCompressor(name) == nil {
+			log.Warn(context.Background(), "msg", "default server compressor is not registered, responses are not compressed by default", "compressor", name)
+		} else {
+			unary = append(unary, defaultCompressorInterceptor(name))
+			stream = append(stream, defaultCompressorStreamInterceptor(name))
+		}
+	}
+	if c.config.EnableGRPCResponseCompression {
+		unary = append(unary, responseCompressionInterceptor(c.config.GRPCResponseCompressionMinBytes))
+	}
+	if c.panics != nil {
+		// innermost so that the panic is seen before the recovery interceptor handles it
+		unary = append(unary, c.panicChannelInterceptor())
+		stream = append(stream, c.panicChannelStreamInterceptor())
+	}
+	if c.config.EnableInterceptorMetrics {
+		// timing interceptors wrap the chain, the outermost measures the whole chain and the innermost the handler
+		unary = append(append([]grpc.UnaryServerInterceptor{interceptorTimingInterceptor()}, unary...), handlerTimingInterceptor())
+		stream = append(append([]grpc.StreamServerInterceptor{interceptorTimingStreamInterceptor()}, stream...), handlerTimingStreamInterceptor())
+	}
+	c.interceptorChain = newInterceptorChain(unary, stream)
 	so = append(so,
-		grpc.ChainUnaryInterceptor(interceptors.DefaultInterceptors()...),
-		grpc.ChainStreamInterceptor(interceptors.DefaultStreamInterceptors()...),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 	)
+	registerCollector(grpcServerConnections)
+	so = append(so, grpc.StatsHandler(connectionStatsHandler{}))
+	if c.tracing == tracingNative {
+		so = append(so, grpc.StatsHandler(otelGRPCServerHandler()))
+	}
+	if c.config.GRPCMaxRecvMsgSize > 0 {
+		so = append(so, grpc.MaxRecvMsgSize(c.config.GRPCMaxRecvMsgSize))
+	}
+	if c.config.GRPCMaxSendMsgSize > 0 {
+		so = append(so, grpc.MaxSendMsgSize(c.config.GRPCMaxSendMsgSize))
+	}
 	if c.config.GRPCServerMaxConnectionAgeGraceInSeconds > 0 ||
 		c.config.GRPCServerMaxConnectionAgeInSeconds > 0 ||
 		c.config.GRPCServerMaxConnectionIdleInSeconds > 0 {
@@ -257,56 +850,179 @@ func (c *cb) getGRPCServerOptions() []grpc.ServerOption {
 		}
 		so = append(so, grpc.KeepaliveParams(option))
 	}
+	if gatewayKeepalive := time.Duration(c.config.GatewayKeepaliveTimeSeconds) * time.Second; gatewayKeepalive > 0 && gatewayKeepalive < defaultKeepaliveMinTime {
+		// the server closes connections pinging more frequently than its enforcement policy allows, the gateway pings must be accepted
+		so = append(so, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: gatewayKeepalive}))
+	}
 	return so
 }
 
-func loadTLSCredentials(certFile, keyFile string, insecureSkipVerify bool) (credentials.TransportCredentials, error) {
-	// Load server's certificate and private key
-	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// defaultKeepaliveMinTime is the minimum interval between the keepalive pings of clients enforced by default by gRPC servers
+const defaultKeepaliveMinTime = 5 * time.Minute
+
+// loadTLSConfig loads the server certificate and private key into a server TLS config
+// nextProtos are the ALPN protocols advertised by the server, the server defaults are used when empty
+func loadTLSConfig(certFile, keyFile string, insecureSkipVerify bool, nextProtos []string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
+	return &tls.Config{
+		// the certificate is loaded again when the files are renewed
+		GetCertificate: reloader.GetCertificate,
+		// the gateway dials the gRPC server with the same config, it presents the server certificate when asked for one
+		GetClientCertificate: reloader.GetClientCertificate,
+		ClientAuth:           tls.NoClientCert,
+		InsecureSkipVerify:   insecureSkipVerify,
+		NextProtos:           nextProtos,
+	}, nil
+}
 
-	// Create the credentials and return it
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{serverCert},
-		ClientAuth:         tls.NoClientCert,
-		InsecureSkipVerify: insecureSkipVerify,
+func (c *cb) loadTLSCredentials(certFile, keyFile string) (credentials.TransportCredentials, error) {
+	config, err := loadTLSConfig(certFile, keyFile, c.config.GRPCTLSInsecureSkipVerify, c.config.TLSNextProtos)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.configureSessionTickets(config); err != nil {
+		return nil, err
+	}
+	if err := c.configureClientAuth(config); err != nil {
+		return nil, err
 	}
 
-	return credentials.NewTLS(config), nil
+	// Create the credentials and return it
+	registerCollector(tlsHandshakeErrors)
+	return handshakeMetricsCredentials{credentials.NewTLS(config)}, nil
 }
 
 func (c *cb) initGRPC(ctx context.Context) (*grpc.Server, error) {
+	if c.config.RequestCaptureFile != "" && c.capturer == nil {
+		capturer, err := newRequestCapturer(c.config.RequestCaptureFile, c.config.RequestCaptureSampleRate)
+		if err != nil {
+			return nil, err
+		}
+		log.Warn(ctx, "msg", "capturing requests, this should only be enabled for debugging", "file", c.config.RequestCaptureFile)
+		c.capturer = capturer
+		c.closers = append(c.closers, capturer)
+	}
 	so := c.getGRPCServerOptions()
-	if c.config.GRPCTLSCertFile != "" && c.config.GRPCTLSKeyFile != "" {
-		creds, err := loadTLSCredentials(c.config.GRPCTLSCertFile, c.config.GRPCTLSKeyFile, c.config.GRPCTLSInsecureSkipVerify)
+	if c.customCreds != nil {
+		c.creds = c.customCreds
+		so = append(so, grpc.Creds(c.creds))
+	} else if c.config.GRPCTLSCertFile != "" && c.config.GRPCTLSKeyFile != "" {
+		creds, err := c.loadTLSCredentials(c.config.GRPCTLSCertFile, c.config.GRPCTLSKeyFile)
 		if err != nil {
 			return nil, err
 		}
 		c.creds = creds
 		so = append(so, grpc.Creds(creds))
 	}
+	if c.unknownServiceHandler != nil {
+		so = append(so, grpc.UnknownServiceHandler(c.unknownServiceHandler))
+	}
+	so = append(so, c.grpcServerOptions...)
 	grpcServer := grpc.NewServer(so...)
 	for _, s := range c.svc {
+		if h, ok := s.(CBHealthReporter); ok {
+			h.SetHealth(c.health)
+		}
 		if err := s.InitGRPC(ctx, grpcServer); err != nil {
 			return nil, err
 		}
 	}
+	if !c.config.DisableGRPCHealth {
+		c.health.registerServices(grpcServer)
+	}
 	return grpcServer, nil
 }
 
-func (c *cb) runGRPC(ctx context.Context, svr *grpc.Server) error {
-	grpcServerEndpoint := fmt.Sprintf("%s:%d", c.config.ListenHost, c.config.GRPCPort)
-	lis, err := net.Listen("tcp", grpcServerEndpoint)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
-	}
+func (c *cb) runGRPC(ctx context.Context, svr *grpc.Server, lis net.Listener) error {
 	if !c.config.DisableGRPCReflection {
 		reflection.Register(svr)
 	}
-	log.Info(ctx, "msg", "Starting GRPC server", "address", grpcServerEndpoint)
-	return svr.Serve(lis)
+	log.Info(ctx, "msg", "Starting GRPC server", "address", lis.Addr().String())
+	return svr.Serve(newRateLimitedListener(lis, c.config.MaxNewConnectionsPerSecond))
+}
+
+// serverListeners are the listeners of the servers, they are bound before the servers start serving
+type serverListeners struct {
+	grpc  net.Listener
+	http  net.Listener
+	pprof net.Listener
+}
+
+// Close closes all the listeners
+func (l serverListeners) Close() {
+	for _, lis := range []net.Listener{l.grpc, l.http, l.pprof} {
+		if lis != nil {
+			lis.Close()
+		}
+	}
+}
+
+// listenGRPC binds the listener of the gRPC server, the address is resolved so that port 0 gets the port assigned by the OS
+func (c *cb) listenGRPC() (net.Listener, error) {
+	lis, err := c.listen(fmt.Sprintf("%s:%d", c.config.ListenHost, c.config.GRPCPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	c.grpcAddr = lis.Addr().String()
+	return lis, nil
+}
+
+// listenHTTP binds the listeners of the HTTP and pprof servers, nothing is left bound when it fails
+func (c *cb) listenHTTP(l *serverListeners) error {
+	var err error
+	l.http, err = c.listen(c.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if c.pprofServer != nil {
+		l.pprof, err = c.listen(c.pprofServer.Addr)
+		if err != nil {
+			l.http.Close()
+			l.http = nil
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+	}
+	c.httpAddr = l.http.Addr().String()
+	return nil
+}
+
+// gatewayEndpoint returns the endpoint the HTTP gateway dials, the gRPC server must be listening
+func (c *cb) gatewayEndpoint() string {
+	_, port, err := net.SplitHostPort(c.grpcAddr)
+	if err != nil {
+		port = strconv.Itoa(c.config.GRPCPort)
+	}
+	return net.JoinHostPort(c.config.ListenHost, port)
+}
+
+// GRPCAddr returns the address the gRPC server listens on, with the port assigned by the OS when GRPCPort is 0
+// It is empty until the server is listening, wait on Started before using it
+func (c *cb) GRPCAddr() string {
+	return c.grpcAddr
+}
+
+// HTTPAddr returns the address the HTTP gateway server listens on, with the port assigned by the OS when HTTPPort is 0
+// It is empty until the server is listening, wait on Started before using it
+func (c *cb) HTTPAddr() string {
+	return c.httpAddr
+}
+
+// Started returns a channel that is closed once the gRPC and HTTP servers are listening on their ports
+// it is closed as well when Run returns before, GRPCAddr and HTTPAddr are then empty unless the server was bound
+func (c *cb) Started() <-chan struct{} {
+	return c.listening
+}
+
+// closeIfOpen closes ch unless it is already closed, ch must only be closed by the calling goroutine
+func closeIfOpen(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
 }
 
 // Run starts the service
@@ -316,29 +1032,117 @@ func (c *cb) runGRPC(ctx context.Context, svr *grpc.Server) error {
 // It will return an error if the service fails to stop
 // It will return an error if the service fails to run
 func (c *cb) Run() error {
-	ctx := context.Background()
-	ctx, c.cancelFunc = context.WithCancel(ctx)
-	defer c.cancelFunc()
+	return c.RunWithContext(context.Background())
+}
 
-	var err error
+// shutdownDuration is the time given to calls to complete on shutdown
+func (c *cb) shutdownDuration() time.Duration {
+	if c.config.ShutdownDurationInSeconds > 0 {
+		return time.Second * time.Duration(c.config.ShutdownDurationInSeconds)
+	}
+	return time.Second * 10
+}
 
-	c.grpcServer, err = c.initGRPC(ctx)
+// RunWithContext runs the service like Run, ctx is the parent context passed to InitGRPC and InitHTTP
+// Cancelling ctx shuts the service down gracefully like Stop, only the first of a cancellation and a signal
+// (when the signal handler is enabled) triggers the shutdown, the values of ctx are available to the services
+func (c *cb) RunWithContext(parent context.Context) (err error) {
+	c.emit(EventStarting, nil)
+	defer func() {
+		c.emit(EventStopped, err)
+	}()
+	if c.setupErr != nil {
+		return c.setupErr
+	}
+	// cancelling parent triggers a graceful shutdown, the servers are not torn down by the cancellation itself
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	c.cancelFunc = cancel
+	defer c.cancelFunc()
+	defer func() {
+		// waiters must not block forever when the servers could not be initialized or bound
+		closeIfOpen(c.serversReady)
+		closeIfOpen(c.listening)
+	}()
+	go func() {
+		select {
+		case <-parent.Done():
+			if !c.shuttingDown.Load() {
+				log.Info(ctx, "msg", "context cancelled, shutting down", "err", parent.Err())
+				c.Stop(c.shutdownDuration())
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	grpcServer, err := c.initGRPC(ctx)
 	if err != nil {
 		return err
 	}
 
-	c.httpServer, err = c.initHTTP(ctx)
+	// the gRPC server is listening before the gateway is initialized so that it dials the port assigned by the OS
+	var lis serverListeners
+	serving := false
+	defer func() {
+		if !serving {
+			lis.Close()
+			c.listeners.closeUnused()
+		}
+	}()
+	if lis.grpc, err = c.listenGRPC(); err != nil {
+		return err
+	}
+
+	httpServer, err := c.initHTTP(ctx)
 	if err != nil {
 		return err
 	}
 
-	errChan := make(chan error, 2)
+	pprofServer := c.initPprof(ctx)
+	c.serversMu.Lock()
+	stopped := c.shuttingDown.Load()
+	if !stopped {
+		c.grpcServer, c.httpServer, c.pprofServer = grpcServer, httpServer, pprofServer
+	}
+	c.serversMu.Unlock()
+	if stopped {
+		// Stop did not see the servers, they must not start serving
+		log.Info(ctx, "msg", "shutdown requested during startup, not serving")
+		c.gracefulWait.Wait()
+		c.close()
+		return nil
+	}
+	closeIfOpen(c.serversReady)
+
+	if err = c.initDependencies(); err != nil {
+		return err
+	}
+	for _, d := range c.dependencies {
+		go d.run(ctx)
+	}
+
+	if err = c.listenHTTP(&lis); err != nil {
+		return err
+	}
+	// the inherited listeners are adopted by now, the other ones must not accept connections nobody serves
+	c.listeners.closeUnused()
+	log.Info(ctx, "msg", "listening", "grpc_address", c.grpcAddr, "http_address", c.httpAddr)
+	closeIfOpen(c.listening)
+	serving = true
+
+	errChan := make(chan error, 3)
 	go func() {
-		errChan <- c.runGRPC(ctx, c.grpcServer)
+		errChan <- c.runGRPC(ctx, c.grpcServer, lis.grpc)
 	}()
 	go func() {
-		errChan <- c.runHTTP(ctx, c.httpServer)
+		errChan <- c.runHTTP(ctx, c.httpServer, lis.http)
 	}()
+	if c.pprofServer != nil {
+		go func() {
+			errChan <- c.runHTTP(ctx, c.pprofServer, lis.pprof)
+		}()
+	}
+	c.initialized.Store(true)
+	c.emit(EventReady, nil)
 	err = <-errChan
 	c.gracefulWait.Wait() // if graceful shutdown is in progress wait for it to finish
 	c.close()
@@ -359,6 +1163,26 @@ func (c *cb) close() {
 func (c *cb) Stop(dur time.Duration) error {
 	c.gracefulWait.Add(1) // tell runner that a graceful shutdow is in progress
 	defer c.gracefulWait.Done()
+	c.shuttingDown.Store(true)
+	report := ShutdownReport{StartedAt: time.Now(), InFlightAtStart: c.inFlight.Load()}
+	// the gauge is exposed while the servers drain, the durations are only known once /metrics stopped serving
+	shutdownInFlightRequests.Set(float64(report.InFlightAtStart))
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+		c.shutdownReport.Store(&report)
+		observeShutdown(report)
+		if path := c.config.ShutdownReportFile; path != "" {
+			if err := writeShutdownReport(path, report); err != nil {
+				log.Error(context.Background(), "msg", "could not write the shutdown report", "file", path, "err", err)
+			}
+		}
+		log.Info(context.Background(), report.logFields()...)
+	}()
+	if c.stopRestartWatcher != nil {
+		c.stopRestartWatcher()
+	}
+	c.health.shutdown()
+	c.emit(EventShuttingDown, nil)
 	ctx, cancel := context.WithTimeout(context.Background(), dur)
 	defer func() {
 		cancel()
@@ -376,26 +1200,109 @@ func (c *cb) Stop(dur time.Duration) error {
 		d := time.Second * time.Duration(c.config.HealthcheckWaitDurationInSeconds)
 		log.Info(context.Background(), "msg", "graceful shutdown timer started", "duration", d)
 		time.Sleep(d)
+		report.HealthcheckWait = d
 		log.Info(context.Background(), "msg", "graceful shutdown timer finished", "duration", d)
 	}
 	log.Info(context.Background(), "msg", "Server shut down started, bye bye")
-	if c.httpServer != nil {
-		go c.httpServer.Shutdown(ctx)
+	drainStart := time.Now()
+	c.serversMu.RLock()
+	grpcServer, httpServer, pprofServer := c.grpcServer, c.httpServer, c.pprofServer
+	c.serversMu.RUnlock()
+	// the HTTP and gRPC servers drain concurrently, both with the same deadline
+	var drainWait sync.WaitGroup
+	var firstDrained atomic.Bool
+	drained := func(server string, err error) {
+		log.Info(context.Background(), "msg", "server shut down", "server", server, "duration", time.Since(drainStart), "first", firstDrained.CompareAndSwap(false, true), "err", err)
 	}
-	if c.grpcServer != nil {
-		timedCall(ctx, c.grpcServer.GracefulStop)
-		c.grpcServer.Stop()
+	if httpServer != nil {
+		drainWait.Add(1)
+		go func() {
+			defer drainWait.Done()
+			// Shutdown waits for in-flight requests to complete or for the deadline
+			drained("http", httpServer.Shutdown(ctx))
+		}()
 	}
-	for _, svc := range c.svc {
-		// call stopper to stop services
-		if s, ok := svc.(CBStopper); ok {
-			s.Stop()
+	if pprofServer != nil {
+		go pprofServer.Shutdown(ctx)
+	}
+	if grpcServer != nil {
+		grpcCtx := ctx
+		if c.config.ForceStopGraceMs > 0 {
+			// give calls that are about to finish a little more time before they are cut off
+			deadline, _ := ctx.Deadline()
+			var grpcCancel context.CancelFunc
+			grpcCtx, grpcCancel = context.WithDeadline(context.Background(), deadline.Add(time.Millisecond*time.Duration(c.config.ForceStopGraceMs)))
+			defer grpcCancel()
 		}
+		drainWait.Add(1)
+		go func() {
+			defer drainWait.Done()
+			report.ForcedStop = !timedCall(grpcCtx, grpcServer.GracefulStop)
+			grpcServer.Stop()
+			drained("grpc", grpcCtx.Err())
+		}()
 	}
+	drainWait.Wait()
+	report.DrainDuration = time.Since(drainStart)
+	// the drain may have used up the shutdown deadline, the services get their own
+	stopTimeout := dur
+	if c.config.ServiceStopTimeoutInSeconds > 0 {
+		stopTimeout = time.Duration(c.config.ServiceStopTimeoutInSeconds) * time.Second
+	}
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer stopCancel()
+	c.stopServices(stopCtx)
 	return nil
 }
 
-func timedCall(ctx context.Context, f func()) {
+// stopServices calls Stop on all services implementing CBContextStopper or CBStopper concurrently
+// and waits for them until the context is done, services that do not stop in time are logged
+func (c *cb) stopServices(ctx context.Context) {
+	// pending holds the services that have not stopped yet, keyed by their index
+	pending := make(map[int]string)
+	var mu sync.Mutex
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, svc := range c.svc {
+		var stop func()
+		if s, ok := svc.(CBContextStopper); ok {
+			stop = func() { s.Stop(ctx) }
+		} else if s, ok := svc.(CBStopper); ok {
+			stop = s.Stop
+		} else {
+			continue
+		}
+		// earlier services may already be removing themselves from pending
+		mu.Lock()
+		pending[i] = fmt.Sprintf("%T", svc)
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop()
+			mu.Lock()
+			delete(pending, i)
+			mu.Unlock()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range pending {
+			log.Warn(context.Background(), "msg", "service did not stop before the shutdown deadline", "service", name)
+		}
+	}
+}
+
+// timedCall calls f and waits for it to return or for the context to be done
+// it returns true if f returned before the context was done
+func timedCall(ctx context.Context, f func()) bool {
 	done := make(chan struct{})
 	go func() {
 		f()
@@ -405,8 +1312,10 @@ func timedCall(ctx context.Context, f func()) {
 	select {
 	case <-done:
 		log.Info(context.Background(), "grpc graceful shutdown complete")
+		return true
 	case <-ctx.Done():
 		log.Info(context.Background(), "grpc graceful shutdown failed, forcing shutdown")
+		return false
 	}
 }
 
@@ -418,9 +1327,19 @@ func timedCall(ctx context.Context, f func()) {
 // The services are started and stopped in the order they are added
 func New(c config.Config) CB {
 	impl := &cb{
-		config: c,
-		svc:    make([]CBService, 0),
+		config:       c,
+		svc:          make([]CBService, 0),
+		health:       newHealthManager(),
+		serversReady: make(chan struct{}),
+		listening:    make(chan struct{}),
+		listeners:    newRestartListeners(),
+	}
+	if c.PanicChannelSize > 0 {
+		impl.panics = make(chan PanicEvent, c.PanicChannelSize)
+	}
+	if c.MaxConcurrentRequests > 0 {
+		impl.limiter = newConcurrencyLimiter(c.MaxConcurrentRequests)
 	}
-	impl.processConfig()
+	impl.setupErr = impl.processConfig()
 	return impl
 }
@@ -0,0 +1,48 @@
+//go:build linux
+
+package core
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// privilegedHelperEnv makes the test binary run TestListenPrivilegedPort itself instead of re-executing it without privileges
+const privilegedHelperEnv = "COLDBREW_TEST_PRIVILEGED_HELPER"
+
+func TestListenPrivilegedPort(t *testing.T) {
+	if os.Geteuid() == 0 && os.Getenv(privilegedHelperEnv) == "" {
+		// root may bind any port, run the test again without the capability to bind privileged ports
+		setpriv, err := exec.LookPath("setpriv")
+		if err != nil {
+			t.Skip("running as root and setpriv is not available to drop CAP_NET_BIND_SERVICE")
+		}
+		cmd := exec.Command(setpriv, "--bounding-set=-net_bind_service", "--inh-caps=-net_bind_service",
+			os.Args[0], "-test.run=^TestListenPrivilegedPort$", "-test.v")
+		cmd.Env = append(os.Environ(), privilegedHelperEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("test without CAP_NET_BIND_SERVICE failed: %v\n%s", err, out)
+		}
+		if strings.Contains(string(out), "--- SKIP") {
+			t.Skipf("test without CAP_NET_BIND_SERVICE was skipped\n%s", out)
+		}
+		return
+	}
+	c := newTestCB(t, testConfig())
+	lis, err := c.listen("127.0.0.1:80")
+	if err == nil {
+		lis.Close()
+		t.Skip("privileged ports can be bound by unprivileged users on this host")
+	}
+	if !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("listen returned %v, want it to wrap EACCES", err)
+	}
+	if !strings.Contains(err.Error(), "ports below 1024 are privileged") {
+		t.Fatalf("listen error %q does not explain that the port is privileged", err)
+	}
+}
@@ -0,0 +1,526 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/core/config"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testConfig returns a config serving on ports assigned by the OS without waiting on shutdown
+func testConfig() config.Config {
+	return config.Config{
+		ListenHost:                "127.0.0.1",
+		AppName:                   "coldbrew-test",
+		LogLevel:                  "error",
+		DisableSignalHandler:      true,
+		DisableAutoMaxProcs:       true,
+		ShutdownDurationInSeconds: 1,
+	}
+}
+
+// newTestCB creates a cb with its own prometheus registry so that the tests do not see each other's metrics
+func newTestCB(t *testing.T, c config.Config) *cb {
+	t.Helper()
+	SetPrometheusRegistry(prometheus.NewRegistry())
+	return New(c).(*cb)
+}
+
+// testService is a CBService registering nothing, initGRPC and initHTTP are called from InitGRPC and InitHTTP when set
+type testService struct {
+	initGRPC func(ctx context.Context, server *grpc.Server) error
+	initHTTP func(ctx context.Context, mux *runtime.ServeMux) error
+}
+
+func (s *testService) InitHTTP(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error {
+	if s.initHTTP != nil {
+		return s.initHTTP(ctx, mux)
+	}
+	return nil
+}
+
+func (s *testService) InitGRPC(ctx context.Context, server *grpc.Server) error {
+	if s.initGRPC != nil {
+		return s.initGRPC(ctx, server)
+	}
+	return nil
+}
+
+// runTestServer runs c in the background until the test ends and waits for it to listen
+func runTestServer(t *testing.T, c *cb) {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run()
+	}()
+	select {
+	case <-c.Started():
+	case err := <-errs:
+		t.Fatalf("Run failed: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not start")
+	}
+	t.Cleanup(func() {
+		c.Stop(time.Second)
+		<-errs
+	})
+}
+
+func TestRunWithContextCancelledDuringStartup(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetService(&testService{initGRPC: func(context.Context, *grpc.Server) error {
+		// the shutdown starts while the servers are being created
+		cancel()
+		for !c.shuttingDown.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.RunWithContext(ctx)
+	}()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("RunWithContext returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("RunWithContext kept serving after a cancellation during startup")
+	}
+}
+
+// slowStopService takes delay to stop and records whether it stopped before its context was done
+type slowStopService struct {
+	testService
+	delay   time.Duration
+	stopped atomic.Bool
+}
+
+func (s *slowStopService) Stop(ctx context.Context) {
+	select {
+	case <-time.After(s.delay):
+		s.stopped.Store(true)
+	case <-ctx.Done():
+	}
+}
+
+func TestStopServicesConcurrently(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServiceStopTimeoutInSeconds = 2
+	c := newTestCB(t, cfg)
+	services := []*slowStopService{{delay: 300 * time.Millisecond}, {delay: 300 * time.Millisecond}}
+	for _, s := range services {
+		c.SetService(s)
+	}
+	begin := time.Now()
+	// the shutdown duration is used up before the services are stopped, they still get ServiceStopTimeoutInSeconds
+	c.Stop(time.Nanosecond)
+	took := time.Since(begin)
+	for i, s := range services {
+		if !s.stopped.Load() {
+			t.Errorf("service %d did not stop before Stop returned", i)
+		}
+	}
+	if took >= 600*time.Millisecond {
+		t.Errorf("services did not stop concurrently, Stop took %s", took)
+	}
+}
+
+// blockingStopService only stops when its context is done and records whether the context had a deadline
+type blockingStopService struct {
+	testService
+	deadline atomic.Bool
+}
+
+func (s *blockingStopService) Stop(ctx context.Context) {
+	_, ok := ctx.Deadline()
+	s.deadline.Store(ok)
+	<-ctx.Done()
+}
+
+// plainStopService implements CBStopper
+type plainStopService struct {
+	testService
+	stopped atomic.Bool
+}
+
+func (s *plainStopService) Stop() {
+	s.stopped.Store(true)
+}
+
+func TestStopPassesShutdownDeadlineToServices(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServiceStopTimeoutInSeconds = 1
+	c := newTestCB(t, cfg)
+	ctxStopper, plainStopper := &blockingStopService{}, &plainStopService{}
+	c.SetService(ctxStopper)
+	c.SetService(plainStopper)
+	begin := time.Now()
+	c.Stop(time.Nanosecond)
+	if took := time.Since(begin); took > 3*time.Second {
+		t.Errorf("Stop waited %s for a service blocking until its deadline", took)
+	}
+	if !ctxStopper.deadline.Load() {
+		t.Error("CBContextStopper was not given the shutdown deadline")
+	}
+	if !plainStopper.stopped.Load() {
+		t.Error("CBStopper was not stopped")
+	}
+}
+
+func TestStopManyServices(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	services := make([]*plainStopService, 50)
+	for i := range services {
+		services[i] = &plainStopService{}
+		c.SetService(services[i])
+	}
+	// services stopping right away remove themselves from the pending ones while the next are started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.stopServices(ctx)
+	for i, s := range services {
+		if !s.stopped.Load() {
+			t.Errorf("service %d was not stopped", i)
+		}
+	}
+}
+
+func TestServersReadyClosedWhenInitFails(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetService(&testService{initGRPC: func(context.Context, *grpc.Server) error {
+		return errors.New("init failed")
+	}})
+	go func() {
+		// the getters are safe to call while Run initializes the servers
+		for {
+			select {
+			case <-c.ServersReady():
+				return
+			default:
+				c.GRPCServer()
+				c.HTTPServer()
+			}
+		}
+	}()
+	if err := c.Run(); err == nil {
+		t.Fatal("Run succeeded although InitGRPC failed")
+	}
+	select {
+	case <-c.ServersReady():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServersReady is not closed after Run failed")
+	}
+	if c.GRPCServer() != nil || c.HTTPServer() != nil {
+		t.Fatal("servers are set although Run failed")
+	}
+}
+
+func TestServersReady(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetService(&testService{})
+	runTestServer(t, c)
+	<-c.ServersReady()
+	if c.GRPCServer() == nil || c.HTTPServer() == nil {
+		t.Fatal("servers are not set once ServersReady is closed")
+	}
+}
+
+func TestStartedClosedWhenListenFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cfg := testConfig()
+	cfg.HTTPPort = busy.Addr().(*net.TCPAddr).Port
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	if err := c.Run(); err == nil {
+		t.Fatal("Run succeeded although the HTTP port is in use")
+	}
+	select {
+	case <-c.Started():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Started is not closed after listening failed")
+	}
+	if c.HTTPAddr() != "" {
+		t.Fatalf("HTTPAddr = %q although the HTTP server is not listening", c.HTTPAddr())
+	}
+}
+
+func TestBoundAddresses(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	if c.GRPCAddr() != "" || c.HTTPAddr() != "" {
+		t.Fatalf("addresses %q and %q are set before Run", c.GRPCAddr(), c.HTTPAddr())
+	}
+	svc := &dialService{}
+	c.SetService(svc)
+	runTestServer(t, c)
+	defer svc.conn.Close()
+
+	for name, addr := range map[string]string{"gRPC": c.GRPCAddr(), "HTTP": c.HTTPAddr()} {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host != "127.0.0.1" || port == "0" {
+			t.Errorf("%s address = %q, want the port assigned by the OS on 127.0.0.1", name, addr)
+		}
+	}
+	// the gateway dials the port assigned to the gRPC server
+	if err := svc.conn.Invoke(context.Background(), "/grpc.health.v1.Health/Check", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{}); err != nil {
+		t.Errorf("call through the gateway connection failed: %v", err)
+	}
+	resp, err := http.Get("http://" + c.HTTPAddr() + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP server at %s returned %d", c.HTTPAddr(), resp.StatusCode)
+	}
+}
+
+// dialService is a CBService dialing the gRPC server from InitHTTP with the options given to the gateway
+type dialService struct {
+	testService
+	conn *grpc.ClientConn
+}
+
+func (s *dialService) InitHTTP(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error {
+	var err error
+	s.conn, err = grpc.NewClient(endpoint, opts...)
+	return err
+}
+
+func TestGatewayDialAppliesServiceConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.GRPCServiceConfig = `{"methodConfig": [{"name": [{"service": "coldbrew.test.Blocking"}], "timeout": "0.05s"}]}`
+	c := newTestCB(t, cfg)
+	srv := newBlockingServer()
+	svc := &dialService{testService: testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&blockingServiceDesc, srv)
+		return nil
+	}}}
+	c.SetService(svc)
+	runTestServer(t, c)
+	defer close(srv.release)
+	defer svc.conn.Close()
+
+	err := svc.conn.Invoke(context.Background(), blockingMethod, &emptypb.Empty{}, &emptypb.Empty{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("call through the gateway connection returned %v, want the DeadlineExceeded of the service config timeout", err)
+	}
+}
+
+func TestGatewayKeepalivePingsAccepted(t *testing.T) {
+	for _, keepalive := range []int{0, 1} {
+		t.Run(fmt.Sprintf("keepalive %ds", keepalive), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.GatewayKeepaliveTimeSeconds = keepalive
+			c := newTestCB(t, cfg)
+			runEchoServer(t, c)
+
+			conn, err := net.Dial("tcp", c.grpcAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+				t.Fatal(err)
+			}
+			framer := http2.NewFramer(conn, conn)
+			if err := framer.WriteSettings(); err != nil {
+				t.Fatal(err)
+			}
+			// an open call, the server only accepts pings more frequent than every two hours while calls are active
+			var headers bytes.Buffer
+			enc := hpack.NewEncoder(&headers)
+			for _, f := range [][2]string{{":method", "POST"}, {":scheme", "http"}, {":path", echoMethod}, {":authority", c.grpcAddr}, {"content-type", "application/grpc"}, {"te", "trailers"}} {
+				enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+			}
+			if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: headers.Bytes(), EndHeaders: true}); err != nil {
+				t.Fatal(err)
+			}
+			goAway := make(chan http2.ErrCode, 1)
+			go func() {
+				for {
+					frame, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					if f, ok := frame.(*http2.GoAwayFrame); ok {
+						goAway <- f.ErrCode
+						return
+					}
+				}
+			}()
+
+			// the server tolerates two pings below its enforcement interval, the gateway pings every keepalive interval
+			for i := 0; i < 4; i++ {
+				if i > 0 {
+					time.Sleep(1100 * time.Millisecond)
+				}
+				if err := framer.WritePing(false, [8]byte{byte(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case code := <-goAway:
+				if keepalive > 0 {
+					t.Fatalf("server closed the connection with %v although pings every %ds are configured for the gateway", code, keepalive)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if keepalive == 0 {
+					t.Fatal("server accepted pings more frequent than its default enforcement policy")
+				}
+			}
+		})
+	}
+}
+
+func TestSetGRPCServerOptions(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	var intercepted atomic.Int32
+	c.SetGRPCServerOptions(
+		grpc.MaxRecvMsgSize(64),
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			intercepted.Add(1)
+			return handler(ctx, req)
+		}),
+	)
+	runEchoServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := intercepted.Load(); n != 1 {
+		t.Errorf("interceptor set with SetGRPCServerOptions ran %d times, want 1", n)
+	}
+	err = conn.Invoke(context.Background(), echoMethod, wrapperspb.String(strings.Repeat("a", 128)), &wrapperspb.StringValue{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("call larger than the MaxRecvMsgSize set with SetGRPCServerOptions returned %v, want ResourceExhausted", err)
+	}
+}
+
+func TestSetUnknownServiceHandler(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetUnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		in := &wrapperspb.StringValue{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		return stream.SendMsg(wrapperspb.String(method + " " + in.GetValue()))
+	})
+	runEchoServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	out := &wrapperspb.StringValue{}
+	if err := conn.Invoke(context.Background(), "/coldbrew.test.Unknown/Call", wrapperspb.String("coldbrew"), out); err != nil {
+		t.Fatalf("call to an unknown service failed: %v", err)
+	}
+	if want := "/coldbrew.test.Unknown/Call coldbrew"; out.GetValue() != want {
+		t.Errorf("unknown service handler answered %q, want %q", out.GetValue(), want)
+	}
+	out.Reset()
+	if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String("coldbrew"), out); err != nil || out.GetValue() != "coldbrew" {
+		t.Errorf("registered service answered %q, %v, it must not be handled by the unknown service handler", out.GetValue(), err)
+	}
+}
+
+func TestGRPCMessageSizeLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.GRPCMaxRecvMsgSize = 256
+	cfg.GRPCMaxSendMsgSize = 64
+	c := newTestCB(t, cfg)
+	svc := &dialService{testService: testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&echoServiceDesc, &echoServer{})
+		return nil
+	}}}
+	c.SetService(svc)
+	runTestServer(t, c)
+	defer svc.conn.Close()
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name    string
+		conn    *grpc.ClientConn
+		size    int
+		message string
+	}{
+		{name: "server receive limit", conn: conn, size: 512, message: "received message larger than max"},
+		{name: "server send limit", conn: conn, size: 128, message: "trying to send message larger than max"},
+		// the gateway does not send requests the server would reject
+		{name: "gateway send limit", conn: svc.conn, size: 512, message: "trying to send message larger than max (515 vs. 256)"},
+	}
+	for _, tt := range tests {
+		err := tt.conn.Invoke(context.Background(), echoMethod, wrapperspb.String(strings.Repeat("a", tt.size)), &wrapperspb.StringValue{})
+		if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s: call returned %v, want ResourceExhausted with %q", tt.name, err, tt.message)
+		}
+	}
+	if err := svc.conn.Invoke(context.Background(), echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{}); err != nil {
+		t.Errorf("call within the limits returned %v", err)
+	}
+}
+
+func TestGatewayMaxRecvMsgSize(t *testing.T) {
+	cfg := testConfig()
+	cfg.GatewayMaxRecvMsgSize = 64
+	c := newTestCB(t, cfg)
+	svc := &dialService{testService: testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&echoServiceDesc, &echoServer{})
+		return nil
+	}}}
+	c.SetService(svc)
+	runTestServer(t, c)
+	defer svc.conn.Close()
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	large := wrapperspb.String(strings.Repeat("a", 128))
+	err = svc.conn.Invoke(context.Background(), echoMethod, large, &wrapperspb.StringValue{})
+	if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "received message larger than max (131 vs. 64)") {
+		t.Errorf("gateway call returned %v, want the response rejected by the gateway receive limit", err)
+	}
+	// the limit only applies to the gateway
+	if err := conn.Invoke(context.Background(), echoMethod, large, &wrapperspb.StringValue{}); err != nil {
+		t.Errorf("call of an external client returned %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+	"regexp"
+	goruntime "runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"google.golang.org/grpc"
+)
+
+// pprofHandler returns a handler serving the net/http/pprof endpoints under /debug/pprof/
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// tokenAuth returns a middleware that only lets requests carrying the token through
+// the token can be provided as a bearer token or as the password of basic auth
+// an empty token disables authentication
+func tokenAuth(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := ""
+		if _, password, ok := r.BasicAuth(); ok {
+			provided = password
+		} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			unauthorized(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// debugAuthEnabled reports whether credentials are configured for the debug routes
+func (c *cb) debugAuthEnabled() bool {
+	return c.config.DebugAuthPassword != "" || c.config.DebugBearerToken != ""
+}
+
+// debugAuthorized reports whether the request carries the credentials configured for the debug routes
+// either the basic auth username and password or the bearer token
+func (c *cb) debugAuthorized(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok && c.config.DebugAuthPassword != "" {
+		return subtle.ConstantTimeCompare([]byte(username), []byte(c.config.DebugAuthUsername)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.config.DebugAuthPassword)) == 1
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && c.config.DebugBearerToken != "" {
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(c.config.DebugBearerToken)) == 1
+	}
+	return false
+}
+
+// isDebugPath reports whether the path is served by the debug routes
+// the whole /debug/ prefix is protected so that unauthorized requests can not tell which endpoints exist
+func isDebugPath(path string) bool {
+	return strings.HasPrefix(path, "/debug/") || path == "/features"
+}
+
+// unauthorized replies with 401 asking for basic auth credentials
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="debug"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// debugAuth returns a middleware that only lets requests carrying the debug credentials through
+// the handler is returned as is when no credentials are configured
+func (c *cb) debugAuth(h http.Handler) http.Handler {
+	if !c.debugAuthEnabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.debugAuthorized(r) {
+			unauthorized(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// interceptorChain holds the names of the gRPC server interceptors in execution order, the first one is the outermost
+type interceptorChain struct {
+	Unary  []string `json:"unary"`
+	Stream []string `json:"stream"`
+}
+
+// closureSuffix matches the suffix the compiler gives to closures, e.g. .func1 or .func2.1
+var closureSuffix = regexp.MustCompile(`(\.func\d+)+(\.\d+)*$`)
+
+// interceptorName returns the name of the function an interceptor is created by, e.g. interceptors.PanicRecoveryInterceptor
+func interceptorName(i interface{}) string {
+	f := goruntime.FuncForPC(reflect.ValueOf(i).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := closureSuffix.ReplaceAllString(f.Name(), "")
+	// drop the import path, keeping the package name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	// method values are suffixed with -fm
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// newInterceptorChain returns the names of the unary and stream interceptors
+func newInterceptorChain(unary []grpc.UnaryServerInterceptor, stream []grpc.StreamServerInterceptor) interceptorChain {
+	chain := interceptorChain{
+		Unary:  make([]string, 0, len(unary)),
+		Stream: make([]string, 0, len(stream)),
+	}
+	for _, i := range unary {
+		chain.Unary = append(chain.Unary, interceptorName(i))
+	}
+	for _, i := range stream {
+		chain.Stream = append(chain.Stream, interceptorName(i))
+	}
+	return chain
+}
+
+// interceptorsHandler serves the interceptor chain of the gRPC server
+// interceptors added with SetGRPCServerOptions run after the listed ones and are not included
+func (c *cb) interceptorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.interceptorChain)
+}
+
+// runtimeStats is the body of /debug/stats, the memory and GC statistics of runtime.MemStats with the number of goroutines
+type runtimeStats struct {
+	goruntime.MemStats
+	NumGoroutine int
+	GOMAXPROCS   int
+}
+
+// readRuntimeStats reads the memory and GC statistics of the process, it stops the world briefly
+func readRuntimeStats() *runtimeStats {
+	stats := &runtimeStats{
+		NumGoroutine: goruntime.NumGoroutine(),
+		GOMAXPROCS:   goruntime.GOMAXPROCS(0),
+	}
+	goruntime.ReadMemStats(&stats.MemStats)
+	return stats
+}
+
+// statsHandler serves the memory and GC statistics of the process as JSON
+// reading them stops the world briefly, it is meant for occasional checks and not for frequent scraping
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readRuntimeStats())
+}
+
+// gcResult is the body of /debug/gc, the runtime stats before and after the collection
+type gcResult struct {
+	Before   *runtimeStats
+	After    *runtimeStats
+	Duration string
+}
+
+// gcHandler forces a garbage collection and returns as much memory as possible to the OS on POST
+// it blocks the calling goroutine until the collection completes and is meant for investigating memory leaks
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	result := gcResult{Before: readRuntimeStats()}
+	start := time.Now()
+	// FreeOSMemory runs a collection before returning the memory to the OS
+	debug.FreeOSMemory()
+	result.Duration = time.Since(start).String()
+	result.After = readRuntimeStats()
+	log.Info(r.Context(), "msg", "forced garbage collection", "duration", result.Duration, "heap_alloc_before", result.Before.HeapAlloc, "heap_alloc_after", result.After.HeapAlloc)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,287 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	goruntime "runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/interceptors"
+)
+
+// freePort returns a port nothing listens on for configs that do not accept port zero
+func freePort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestPprofOnSeparatePort(t *testing.T) {
+	cfg := testConfig()
+	cfg.PprofPort = freePort(t)
+	cfg.PprofAuthToken = "secret"
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	get := func(url string, auth func(r *http.Request)) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	pprofURL := "http://" + net.JoinHostPort(cfg.ListenHost, fmt.Sprint(cfg.PprofPort)) + "/debug/pprof/"
+	tests := []struct {
+		name string
+		auth func(r *http.Request)
+		want int
+	}{
+		{name: "no token", auth: func(r *http.Request) {}, want: http.StatusUnauthorized},
+		{name: "wrong token", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, want: http.StatusUnauthorized},
+		{name: "bearer token", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, want: http.StatusOK},
+		{name: "basic auth password", auth: func(r *http.Request) { r.SetBasicAuth("anyone", "secret") }, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := get(pprofURL, tt.auth)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: pprof port returned %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without a WWW-Authenticate challenge", tt.name)
+		}
+	}
+	// pprof is no longer served by the gateway
+	if resp := get("http://"+c.httpAddr+"/debug/pprof/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }); resp.StatusCode == http.StatusOK {
+		t.Error("pprof is still served on the gateway port")
+	}
+}
+
+func TestInterceptorName(t *testing.T) {
+	c := &cb{}
+	tests := []struct {
+		interceptor interface{}
+		want        string
+	}{
+		{interceptor: defaultTimeoutInterceptor(time.Second), want: "core.defaultTimeoutInterceptor"},
+		{interceptor: c.inFlightInterceptor(), want: "core.(*cb).inFlightInterceptor"},
+		{interceptor: c.interceptorsHandler, want: "core.(*cb).interceptorsHandler"},
+		// the import path is dropped, keeping the package name
+		{interceptor: interceptors.DefaultInterceptors()[0], want: "interceptors.ResponseTimeLoggingInterceptor"},
+	}
+	for _, tt := range tests {
+		if got := interceptorName(tt.interceptor); got != tt.want {
+			t.Errorf("interceptorName = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestInterceptorsEndpoint(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		name := map[bool]string{false: "enabled", true: "disabled"}[disabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DefaultRequestTimeoutInSeconds = 1
+			cfg.DisableDebug = disabled
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{})
+			runTestServer(t, c)
+
+			resp, err := http.Get("http://" + c.httpAddr + "/debug/interceptors")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if disabled {
+				if resp.StatusCode == http.StatusOK {
+					t.Fatal("/debug/interceptors is served although debug is disabled")
+				}
+				return
+			}
+			var chain interceptorChain
+			if err := json.NewDecoder(resp.Body).Decode(&chain); err != nil {
+				t.Fatalf("/debug/interceptors returned %d with an invalid body: %v", resp.StatusCode, err)
+			}
+			// the default timeout is applied before the default interceptors so that they all see the deadline
+			if i, j := slices.Index(chain.Unary, "core.defaultTimeoutInterceptor"), slices.Index(chain.Unary, "interceptors.ResponseTimeLoggingInterceptor"); i < 0 || j < i {
+				t.Errorf("unary chain = %v, want core.defaultTimeoutInterceptor before the default interceptors", chain.Unary)
+			}
+			if i, j := slices.Index(chain.Stream, "core.defaultTimeoutStreamInterceptor"), slices.Index(chain.Stream, "interceptors.ResponseTimeLoggingStreamInterceptor"); i < 0 || j < i {
+				t.Errorf("stream chain = %v, want core.defaultTimeoutStreamInterceptor before the default interceptors", chain.Stream)
+			}
+		})
+	}
+}
+
+func TestDebugStats(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		name := map[bool]string{false: "enabled", true: "disabled"}[disabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DisableDebug = disabled
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{})
+			runTestServer(t, c)
+
+			resp, err := http.Get("http://" + c.httpAddr + "/debug/stats")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if disabled {
+				if resp.StatusCode == http.StatusOK {
+					t.Fatal("/debug/stats is served although debug is disabled")
+				}
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("/debug/stats Content-Type = %q, want application/json", ct)
+			}
+			var stats map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				t.Fatalf("/debug/stats returned %d with an invalid body: %v", resp.StatusCode, err)
+			}
+			if got := stats["GOMAXPROCS"]; got != float64(goruntime.GOMAXPROCS(0)) {
+				t.Errorf("GOMAXPROCS = %v, want %d", got, goruntime.GOMAXPROCS(0))
+			}
+			for _, field := range []string{"NumGoroutine", "HeapAlloc", "Sys"} {
+				if v, ok := stats[field].(float64); !ok || v <= 0 {
+					t.Errorf("%s = %v, want a positive number", field, stats[field])
+				}
+			}
+			for _, field := range []string{"NumGC", "PauseTotalNs", "GCCPUFraction"} {
+				if _, ok := stats[field].(float64); !ok {
+					t.Errorf("%s is missing from /debug/stats", field)
+				}
+			}
+		})
+	}
+}
+
+func TestDebugAuth(t *testing.T) {
+	cfg := testConfig()
+	cfg.PprofPort = freePort(t)
+	cfg.DebugAuthUsername = "admin"
+	cfg.DebugAuthPassword = "secret"
+	cfg.DebugBearerToken = "token"
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	basic := func(username, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	none := func(r *http.Request) {}
+	pprofURL := fmt.Sprintf("http://127.0.0.1:%d/debug/pprof/", cfg.PprofPort)
+	tests := []struct {
+		url  string
+		auth func(r *http.Request)
+		want int
+	}{
+		{url: "http://" + c.httpAddr + "/debug/interceptors", auth: none, want: http.StatusUnauthorized},
+		{url: "http://" + c.httpAddr + "/features", auth: none, want: http.StatusUnauthorized},
+		// unknown debug paths are not told apart from existing ones
+		{url: "http://" + c.httpAddr + "/debug/missing", auth: none, want: http.StatusUnauthorized},
+		{url: "http://" + c.httpAddr + "/debug/interceptors", auth: basic("admin", "wrong"), want: http.StatusUnauthorized},
+		{url: "http://" + c.httpAddr + "/debug/interceptors", auth: bearer("wrong"), want: http.StatusUnauthorized},
+		{url: "http://" + c.httpAddr + "/debug/interceptors", auth: basic("admin", "secret"), want: http.StatusOK},
+		{url: "http://" + c.httpAddr + "/debug/interceptors", auth: bearer("token"), want: http.StatusOK},
+		{url: "http://" + c.httpAddr + "/readyz", auth: none, want: http.StatusOK},
+		{url: pprofURL, auth: none, want: http.StatusUnauthorized},
+		{url: pprofURL, auth: bearer("token"), want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s with %s returned %d, want %d", tt.url, req.Header.Get("Authorization"), resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s returned 401 without asking for credentials", tt.url)
+		}
+	}
+}
+
+func TestDebugGC(t *testing.T) {
+	gc := func(t *testing.T, c *cb, method string, auth bool) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+c.httpAddr+"/debug/gc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("without credentials", func(t *testing.T) {
+		c := newTestCB(t, testConfig())
+		c.SetService(&testService{})
+		runTestServer(t, c)
+		if resp := gc(t, c, http.MethodPost, false); resp.StatusCode == http.StatusOK {
+			t.Fatal("/debug/gc is served without debug credentials configured")
+		}
+	})
+
+	t.Run("with credentials", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.DebugAuthUsername = "admin"
+		cfg.DebugAuthPassword = "secret"
+		c := newTestCB(t, cfg)
+		c.SetService(&testService{})
+		runTestServer(t, c)
+
+		if resp := gc(t, c, http.MethodPost, false); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("unauthenticated POST /debug/gc = %d, want 401", resp.StatusCode)
+		}
+		if resp := gc(t, c, http.MethodGet, true); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+			t.Errorf("GET /debug/gc = %d with Allow %q, want 405 with Allow POST", resp.StatusCode, resp.Header.Get("Allow"))
+		}
+		resp := gc(t, c, http.MethodPost, true)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /debug/gc = %d, want 200", resp.StatusCode)
+		}
+		var result gcResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Before == nil || result.After == nil || result.After.NumGC <= result.Before.NumGC {
+			t.Errorf("no collection ran between the stats, before %+v after %+v", result.Before, result.After)
+		}
+		if _, err := time.ParseDuration(result.Duration); err != nil {
+			t.Errorf("invalid collection duration %q: %v", result.Duration, err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var errDependencyNotChecked = errors.New("not checked yet")
+
+// dependencyHealth periodically checks a downstream gRPC dependency with the grpc.health.v1 protocol
+type dependencyHealth struct {
+	target   string
+	service  string
+	interval time.Duration
+	conn     *grpc.ClientConn
+	// status holds the error of the last check, nil when the dependency is serving
+	status atomic.Pointer[error]
+}
+
+// newDependencyHealth parses a target of the form host:port or host:port/service and connects to it
+// the connection is made lazily by gRPC so an unavailable dependency does not fail the startup
+func newDependencyHealth(target string, interval time.Duration) (*dependencyHealth, error) {
+	addr, service, _ := strings.Cut(target, "/")
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("dependency %s: %w", target, err)
+	}
+	d := &dependencyHealth{
+		target:   target,
+		service:  service,
+		interval: interval,
+		conn:     conn,
+	}
+	d.setStatus(errDependencyNotChecked)
+	return d, nil
+}
+
+func (d *dependencyHealth) setStatus(err error) {
+	d.status.Store(&err)
+}
+
+// check returns the result of the last health check
+func (d *dependencyHealth) check(context.Context) error {
+	return *d.status.Load()
+}
+
+// run checks the dependency every interval until the context is done
+func (d *dependencyHealth) run(ctx context.Context) {
+	client := healthpb.NewHealthClient(d.conn)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.probe(ctx, client)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe runs a single health check and records its result
+func (d *dependencyHealth) probe(ctx context.Context, client healthpb.HealthClient) {
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: d.service})
+	if err == nil && resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		err = fmt.Errorf("status %s", resp.GetStatus())
+	}
+	prev := d.check(ctx)
+	if (err == nil) != (prev == nil) {
+		if err != nil {
+			log.Warn(ctx, "msg", "dependency is not healthy", "dependency", d.target, "err", err)
+		} else {
+			log.Info(ctx, "msg", "dependency is healthy", "dependency", d.target)
+		}
+	}
+	d.setStatus(err)
+}
+
+func (d *dependencyHealth) Close() error {
+	return d.conn.Close()
+}
+
+// initDependencies creates the health checkers for DependencyHealthTargets
+func (c *cb) initDependencies() error {
+	interval := time.Duration(c.config.DependencyHealthIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for _, target := range c.config.DependencyHealthTargets {
+		if target = strings.TrimSpace(target); target == "" {
+			continue
+		}
+		d, err := newDependencyHealth(target, interval)
+		if err != nil {
+			return err
+		}
+		c.dependencies = append(c.dependencies, d)
+		c.closers = append(c.closers, d)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"time"
+)
+
+// EventType is the type of a lifecycle event
+type EventType int
+
+const (
+	// EventStarting is emitted when Run is called, before the servers are initialized
+	EventStarting EventType = iota
+	// EventReady is emitted once the gRPC and HTTP servers are initialized and being started
+	EventReady
+	// EventShuttingDown is emitted when Stop is called, before the servers are stopped
+	EventShuttingDown
+	// EventStopped is emitted when Run returns, after all closers are closed
+	EventStopped
+)
+
+// String returns the name of the event type
+func (e EventType) String() string {
+	switch e {
+	case EventStarting:
+		return "starting"
+	case EventReady:
+		return "ready"
+	case EventShuttingDown:
+		return "shutting-down"
+	case EventStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Event is a lifecycle event emitted by ColdBrew
+type Event struct {
+	// Type is the type of the event
+	Type EventType
+	// Time is the time at which the event was emitted
+	Time time.Time
+	// Err is the error returned by Run, it is only set for EventStopped
+	Err error
+}
+
+// Subscribe registers a function that is called for every lifecycle event
+// Subscribers are called synchronously in the order they were registered, they should not block
+func (c *cb) Subscribe(f func(Event)) {
+	if f == nil {
+		return
+	}
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+	c.subscribers = append(c.subscribers, f)
+}
+
+// emit delivers the event to all subscribers
+func (c *cb) emit(t EventType, err error) {
+	c.subscribersMu.RLock()
+	subscribers := c.subscribers
+	c.subscribersMu.RUnlock()
+	e := Event{
+		Type: t,
+		Time: time.Now(),
+		Err:  err,
+	}
+	for _, f := range subscribers {
+		f(e)
+	}
+}
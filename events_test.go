@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder records the lifecycle events it is subscribed to
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]EventType, 0, len(r.events))
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func (r *eventRecorder) last() Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetService(&testService{})
+	rec := &eventRecorder{}
+	c.Subscribe(rec.record)
+	c.Subscribe(nil)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run()
+	}()
+	select {
+	case <-c.Started():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not start")
+	}
+	if err := c.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	runErr := <-errs
+
+	want := []EventType{EventStarting, EventReady, EventShuttingDown, EventStopped}
+	if got := rec.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if last := rec.last(); last.Err != runErr {
+		t.Errorf("stopped event carries %v, want the error returned by Run %v", last.Err, runErr)
+	}
+}
+
+func TestLifecycleEventsWhenRunFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cfg := testConfig()
+	cfg.GRPCPort = busy.Addr().(*net.TCPAddr).Port
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	rec := &eventRecorder{}
+	c.Subscribe(rec.record)
+	runErr := c.Run()
+	if runErr == nil {
+		t.Fatal("Run succeeded although the gRPC port is in use")
+	}
+
+	want := []EventType{EventStarting, EventStopped}
+	if got := rec.types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if last := rec.last(); last.Err != runErr {
+		t.Errorf("stopped event carries %v, want the error returned by Run %v", last.Err, runErr)
+	}
+}
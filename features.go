@@ -0,0 +1,30 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+var (
+	featureFlags   = map[string]bool{}
+	featureFlagsMu sync.RWMutex
+)
+
+// RegisterFeatureFlags registers build time feature flags, they are served as JSON at /features unless DisableDebug is set
+// It can be called more than once, flags registered later override the earlier ones with the same name
+func RegisterFeatureFlags(flags map[string]bool) {
+	featureFlagsMu.Lock()
+	defer featureFlagsMu.Unlock()
+	for name, enabled := range flags {
+		featureFlags[name] = enabled
+	}
+}
+
+// featuresHandler serves the registered feature flags as a JSON object
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	featureFlagsMu.RLock()
+	defer featureFlagsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(featureFlags)
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	t.Cleanup(func() {
+		featureFlagsMu.Lock()
+		defer featureFlagsMu.Unlock()
+		featureFlags = map[string]bool{}
+	})
+	RegisterFeatureFlags(map[string]bool{"new_checkout": false, "dark_mode": true})
+	RegisterFeatureFlags(map[string]bool{"new_checkout": true})
+
+	for _, disabled := range []bool{false, true} {
+		name := map[bool]string{false: "served", true: "debug disabled"}[disabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DisableDebug = disabled
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{})
+			runTestServer(t, c)
+
+			resp, err := http.Get("http://" + c.httpAddr + "/features")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if disabled {
+				if resp.StatusCode == http.StatusOK {
+					t.Fatal("/features is served although DisableDebug is set")
+				}
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var flags map[string]bool
+			if err := json.NewDecoder(resp.Body).Decode(&flags); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]bool{"new_checkout": true, "dark_mode": true}; !reflect.DeepEqual(flags, want) {
+				t.Errorf("/features = %v, want %v with the later registration overriding the earlier one", flags, want)
+			}
+		})
+	}
+}
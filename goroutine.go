@@ -0,0 +1,33 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-coldbrew/errors/notifier"
+	"github.com/go-coldbrew/log"
+)
+
+// Go runs the provided function in a new goroutine and recovers from any panic raised by it
+// The gRPC panic recovery interceptor only covers the handler goroutine, so a panic in a goroutine
+// spawned by a handler would otherwise crash the whole process
+// ctx is used for logging and is passed to the notifier when reporting the panic
+func Go(ctx context.Context, f func()) {
+	go func() {
+		defer recoverAndNotify(ctx)
+		f()
+	}()
+}
+
+// recoverAndNotify recovers from a panic, logs it and reports it to the notifier
+// It must be called directly with defer
+func recoverAndNotify(ctx context.Context) {
+	if r := recover(); r != nil {
+		err, ok := r.(error)
+		if !ok {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		log.Error(ctx, "msg", "recovered panic in goroutine", "panic", r)
+		notifier.NotifyWithLevel(err, "critical", ctx)
+	}
+}
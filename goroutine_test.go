@@ -0,0 +1,28 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGoRecoversPanics(t *testing.T) {
+	done := make(chan struct{})
+	Go(context.Background(), func() {
+		defer close(done)
+		panic("boom")
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("goroutine did not run")
+	}
+	// recovering happens after f returns, the same path is run synchronously so that the test fails if it panics
+	for _, v := range []interface{}{"boom", errors.New("boom")} {
+		func() {
+			defer recoverAndNotify(context.Background())
+			panic(v)
+		}()
+	}
+}
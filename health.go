@@ -0,0 +1,63 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthManager is the single source of truth of the serving status of the service
+// It backs the grpc.health.v1 service (unless DisableGRPCHealth is set) and the readiness endpoint at /readyz
+type HealthManager struct {
+	server *health.Server
+}
+
+func newHealthManager() *HealthManager {
+	return &HealthManager{server: health.NewServer()}
+}
+
+// SetServingStatus sets the serving status of service, the empty service is the status of the whole server
+// the readiness endpoint reports not ready unless the whole server is SERVING
+func (h *HealthManager) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	h.server.SetServingStatus(service, status)
+}
+
+// Status returns the serving status of service, SERVICE_UNKNOWN if it was never set
+func (h *HealthManager) Status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := h.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	return resp.GetStatus()
+}
+
+// shutdown sets all services as NOT_SERVING and ignores further updates
+func (h *HealthManager) shutdown() {
+	h.server.Shutdown()
+}
+
+// check is the readiness check of the whole server status
+func (h *HealthManager) check(context.Context) error {
+	if s := h.Status(""); s != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %s", s)
+	}
+	return nil
+}
+
+// registerServices registers the grpc.health.v1 service on server unless a service already did
+// and reports every registered service as SERVING unless its status was already set
+func (h *HealthManager) registerServices(server *grpc.Server) {
+	info := server.GetServiceInfo()
+	if _, ok := info[healthpb.Health_ServiceDesc.ServiceName]; ok {
+		return
+	}
+	healthpb.RegisterHealthServer(server, h.server)
+	for name := range info {
+		if h.Status(name) == healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+			h.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+}
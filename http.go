@@ -0,0 +1,516 @@
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/NYTimes/gziphandler"
+	"github.com/go-coldbrew/errors/notifier"
+	"github.com/go-coldbrew/log"
+	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// TrailingSlashRedirect redirects requests with a trailing slash to the path without it
+	TrailingSlashRedirect = "redirect"
+	// TrailingSlashStrip removes the trailing slash from the request path before routing
+	TrailingSlashStrip = "strip"
+)
+
+const (
+	// UnknownQueryParamsIgnore ignores query parameters that do not match a field of the request, the grpc-gateway default
+	UnknownQueryParamsIgnore = "ignore"
+	// UnknownQueryParamsReject answers requests with query parameters that do not match a field of the request with 400
+	UnknownQueryParamsReject = "reject"
+)
+
+// queryParamKeyRegexp matches map query parameters, e.g. labels[key]=value
+var queryParamKeyRegexp = regexp.MustCompile(`^(.*)\[(.*)\]$`)
+
+// strictQueryParser is a runtime.QueryParameterParser rejecting query parameters that do not match a field of the request
+// the generated gateway handlers answer the returned error with InvalidArgument
+type strictQueryParser struct {
+	runtime.DefaultQueryParser
+}
+
+func (p *strictQueryParser) Parse(msg proto.Message, values url.Values, filter *utilities.DoubleArray) error {
+	for key := range values {
+		if match := queryParamKeyRegexp.FindStringSubmatch(key); len(match) == 3 {
+			key = match[1]
+		}
+		if !queryFieldExists(msg.ProtoReflect().Descriptor(), strings.Split(key, ".")) {
+			return fmt.Errorf("unknown query parameter %q", key)
+		}
+	}
+	return p.DefaultQueryParser.Parse(msg, values, filter)
+}
+
+// queryFieldExists reports whether the query parameter path, e.g. filter.name, matches a field of the message
+func queryFieldExists(desc protoreflect.MessageDescriptor, path []string) bool {
+	for i, name := range path {
+		if desc == nil {
+			return false
+		}
+		field := desc.Fields().ByTextName(name)
+		if field == nil {
+			field = desc.Fields().ByJSONName(name)
+		}
+		if field == nil {
+			return false
+		}
+		// only the last element of the path can be a repeated field
+		if i < len(path)-1 && field.Cardinality() == protoreflect.Repeated {
+			return false
+		}
+		desc = field.Message()
+	}
+	return true
+}
+
+// queryParameterParser returns the gateway option handling unknown query parameters according to mode
+func queryParameterParser(mode string) runtime.ServeMuxOption {
+	switch strings.ToLower(mode) {
+	case UnknownQueryParamsReject:
+		return runtime.SetQueryParameterParser(&strictQueryParser{})
+	case "", UnknownQueryParamsIgnore:
+	default:
+		log.Warn(context.Background(), "msg", "unknown query parameters mode, ignoring unknown query parameters", "mode", mode)
+	}
+	return runtime.SetQueryParameterParser(&runtime.DefaultQueryParser{})
+}
+
+// traceHeaderName returns the header carrying the trace id of requests
+func (c *cb) traceHeaderName() string {
+	if c.config.TraceHeaderName != "" {
+		return c.config.TraceHeaderName
+	}
+	return notifier.GetTraceHeaderName()
+}
+
+// requestIDHandler makes sure every request carries a trace id in headerName, a UUID is generated when it is missing
+// the id is added to the log context and sent back in the response header, the gateway forwards it to the gRPC server
+func requestIDHandler(headerName string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerName)
+		if id == "" {
+			id = uuid.NewString()
+			r.Header.Set(headerName, id)
+		}
+		w.Header().Set(headerName, id)
+		h.ServeHTTP(w, r.WithContext(notifier.UpdateTraceId(r.Context(), id)))
+	})
+}
+
+// defaultContentTypeHandler sets the Content-Type and Accept headers of requests that do not have them to contentType
+// so that the gateway picks a predictable marshaler for simple clients, the handler is returned as is when contentType is empty
+func defaultContentTypeHandler(contentType string, h http.Handler) http.Handler {
+	if contentType == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if r.Header.Get("Accept") == "" {
+			r.Header.Set("Accept", contentType)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// trailingSlashHandler normalizes request paths with a trailing slash so that /v1/items/ and /v1/items reach the same handler
+// mode is one of TrailingSlashRedirect or TrailingSlashStrip, any other value returns the handler as is
+func trailingSlashHandler(mode string, h http.Handler) http.Handler {
+	if mode != TrailingSlashRedirect && mode != TrailingSlashStrip {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) <= 1 || !strings.HasSuffix(r.URL.Path, "/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		path := strings.TrimRight(r.URL.Path, "/")
+		if path == "" {
+			path = "/"
+		}
+		if mode == TrailingSlashRedirect {
+			u := *r.URL
+			u.Path = path
+			u.RawPath = ""
+			// 308 preserves the method and body of the request
+			http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+type routeProbeKey struct{}
+
+// routeProbeMiddleware short circuits requests issued by allowedMethods so that matched handlers are never executed
+func routeProbeMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		if matched, ok := r.Context().Value(routeProbeKey{}).(*bool); ok {
+			*matched = true
+			return
+		}
+		next(w, r, pathParams)
+	}
+}
+
+// isRouteProbe returns true if the request was issued by allowedMethods
+func isRouteProbe(ctx context.Context) bool {
+	_, ok := ctx.Value(routeProbeKey{}).(*bool)
+	return ok
+}
+
+// allowedMethods returns the methods the mux has a route for on the path of the request
+// it relies on routeProbeMiddleware being registered on the mux
+func allowedMethods(mux *runtime.ServeMux, r *http.Request) []string {
+	methods := make([]string, 0)
+	for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+		req := r.Clone(r.Context())
+		req.Method = m
+		req.Header.Del("X-HTTP-Method-Override")
+		if hasRoute(mux, req) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// hasRoute returns true if the mux has a route matching the request without executing it
+// it relies on routeProbeMiddleware being registered on the mux
+func hasRoute(mux *runtime.ServeMux, r *http.Request) bool {
+	matched := false
+	mux.ServeHTTP(discardResponseWriter{}, r.WithContext(context.WithValue(r.Context(), routeProbeKey{}, &matched)))
+	return matched
+}
+
+// serviceMuxes routes requests to the mux of the service that registered a matching route
+// and falls back to the shared mux for everything else
+type serviceMuxes struct {
+	muxes    []*runtime.ServeMux
+	fallback *runtime.ServeMux
+}
+
+func (s serviceMuxes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, mux := range s.muxes {
+		if hasRoute(mux, r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.fallback.ServeHTTP(w, r)
+}
+
+// discardResponseWriter is a http.ResponseWriter that discards everything written to it
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardResponseWriter) WriteHeader(int) {}
+
+// routingErrorHandler handles gateway routing errors using the handlers set with SetNotFoundHandler and SetMethodNotAllowedHandler
+// when HTTPMethodNotAllowed is set, wrong methods are answered with 405 and an Allow header instead of the gateway default of 501
+func (c *cb) routingErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, httpStatus int) {
+	if isRouteProbe(ctx) {
+		return
+	}
+	switch httpStatus {
+	case http.StatusNotFound:
+		if c.notFoundHandler != nil {
+			c.notFoundHandler.ServeHTTP(w, r)
+			return
+		}
+	case http.StatusMethodNotAllowed:
+		if c.methodNotAllowedHandler == nil && !c.config.HTTPMethodNotAllowed {
+			break
+		}
+		w.Header().Set("Allow", strings.Join(allowedMethods(mux, r), ", "))
+		if c.methodNotAllowedHandler != nil {
+			c.methodNotAllowedHandler.ServeHTTP(w, r)
+			return
+		}
+		runtime.HTTPError(ctx, mux, m, w, r, &runtime.HTTPStatusError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        status.Error(codes.Unimplemented, http.StatusText(http.StatusMethodNotAllowed)),
+		})
+		return
+	}
+	runtime.DefaultRoutingErrorHandler(ctx, mux, m, w, r, httpStatus)
+}
+
+// gatewayDeadlineExceeded counts gateway calls that failed because the upstream gRPC call exceeded its deadline
+var gatewayDeadlineExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_deadline_exceeded_total",
+	Help: "Total number of HTTP gateway calls whose upstream gRPC call exceeded its deadline",
+}, []string{"grpc_method"})
+
+// gatewayErrorHandler reports upstream deadline errors before handing the error to the default gateway error handler
+// which answers them with a 504
+func gatewayErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	if s, ok := status.FromError(err); ok && s.Code() == codes.DeadlineExceeded {
+		method, _ := runtime.RPCMethod(ctx)
+		gatewayDeadlineExceeded.WithLabelValues(method).Inc()
+		log.Warn(ctx, "msg", "gateway upstream call exceeded its deadline", "grpc_method", method, "path", r.URL.Path, "err", err)
+		err = status.Errorf(codes.DeadlineExceeded, "upstream call to %s exceeded its deadline: %s", method, s.Message())
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, err)
+}
+
+// newHTTP2Server returns the HTTP/2 settings for the gateway, nil when none are configured
+func (c *cb) newHTTP2Server() *http2.Server {
+	if c.config.HTTP2MaxConcurrentStreams == 0 && c.config.HTTP2MaxReadFrameSize == 0 {
+		return nil
+	}
+	return &http2.Server{
+		MaxConcurrentStreams: c.config.HTTP2MaxConcurrentStreams,
+		MaxReadFrameSize:     c.config.HTTP2MaxReadFrameSize,
+	}
+}
+
+// gzipHandler wraps the handler with gzip compression using the configured options
+// the handler is returned as is when DisableHTTPGzip is set
+func (c *cb) gzipHandler(h http.Handler) (http.Handler, error) {
+	if c.config.DisableHTTPGzip {
+		return h, nil
+	}
+	level := c.config.HTTPGzipLevel
+	if level == 0 {
+		// no compression is what DisableHTTPGzip is for, zero is treated as unset
+		level = gzip.DefaultCompression
+	} else if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		log.Warn(context.Background(), "msg", "invalid gzip compression level, using the default level", "level", level)
+		level = gzip.DefaultCompression
+	}
+	minSize := c.config.HTTPGzipMinSize
+	if minSize < 0 {
+		log.Warn(context.Background(), "msg", "invalid gzip minimum size, using the default size", "min_size", minSize)
+	}
+	if minSize <= 0 {
+		minSize = gziphandler.DefaultMinSize
+	}
+	wrapper, err := gziphandler.GzipHandlerWithOpts(
+		// an empty content type list compresses all content types
+		gziphandler.ContentTypes(c.config.HTTPGzipContentTypes),
+		gziphandler.CompressionLevel(level),
+		gziphandler.MinSize(minSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper(h), nil
+}
+
+// staticFilesHandler returns the path prefix and the handler serving StaticFilesDir
+// it returns a nil handler when static files are not configured or would be served at / without StaticFilesAllowRoot
+func (c *cb) staticFilesHandler() (string, http.Handler) {
+	if c.config.StaticFilesDir == "" {
+		return "", nil
+	}
+	prefix := "/" + strings.Trim(c.config.StaticFilesPath, "/")
+	if prefix == "/" {
+		if !c.config.StaticFilesAllowRoot {
+			log.Warn(context.Background(), "msg", "not serving static files at / as it would shadow the gateway routes, set StaticFilesAllowRoot to allow it", "static_files_dir", c.config.StaticFilesDir)
+			return "", nil
+		}
+	} else {
+		prefix += "/"
+	}
+	fs := http.FileServer(noDirListingFS{http.Dir(c.config.StaticFilesDir)})
+	return prefix, http.StripPrefix(strings.TrimSuffix(prefix, "/"), fs)
+}
+
+// noDirListingFS is a http.FileSystem hiding the directories without an index.html so that they are not listed
+type noDirListingFS struct {
+	http.FileSystem
+}
+
+func (fs noDirListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// hasHandler reports whether a route of mux matches the request
+func hasHandler(mux *http.ServeMux, r *http.Request) bool {
+	_, pattern := mux.Handler(r)
+	return pattern != ""
+}
+
+// startGatewaySpan starts a span of the gateway as a child of the request span and returns the function finishing it
+// the span is started with OpenTelemetry when the servers trace with it and with OpenTracing otherwise
+func (c *cb) startGatewaySpan(ctx context.Context, name string) func() {
+	if c.tracing != tracingOpenTracing {
+		_, span := otel.Tracer("").Start(ctx, name)
+		return func() { span.End() }
+	}
+	span, _ := opentracing.StartSpanFromContext(ctx, name)
+	return span.Finish
+}
+
+// marshalSpanWriter finishes the marshal span of the response on the first write
+type marshalSpanWriter struct {
+	http.ResponseWriter
+	start func(ctx context.Context, name string) func()
+	end   func()
+}
+
+func (w *marshalSpanWriter) finish() {
+	if w.end != nil {
+		w.end()
+		w.end = nil
+	}
+}
+
+func (w *marshalSpanWriter) WriteHeader(code int) {
+	w.finish()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *marshalSpanWriter) Write(b []byte) (int, error) {
+	w.finish()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *marshalSpanWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *marshalSpanWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// unmarshalSpanBody traces the reading and decoding of the request body, from the first read to the end of the body
+type unmarshalSpanBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	start func(ctx context.Context, name string) func()
+	end   func()
+	done  bool
+}
+
+func (b *unmarshalSpanBody) finish() {
+	b.done = true
+	if b.end != nil {
+		b.end()
+		b.end = nil
+	}
+}
+
+func (b *unmarshalSpanBody) Read(p []byte) (int, error) {
+	if b.end == nil && !b.done {
+		b.end = b.start(b.ctx, "gateway.unmarshal")
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *unmarshalSpanBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+// marshalerLogger logs the marshalers the mux selects for each gateway request
+type marshalerLogger struct {
+	mux *runtime.ServeMux
+}
+
+// middleware logs the MIME types of the inbound and outbound marshalers of the request at debug level
+func (m *marshalerLogger) middleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		inbound, outbound := runtime.MarshalerForRequest(m.mux, r)
+		log.Debug(r.Context(), "msg", "gateway marshaler selected",
+			"path", r.URL.Path,
+			"content_type", r.Header.Get("Content-Type"),
+			"accept", r.Header.Get("Accept"),
+			"inbound_marshaler", inbound.ContentType(nil),
+			"outbound_marshaler", outbound.ContentType(nil),
+		)
+		next(w, r, pathParams)
+	}
+}
+
+// newServeMux returns a gateway mux with opts, logging the selected marshalers when LogGatewayMarshaler is set
+func (c *cb) newServeMux(opts ...runtime.ServeMuxOption) *runtime.ServeMux {
+	if !c.config.LogGatewayMarshaler {
+		return runtime.NewServeMux(opts...)
+	}
+	// the middleware needs the mux it is registered on to resolve the marshalers
+	ml := &marshalerLogger{}
+	ml.mux = runtime.NewServeMux(append(opts[:len(opts):len(opts)], runtime.WithMiddlewares(ml.middleware))...)
+	return ml.mux
+}
+
+// marshalSpanMiddleware adds the gateway.unmarshal span around the decoding of the request body
+// and prepares the response writer for the gateway.marshal span started by startMarshalSpan
+func (c *cb) marshalSpanMiddleware(next runtime.HandlerFunc) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		if r.Body != nil && r.Body != http.NoBody {
+			body := &unmarshalSpanBody{ReadCloser: r.Body, ctx: r.Context(), start: c.startGatewaySpan}
+			defer body.finish()
+			r.Body = body
+		}
+		mw := &marshalSpanWriter{ResponseWriter: w, start: c.startGatewaySpan}
+		defer mw.finish()
+		next(mw, r, pathParams)
+	}
+}
+
+// startMarshalSpan is a forward response option starting the gateway.marshal span, it is the last step before the
+// response is marshaled and the span is finished when the marshaled response is written
+func startMarshalSpan(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+	if mw, ok := w.(*marshalSpanWriter); ok {
+		mw.finish()
+		mw.end = mw.start(ctx, "gateway.marshal")
+	}
+	return nil
+}
@@ -0,0 +1,835 @@
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-coldbrew/errors/notifier"
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/google/uuid"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// pathRecorder answers every request with 200 and records the path it was routed with
+type pathRecorder struct {
+	path string
+}
+
+func (p *pathRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.path = r.URL.Path
+}
+
+func TestTrailingSlashHandler(t *testing.T) {
+	tests := []struct {
+		mode     string
+		target   string
+		code     int
+		path     string
+		location string
+	}{
+		{mode: "", target: "/v1/items/", code: http.StatusOK, path: "/v1/items/"},
+		{mode: TrailingSlashStrip, target: "/v1/items/", code: http.StatusOK, path: "/v1/items"},
+		{mode: TrailingSlashStrip, target: "/v1/items//", code: http.StatusOK, path: "/v1/items"},
+		{mode: TrailingSlashStrip, target: "/", code: http.StatusOK, path: "/"},
+		{mode: TrailingSlashStrip, target: "/v1/items", code: http.StatusOK, path: "/v1/items"},
+		{mode: TrailingSlashRedirect, target: "/v1/items/?page=2", code: http.StatusPermanentRedirect, location: "/v1/items?page=2"},
+		{mode: TrailingSlashRedirect, target: "/v1/items", code: http.StatusOK, path: "/v1/items"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.target, func(t *testing.T) {
+			next := &pathRecorder{}
+			w := httptest.NewRecorder()
+			trailingSlashHandler(tt.mode, next).ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.target, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if next.path != tt.path {
+				t.Errorf("handler was routed with %q, want %q", next.path, tt.path)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestRoutingErrorHandler(t *testing.T) {
+	tests := []struct {
+		name                    string
+		methodNotAllowed        bool
+		notFoundHandler         bool
+		methodNotAllowedHandler bool
+		wantNotFound            int
+		wantWrongMethod         int
+		wantAllow               string
+	}{
+		{name: "gateway defaults", wantNotFound: http.StatusNotFound, wantWrongMethod: http.StatusNotImplemented},
+		{name: "method not allowed", methodNotAllowed: true, wantNotFound: http.StatusNotFound, wantWrongMethod: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "custom handlers", notFoundHandler: true, methodNotAllowedHandler: true, wantNotFound: http.StatusTeapot, wantWrongMethod: http.StatusConflict, wantAllow: "POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.HTTPMethodNotAllowed = tt.methodNotAllowed
+			c := newTestCB(t, cfg)
+			var served atomic.Int32
+			c.SetService(&testService{initHTTP: func(ctx context.Context, mux *runtime.ServeMux) error {
+				return mux.HandlePath(http.MethodPost, "/v1/items", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+					served.Add(1)
+				})
+			}})
+			if tt.notFoundHandler {
+				c.SetNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusTeapot)
+				}))
+			}
+			if tt.methodNotAllowedHandler {
+				c.SetMethodNotAllowedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusConflict)
+				}))
+			}
+			runTestServer(t, c)
+
+			resp, err := http.Get("http://" + c.httpAddr + "/v1/missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantNotFound {
+				t.Errorf("unknown route returned %d, want %d", resp.StatusCode, tt.wantNotFound)
+			}
+
+			resp, err = http.Get("http://" + c.httpAddr + "/v1/items")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantWrongMethod {
+				t.Errorf("wrong method returned %d, want %d", resp.StatusCode, tt.wantWrongMethod)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			// looking up the allowed methods must not run the matched handler
+			if n := served.Load(); n != 0 {
+				t.Errorf("the POST handler was run %d times by requests with the wrong method", n)
+			}
+		})
+	}
+}
+
+// muxOptionService is a testService whose routes are served by a mux created with its own options
+type muxOptionService struct {
+	testService
+	opts []runtime.ServeMuxOption
+}
+
+func (s *muxOptionService) ServeMuxOptions() []runtime.ServeMuxOption {
+	return s.opts
+}
+
+// forwardRoute registers a POST route on mux answering with an empty message through the forward response options of the mux
+func forwardRoute(path string) func(ctx context.Context, mux *runtime.ServeMux) error {
+	return func(ctx context.Context, mux *runtime.ServeMux) error {
+		return mux.HandlePath(http.MethodPost, path, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+			_, outbound := runtime.MarshalerForRequest(mux, r)
+			ctx := runtime.NewServerMetadataContext(r.Context(), runtime.ServerMetadata{})
+			runtime.ForwardResponseMessage(ctx, mux, outbound, w, r, &emptypb.Empty{}, mux.GetForwardResponseOptions()...)
+		})
+	}
+}
+
+func TestServiceServeMuxOptions(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetService(&muxOptionService{
+		testService: testService{initHTTP: forwardRoute("/v1/own")},
+		opts: []runtime.ServeMuxOption{runtime.WithForwardResponseOption(func(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+			w.Header().Set("X-Own-Mux", "true")
+			return nil
+		})},
+	})
+	c.SetService(&testService{initHTTP: forwardRoute("/v1/shared")})
+	runTestServer(t, c)
+
+	post := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Post("http://"+c.httpAddr+path, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post("/v1/own"); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Own-Mux") != "true" {
+		t.Errorf("route of the service with its own options returned %d without its forward option", resp.StatusCode)
+	}
+	if resp := post("/v1/shared"); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Own-Mux") != "" {
+		t.Errorf("route of the shared mux returned %d, options of another service must not apply to it", resp.StatusCode)
+	}
+	if resp := post("/v1/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown route returned %d, want 404 from the shared mux", resp.StatusCode)
+	}
+}
+
+func TestSetServeMuxOptions(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetServeMuxOptions(runtime.WithForwardResponseOption(func(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+		w.Header().Set("X-Cb-Mux", "true")
+		return nil
+	}))
+	c.SetService(&testService{initHTTP: forwardRoute("/v1/shared")})
+	c.SetService(&muxOptionService{testService: testService{initHTTP: forwardRoute("/v1/own")}})
+	runTestServer(t, c)
+
+	for _, path := range []string{"/v1/shared", "/v1/own"} {
+		resp, err := http.Post("http://"+c.httpAddr+path, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cb-Mux") != "true" {
+			t.Errorf("%s returned %d without the forward option set through SetServeMuxOptions", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestGzipContentTypes(t *testing.T) {
+	body := strings.Repeat("coldbrew ", 500)
+	tests := []struct {
+		types       []string
+		contentType string
+		compressed  bool
+	}{
+		{types: nil, contentType: "text/html", compressed: true},
+		{types: []string{"application/json"}, contentType: "application/json", compressed: true},
+		{types: []string{"application/json"}, contentType: "application/json; charset=utf-8", compressed: true},
+		{types: []string{"application/json"}, contentType: "text/html", compressed: false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.types, ",")+" "+tt.contentType, func(t *testing.T) {
+			c := &cb{config: testConfig()}
+			c.config.HTTPGzipContentTypes = tt.types
+			h, err := c.gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(body))
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/v1/items", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.compressed {
+				t.Fatalf("compressed = %v, want %v", got, tt.compressed)
+			}
+		})
+	}
+}
+
+func TestGzipLevelAndMinSize(t *testing.T) {
+	// words in a fixed pseudo random order so that the compression level makes a difference
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"coldbrew", "espresso", "latte", "mocha", "ristretto", "lungo", "cortado", "macchiato"}
+	var b strings.Builder
+	for b.Len() < 64*1024 {
+		b.WriteString(words[rnd.Intn(len(words))])
+		b.WriteByte(' ')
+	}
+	large := b.String()
+	serve := func(t *testing.T, c *cb, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		h, err := c.gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(body))
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/v1/items", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	compressedSize := func(t *testing.T, level int) int {
+		t.Helper()
+		c := &cb{config: testConfig()}
+		c.config.HTTPGzipLevel = level
+		w := serve(t, c, large)
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("response was not compressed with level %d", level)
+		}
+		return w.Body.Len()
+	}
+
+	if fast, best := compressedSize(t, gzip.BestSpeed), compressedSize(t, gzip.BestCompression); best >= fast {
+		t.Errorf("level %d compressed to %d bytes and level %d to %d, want the best compression to be smaller", gzip.BestSpeed, fast, gzip.BestCompression, best)
+	}
+	// invalid levels fall back to the default level
+	if got, want := compressedSize(t, 42), compressedSize(t, gzip.DefaultCompression); got != want {
+		t.Errorf("invalid level compressed to %d bytes, want %d of the default level", got, want)
+	}
+
+	small := large[:200]
+	for _, tt := range []struct {
+		minSize    int
+		disabled   bool
+		compressed bool
+	}{
+		{minSize: 0, compressed: false},
+		{minSize: 100, compressed: true},
+		{minSize: 100, disabled: true, compressed: false},
+	} {
+		c := &cb{config: testConfig()}
+		c.config.HTTPGzipMinSize = tt.minSize
+		c.config.DisableHTTPGzip = tt.disabled
+		if got := serve(t, c, small).Header().Get("Content-Encoding") == "gzip"; got != tt.compressed {
+			t.Errorf("200 byte response with min size %d and disabled %v: compressed = %v, want %v", tt.minSize, tt.disabled, got, tt.compressed)
+		}
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('coldbrew')"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.StaticFilesDir = dir
+	cfg.StaticFilesPath = "assets"
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+	runTestServer(t, c)
+
+	resp, err := http.Get("http://" + c.httpAddr + "/assets/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "console.log('coldbrew')" {
+		t.Errorf("static file returned %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get("http://" + c.httpAddr + "/assets/missing.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing static file returned %d, want 404", resp.StatusCode)
+	}
+
+	// paths outside the prefix are served by the gateway
+	resp, err = http.Post("http://"+c.httpAddr+"/v1/items", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("gateway route returned %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStaticFilesDirectories(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"docs", "images"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<h1>docs</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "images", "logo.svg"), []byte("<svg/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.StaticFilesDir = dir
+	cfg.StaticFilesPath = "/static/"
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	for _, tt := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{path: "/static/docs/", code: http.StatusOK, body: "<h1>docs</h1>"},
+		{path: "/static/images/logo.svg", code: http.StatusOK, body: "<svg/>"},
+		// directories without an index.html are not listed
+		{path: "/static/images/", code: http.StatusNotFound},
+		{path: "/static/", code: http.StatusNotFound},
+	} {
+		resp, err := http.Get("http://" + c.httpAddr + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code || (tt.body != "" && string(body) != tt.body) {
+			t.Errorf("GET %s returned %d %q, want %d %q", tt.path, resp.StatusCode, body, tt.code, tt.body)
+		}
+		if strings.Contains(string(body), "logo.svg") {
+			t.Errorf("GET %s listed the directory: %q", tt.path, body)
+		}
+	}
+}
+
+func TestStaticFilesAtRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('coldbrew')"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"", "/"} {
+		for _, allow := range []bool{false, true} {
+			t.Run(fmt.Sprintf("path %q allowed %v", path, allow), func(t *testing.T) {
+				cfg := testConfig()
+				cfg.StaticFilesDir = dir
+				cfg.StaticFilesPath = path
+				cfg.StaticFilesAllowRoot = allow
+				c := newTestCB(t, cfg)
+				c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+				runTestServer(t, c)
+
+				resp, err := http.Get("http://" + c.httpAddr + "/app.js")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if served := resp.StatusCode == http.StatusOK; served != allow {
+					t.Errorf("GET /app.js returned %d with StaticFilesAllowRoot %v", resp.StatusCode, allow)
+				}
+				if allow {
+					return
+				}
+				// refusing the root prefix keeps the gateway routes reachable
+				resp, err = http.Post("http://"+c.httpAddr+"/v1/items", "application/json", strings.NewReader("{}"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("gateway route returned %d, want 200", resp.StatusCode)
+				}
+			})
+		}
+	}
+}
+
+func TestGatewayErrorHandler(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		counted float64
+	}{
+		{err: status.Error(codes.DeadlineExceeded, "context deadline exceeded"), code: http.StatusGatewayTimeout, counted: 1},
+		{err: status.Error(codes.NotFound, "no such item"), code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(status.Code(tt.err).String(), func(t *testing.T) {
+			mux := runtime.NewServeMux()
+			r := httptest.NewRequest(http.MethodGet, "/v1/echo", nil)
+			ctx, err := runtime.AnnotateContext(r.Context(), mux, r, echoMethod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := testutil.ToFloat64(gatewayDeadlineExceeded.WithLabelValues(echoMethod))
+			w := httptest.NewRecorder()
+			gatewayErrorHandler(ctx, mux, &runtime.JSONPb{}, w, r, tt.err)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := testutil.ToFloat64(gatewayDeadlineExceeded.WithLabelValues(echoMethod)) - before; got != tt.counted {
+				t.Errorf("counted %v deadline errors, want %v", got, tt.counted)
+			}
+			if tt.counted > 0 && !strings.Contains(w.Body.String(), "upstream call to "+echoMethod+" exceeded its deadline") {
+				t.Errorf("body %q does not name the upstream method", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDisableProtoMarshaller(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		name := map[bool]string{false: "enabled", true: "disabled"}[disabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DisableProtoMarshaller = disabled
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+			runTestServer(t, c)
+
+			for _, contentType := range []string{"application/proto", "application/protobuf"} {
+				resp, err := http.Post("http://"+c.httpAddr+"/v1/items", contentType, strings.NewReader(""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				want := map[bool]string{false: (&runtime.ProtoMarshaller{}).ContentType(nil), true: "application/json"}[disabled]
+				if got := resp.Header.Get("Content-Type"); got != want {
+					t.Errorf("%s request was answered with %q, want %q", contentType, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	protoType := (&runtime.ProtoMarshaller{}).ContentType(nil)
+	tests := []struct {
+		defaultType string
+		sent        string
+		want        string
+	}{
+		{defaultType: "", sent: "", want: "application/json"},
+		{defaultType: "application/proto", sent: "", want: protoType},
+		{defaultType: "application/proto", sent: "application/json", want: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.defaultType+" "+tt.sent, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DefaultContentType = tt.defaultType
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+			runTestServer(t, c)
+
+			req, err := http.NewRequest(http.MethodPost, "http://"+c.httpAddr+"/v1/items", strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.sent != "" {
+				req.Header.Set("Content-Type", tt.sent)
+				req.Header.Set("Accept", tt.sent)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || got != tt.want {
+				t.Errorf("request returned %d with %q, want 200 with %q", resp.StatusCode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetHTTPHandler(t *testing.T) {
+	body := strings.Repeat("coldbrew ", 500)
+	for _, wrap := range []bool{false, true} {
+		name := map[bool]string{false: "plain", true: "wrapped"}[wrap]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.WrapHTTPHandlers = wrap
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+			c.SetHTTPHandler("/livez", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(body))
+			}))
+			runTestServer(t, c)
+
+			req, err := http.NewRequest(http.MethodGet, "http://"+c.httpAddr+"/livez", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// set explicitly so that the transport does not decompress the response
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("custom route returned %d", resp.StatusCode)
+			}
+			if compressed := resp.Header.Get("Content-Encoding") == "gzip"; compressed != wrap {
+				t.Errorf("custom route compressed = %v, want %v", compressed, wrap)
+			}
+
+			// other paths are served by the gateway
+			resp, err = http.Post("http://"+c.httpAddr+"/v1/items", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("gateway route returned %d next to a custom route", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.EnableH2C = enabled
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{initHTTP: forwardRoute("/v1/items")})
+			runTestServer(t, c)
+
+			resp, err := h2cClient.Post("http://"+c.httpAddr+"/v1/items", "application/json", strings.NewReader("{}"))
+			if !enabled {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("HTTP/2 request with prior knowledge succeeded although h2c is disabled")
+				}
+			} else if err != nil {
+				t.Fatalf("HTTP/2 request with prior knowledge failed: %v", err)
+			} else {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+					t.Errorf("h2c request returned %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+				}
+			}
+
+			resp, err = http.Post("http://"+c.httpAddr+"/v1/items", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+				t.Errorf("HTTP/1.1 request returned %d over %s", resp.StatusCode, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestMarshalSpansWithOpenTracing(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			tracer := mocktracer.New()
+			prev := opentracing.GlobalTracer()
+			opentracing.SetGlobalTracer(tracer)
+			t.Cleanup(func() { opentracing.SetGlobalTracer(prev) })
+
+			c := &cb{config: testConfig(), tracing: tracingOpenTracing}
+			var opts []runtime.ServeMuxOption
+			if enabled {
+				opts = append(opts, runtime.WithMiddlewares(c.marshalSpanMiddleware), runtime.WithForwardResponseOption(startMarshalSpan))
+			}
+			mux := runtime.NewServeMux(opts...)
+			if err := echoRoute(context.Background(), mux); err != nil {
+				t.Fatal(err)
+			}
+			root := tracer.StartSpan("ServeHTTP")
+			req := httptest.NewRequest(http.MethodPost, "/v1/echo", strings.NewReader(`{"value":"coldbrew"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req = req.WithContext(opentracing.ContextWithSpan(req.Context(), root))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			root.Finish()
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/v1/echo returned %d", rec.Code)
+			}
+
+			spans := map[string]*mocktracer.MockSpan{}
+			for _, s := range tracer.FinishedSpans() {
+				spans[s.OperationName] = s
+			}
+			if !enabled {
+				if len(spans) != 1 {
+					t.Errorf("recorded spans %v, want only the request span when marshal spans are disabled", spans)
+				}
+				return
+			}
+			unmarshal, marshal := spans["gateway.unmarshal"], spans["gateway.marshal"]
+			if unmarshal == nil || marshal == nil {
+				t.Fatalf("recorded spans %v, want gateway.unmarshal and gateway.marshal", spans)
+			}
+			rootID := root.Context().(mocktracer.MockSpanContext).SpanID
+			if unmarshal.ParentID != rootID || marshal.ParentID != rootID {
+				t.Error("marshal spans are not children of the request span")
+			}
+			if unmarshal.FinishTime.After(marshal.StartTime) {
+				t.Error("gateway.unmarshal span ended after gateway.marshal started")
+			}
+		})
+	}
+}
+
+func TestStrictQueryParser(t *testing.T) {
+	p, filter := &strictQueryParser{}, utilities.NewDoubleArray(nil)
+	for _, tt := range []struct {
+		query string
+		ok    bool
+	}{
+		{query: "name=id&number=1", ok: true},
+		{query: "json_name=id", ok: true},
+		{query: "jsonName=id", ok: true},
+		{query: "options.deprecated=true", ok: true},
+		{query: "extra=1", ok: false},
+		{query: "options.unknown=1", ok: false},
+		{query: "name.nested=1", ok: false},
+	} {
+		values, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &descriptorpb.FieldDescriptorProto{}
+		err = p.Parse(msg, values, filter)
+		if tt.ok && err != nil {
+			t.Errorf("Parse(%q) = %v, want no error", tt.query, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("Parse(%q) did not reject the unknown query parameter", tt.query)
+		}
+	}
+
+	values, _ := url.ParseQuery("name=id&options.deprecated=true")
+	msg := &descriptorpb.FieldDescriptorProto{}
+	if err := p.Parse(msg, values, filter); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetName() != "id" || !msg.GetOptions().GetDeprecated() {
+		t.Errorf("known query parameters were not parsed into the request, got %v", msg)
+	}
+
+	// a repeated message can only be the last element of the path
+	values, _ = url.ParseQuery("field.name=id")
+	if err := p.Parse(&descriptorpb.DescriptorProto{}, values, filter); err == nil {
+		t.Error("Parse accepted a path through a repeated field")
+	}
+}
+
+func TestGenerateRequestIDIfMissing(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		name := map[bool]string{false: "disabled", true: "enabled"}[enabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.TraceHeaderName = "x-request-id"
+			cfg.GenerateRequestIDIfMissing = enabled
+			c := newTestCB(t, cfg)
+			seen := make(chan [2]string, 1)
+			c.SetService(&testService{initHTTP: func(ctx context.Context, mux *runtime.ServeMux) error {
+				return mux.HandlePath(http.MethodGet, "/v1/id", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+					seen <- [2]string{r.Header.Get("x-request-id"), notifier.GetTraceId(r.Context())}
+				})
+			}})
+			runTestServer(t, c)
+
+			get := func(id string) (string, [2]string) {
+				t.Helper()
+				req, err := http.NewRequest(http.MethodGet, "http://"+c.httpAddr+"/v1/id", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id != "" {
+					req.Header.Set("x-request-id", id)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return resp.Header.Get("x-request-id"), <-seen
+			}
+
+			got, handled := get("")
+			if !enabled {
+				if got != "" || handled[0] != "" {
+					t.Fatalf("request id %q generated while disabled, handler saw %q", got, handled[0])
+				}
+				return
+			}
+			if _, err := uuid.Parse(got); err != nil {
+				t.Fatalf("generated request id %q is not a UUID: %v", got, err)
+			}
+			if handled != [2]string{got, got} {
+				t.Errorf("handler saw header and trace id %q, want the generated id %q", handled, got)
+			}
+
+			got, handled = get("client-id")
+			if got != "client-id" || handled != [2]string{"client-id", "client-id"} {
+				t.Errorf("client request id was replaced, response %q, handler saw %q", got, handled)
+			}
+		})
+	}
+}
+
+func TestLogGatewayMarshaler(t *testing.T) {
+	previous := log.GetLogger()
+	t.Cleanup(func() { log.SetLogger(previous) })
+	for _, enabled := range []bool{false, true} {
+		name := map[bool]string{false: "disabled", true: "enabled"}[enabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.LogGatewayMarshaler = enabled
+			c := newTestCB(t, cfg)
+			rec := &levelRecorder{}
+			l := log.NewLogger(rec)
+			l.SetLevel(loggers.DebugLevel)
+			log.SetLogger(l)
+
+			mux := c.newServeMux(runtime.WithMarshalerOption("application/proto", &runtime.ProtoMarshaller{}))
+			if err := forwardRoute("/v1/items")(context.Background(), mux); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/v1/items", strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/proto")
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("request returned %d", rr.Code)
+			}
+
+			kv := rec.find("gateway marshaler selected")
+			if !enabled {
+				if kv != nil {
+					t.Fatalf("marshalers were logged while disabled: %v", kv)
+				}
+				return
+			}
+			if kv == nil {
+				t.Fatal("the selected marshalers were not logged")
+			}
+			want := map[string]interface{}{
+				"path":               "/v1/items",
+				"content_type":       "application/json",
+				"accept":             "application/proto",
+				"inbound_marshaler":  "application/json",
+				"outbound_marshaler": (&runtime.ProtoMarshaller{}).ContentType(nil),
+			}
+			for k, v := range want {
+				if kv[k] != v {
+					t.Errorf("logged %s = %v, want %v", k, kv[k], v)
+				}
+			}
+		})
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/afex/hystrix-go/hystrix"
 	metricCollector "github.com/afex/hystrix-go/hystrix/metric_collector"
+	raven "github.com/getsentry/raven-go"
 	"github.com/go-coldbrew/errors/notifier"
 	"github.com/go-coldbrew/hystrixprometheus"
 	"github.com/go-coldbrew/interceptors"
@@ -24,14 +27,6 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	jaegerconfig "github.com/uber/jaeger-client-go/config"
-	"github.com/uber/jaeger-client-go/zipkin"
-	"go.opentelemetry.io/otel"
-	otelBridge "go.opentelemetry.io/otel/bridge/opentracing"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"go.uber.org/automaxprocs/maxprocs"
 	"google.golang.org/grpc/encoding"
 	"google.golang.org/protobuf/proto"
@@ -63,6 +58,19 @@ func SetupNewRelic(serviceName, apiKey string, tracing bool) error {
 	return nil
 }
 
+// newRelicCloser flushes the data buffered by the New Relic agent when it is closed
+type newRelicCloser struct {
+	timeout time.Duration
+}
+
+// Close shuts the New Relic application down, waiting up to timeout for the buffered data to be sent
+func (n newRelicCloser) Close() error {
+	if app := nrutil.GetNewRelicApp(); app != nil {
+		app.Shutdown(n.timeout)
+	}
+	return nil
+}
+
 // SetupLogger sets up the logger
 // It uses the coldbrew logger to log messages to stdout
 // logLevel is the log level to set for the logger
@@ -82,10 +90,23 @@ func SetupLogger(logLevel string, jsonlogs bool) error {
 // SetupSentry sets up the Sentry notifier
 // It uses the Sentry HTTP Transport to send errors to Sentry server
 // dsn is the Sentry DSN to use for sending errors
+// An invalid DSN is logged and errors are not sent to Sentry
 func SetupSentry(dsn string) {
-	if dsn != "" {
-		notifier.InitSentry(dsn)
+	setupSentry(dsn)
+}
+
+// setupSentry sets up the Sentry notifier like SetupSentry and returns an error when the DSN is invalid
+func setupSentry(dsn string) error {
+	if dsn == "" {
+		return nil
+	}
+	// the notifier reports through the default raven client, setting its DSN validates it
+	if err := raven.SetDSN(dsn); err != nil {
+		log.Error(context.Background(), "msg", "Sentry could not be initialized", "err", err)
+		return err
 	}
+	notifier.InitSentry(dsn)
+	return nil
 }
 
 // SetupEnvironment sets the environment
@@ -108,19 +129,24 @@ func SetupReleaseName(rel string) {
 
 // setupJaeger sets up the Jaeger tracing
 // It uses the Jaeger Zipkin B3 HTTP Propagator to propagate the tracing headers to downstream services
-func setupJaeger(serviceName string) io.Closer {
+// unless other formats are configured with inbound (extraction) and outbound (injection) propagators
+func setupJaeger(serviceName string, inbound, outbound []string) io.Closer {
 	conf, err := jaegerconfig.FromEnv()
 	if err != nil {
 		log.Info(context.Background(), "msg", "could not initialize jaeger", "err", err)
 		return nil
 	}
 	conf.ServiceName = serviceName
-	zipkinPropagator := zipkin.NewZipkinB3HTTPHeaderPropagator()
+	injector, extractor, err := jaegerPropagators(inbound, outbound)
+	if err != nil {
+		log.Info(context.Background(), "msg", "could not initialize jaeger", "err", err)
+		return nil
+	}
 	jaegerTracer, closer, err := conf.NewTracer(
-		jaegerconfig.Injector(opentracing.HTTPHeaders, zipkinPropagator),
-		jaegerconfig.Extractor(opentracing.HTTPHeaders, zipkinPropagator),
+		jaegerconfig.Injector(opentracing.HTTPHeaders, injector),
+		jaegerconfig.Extractor(opentracing.HTTPHeaders, extractor),
 		jaegerconfig.ZipkinSharedRPCSpan(true),
-		jaegerconfig.Metrics(jprom.New()),
+		jaegerconfig.Metrics(jprom.New(jprom.WithRegisterer(collectorRegisterer{}))),
 	)
 	if err != nil {
 		log.Info(context.Background(), "msg", "could not initialize jaeger", "err", err)
@@ -131,7 +157,7 @@ func setupJaeger(serviceName string) io.Closer {
 	return closer
 }
 
-// setupOpenTelemetry sets up the OpenTelemetry tracing
+// SetupNROpenTelemetry sets up the OpenTelemetry tracing
 // It uses the New Relic OTLP exporter to send traces to New Relic One APM and Insights
 // serviceName is the name of the service
 // license is the New Relic license key
@@ -142,62 +168,78 @@ func SetupNROpenTelemetry(serviceName, license, version string, ratio float64) e
 		log.Info(context.Background(), "msg", "not initializing NR opentelemetry tracing")
 		return nil
 	}
-	headers := map[string]string{
-		"api-key": license,
-	}
-
-	clientOpts := []otlptracegrpc.Option{
-		otlptracegrpc.WithEndpoint("otlp.nr-data.net:4317"),
-		otlptracegrpc.WithHeaders(headers),
-		otlptracegrpc.WithCompressor("gzip"),
-	}
-
-	otlpExporter, err := otlptrace.New(context.Background(), otlptracegrpc.NewClient(clientOpts...))
-	if err != nil {
-		log.Error(context.Background(), "msg", "creating OTLP trace exporter", "err", err)
-		return err
-	}
+	return SetupOpenTelemetry(newRelicOTLPConfig(serviceName, license, version, ratio))
+}
 
-	d := resource.Default()
-	res, err := resource.New(context.Background(),
-		resource.WithAttributes(
-			// the service name used to display traces in backends
-			semconv.ServiceNameKey.String(serviceName),
-			semconv.ServiceVersionKey.String(version),
-		),
-	)
-	if err != nil {
-		log.Error(context.Background(), "msg", "creating OTLP resource", "err", err)
-		return err
-	}
-	r, err := resource.Merge(d, res)
-	if err != nil {
-		log.Error(context.Background(), "msg", "merging OTLP resource", "err", err)
-		return err
+// newRelicOTLPConfig returns the OTLP config used to send traces to New Relic
+func newRelicOTLPConfig(serviceName, license, version string, ratio float64) OTLPConfig {
+	return OTLPConfig{
+		Endpoint: "otlp.nr-data.net:4317",
+		Headers: map[string]string{
+			"api-key": license,
+		},
+		ServiceName:        serviceName,
+		ServiceVersion:     version,
+		SamplingRatio:      ratio,
+		Compression:        "gzip",
+		MetricsCompression: "gzip",
 	}
-
-	tracerProvider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))), // sample 20%
-		sdktrace.WithBatcher(otlpExporter),
-		sdktrace.WithResource(r),
-	)
-	otelTracer := tracerProvider.Tracer("")
-	// Use the bridgeTracer as your OpenTracing tracer.
-	bridgeTracer, wrapperTracerProvider := otelBridge.NewTracerPair(otelTracer)
-
-	otel.SetTracerProvider(wrapperTracerProvider)
-	opentracing.SetGlobalTracer(bridgeTracer)
-	log.Info(context.Background(), "msg", "Initialized NR opentelemetry tracing")
-	return nil
 }
 
 // SetupHystrixPrometheus sets up the hystrix metrics
 // This is a workaround for hystrix-go not supporting the prometheus registry
+// the metrics are registered with the registry set by SetPrometheusRegistry, if any
 func SetupHystrixPrometheus() {
-	promC := hystrixprometheus.NewPrometheusCollector("hystrix", nil, prometheus.DefBuckets)
+	promC := hystrixprometheus.NewPrometheusCollector("hystrix", collectorRegisterer{}, prometheus.DefBuckets)
 	metricCollector.Registry.Register(promC.Collector)
 }
 
+// SetupHystrix sets the hystrix circuit breaker settings
+// the non zero fields of defaults replace the hystrix defaults used by every command, including the ones
+// created by the client interceptors which are named after the gRPC method, e.g. /package.Service/Method
+// commands overrides the settings of individual commands, their zero fields use the defaults
+// hystrix keeps its settings in package globals, the defaults apply to every hystrix command of the process, including the ones
+// of other libraries, that is first run after the call, and they are not restored by a later call with zero fields
+func SetupHystrix(defaults hystrix.CommandConfig, commands map[string]hystrix.CommandConfig) {
+	if defaults.Timeout > 0 {
+		hystrix.DefaultTimeout = defaults.Timeout
+	}
+	if defaults.MaxConcurrentRequests > 0 {
+		hystrix.DefaultMaxConcurrent = defaults.MaxConcurrentRequests
+	}
+	if defaults.RequestVolumeThreshold > 0 {
+		hystrix.DefaultVolumeThreshold = defaults.RequestVolumeThreshold
+	}
+	if defaults.SleepWindow > 0 {
+		hystrix.DefaultSleepWindow = defaults.SleepWindow
+	}
+	if defaults.ErrorPercentThreshold > 0 {
+		hystrix.DefaultErrorPercentThreshold = defaults.ErrorPercentThreshold
+	}
+	hystrix.Configure(commands)
+}
+
+// hystrixCommands returns the per command hystrix settings from the per setting maps keyed by command name
+func hystrixCommands(timeouts, maxConcurrent, errorPercent map[string]int) map[string]hystrix.CommandConfig {
+	commands := make(map[string]hystrix.CommandConfig)
+	for name, v := range timeouts {
+		cmd := commands[name]
+		cmd.Timeout = v
+		commands[name] = cmd
+	}
+	for name, v := range maxConcurrent {
+		cmd := commands[name]
+		cmd.MaxConcurrentRequests = v
+		commands[name] = cmd
+	}
+	for name, v := range errorPercent {
+		cmd := commands[name]
+		cmd.ErrorPercentThreshold = v
+		commands[name] = cmd
+	}
+	return commands
+}
+
 // ConfigureInterceptors configures the interceptors package with the provided
 // DoNotLogGRPCReflection is a boolean that indicates whether to log the grpc.reflection.v1alpha.ServerReflection service calls in logs
 // traceHeaderName is the name of the header to use for tracing (e.g. X-Trace-Id) - if empty, defaults to X-Trace-Id
@@ -212,6 +254,7 @@ func ConfigureInterceptors(DoNotLogGRPCReflection bool, traceHeaderName string)
 
 // SetupAutoMaxProcs sets up the GOMAXPROCS to match Linux container CPU quota
 // This is used to set the GOMAXPROCS to the number of CPUs allocated to the container
+// The resulting value is reported by the go_maxprocs gauge
 func SetupAutoMaxProcs() {
 	// Automatically set GOMAXPROCS to match Linux container CPU quota
 	// https://kubernetes.io/docs/tasks/configure-pod-container/assign-cpu-resource/
@@ -222,6 +265,18 @@ func SetupAutoMaxProcs() {
 	if err != nil {
 		log.Error(context.Background(), "msg", "automaxprocs", "err", err)
 	}
+	registerCollector(goMaxProcs)
+}
+
+// SetupMaxProcs sets GOMAXPROCS to the provided value
+// This is used instead of SetupAutoMaxProcs when the container CPU quota detection is not accurate (e.g. fractional CPUs)
+func SetupMaxProcs(n int) {
+	if n <= 0 {
+		return
+	}
+	prev := runtime.GOMAXPROCS(n)
+	log.Info(context.Background(), "msg", "GOMAXPROCS set from config", "value", n, "previous", prev)
+	registerCollector(goMaxProcs)
 }
 
 // startSignalHandler starts a goroutine that listens for SIGTERM and SIGINT
@@ -236,6 +291,11 @@ func signalWatcher(ctx context.Context, c *cb, dur time.Duration) {
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 	log.Info(ctx, "signal watcher started")
 	for sig := range signals {
+		if c.shuttingDown.Load() {
+			// shutdown was already started, e.g. by cancelling the context passed to RunWithContext
+			log.Info(ctx, "signal: shutdown already in progress "+sig.String())
+			break
+		}
 		log.Info(ctx, "signal: shutdown on "+sig.String())
 		err := c.Stop(dur)
 		log.Info(ctx, "signal: shutdown completed "+sig.String(), "err", err)
@@ -247,6 +307,8 @@ func signalWatcher(ctx context.Context, c *cb, dur time.Duration) {
 //
 // https://github.com/planetscale/vtprotobuf?tab=readme-ov-file#mixing-protobuf-implementations-with-grpc
 func InitializeVTProto() {
+	registerCollector(codecMarshalErrors)
+	registerCollector(codecUnmarshalErrors)
 	encoding.RegisterCodec(vtprotoCodec{})
 }
 
@@ -264,6 +326,9 @@ func (vtprotoCodec) Marshal(v any) (data []byte, err error) {
 			err = fmt.Errorf("failed to marshal, err: %v", r)
 			notifier.NotifyOnPanic(err, r)
 		}
+		if err != nil {
+			codecMarshalErrors.Inc()
+		}
 	}()
 	switch v := v.(type) {
 	case vtprotoMessage:
@@ -285,6 +350,9 @@ func (vtprotoCodec) Unmarshal(data []byte, v any) (err error) {
 			err = fmt.Errorf("failed to unmarshal, err: %v", r)
 			notifier.NotifyOnPanic(err, r)
 		}
+		if err != nil {
+			codecUnmarshalErrors.Inc()
+		}
 	}()
 	switch v := v.(type) {
 	case vtprotoMessage:
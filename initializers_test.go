@@ -0,0 +1,183 @@
+package core
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	raven "github.com/getsentry/raven-go"
+	nrutil "github.com/go-coldbrew/tracing/newrelic"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestSetupSentry(t *testing.T) {
+	t.Cleanup(func() { raven.SetDSN("") })
+	if err := setupSentry("not a dsn"); err == nil {
+		t.Fatal("invalid DSN was accepted")
+	}
+	// SetupSentry keeps its signature, an invalid DSN is only logged
+	var setup func(string) = SetupSentry
+	setup("not a dsn")
+	setup("https://public@sentry.example.com/1")
+	if got := raven.DefaultClient.URL(); got != "https://sentry.example.com/api/1/store/" {
+		t.Fatalf("default raven client reports to %q", got)
+	}
+}
+
+func TestRequireSentry(t *testing.T) {
+	t.Cleanup(func() { raven.SetDSN("") })
+	for _, tt := range []struct {
+		dsn     string
+		require bool
+		fails   bool
+	}{
+		{dsn: "not a dsn", require: false, fails: false},
+		{dsn: "not a dsn", require: true, fails: true},
+		{dsn: "", require: true, fails: true},
+		{dsn: "https://public@sentry.example.com/1", require: true, fails: false},
+	} {
+		cfg := testConfig()
+		cfg.SentryDSN = tt.dsn
+		cfg.RequireSentry = tt.require
+		if err := newTestCB(t, cfg).setupErr; (err != nil) != tt.fails {
+			t.Errorf("New with DSN %q and RequireSentry %v failed with %v", tt.dsn, tt.require, err)
+		}
+	}
+}
+
+func TestSetupHystrixTripsBreakerOnConfiguredTimeout(t *testing.T) {
+	timeout, volume, errPercent := hystrix.DefaultTimeout, hystrix.DefaultVolumeThreshold, hystrix.DefaultErrorPercentThreshold
+	t.Cleanup(func() {
+		hystrix.DefaultTimeout, hystrix.DefaultVolumeThreshold, hystrix.DefaultErrorPercentThreshold = timeout, volume, errPercent
+		hystrix.Flush()
+	})
+	SetupHystrix(hystrix.CommandConfig{
+		Timeout:                20,
+		RequestVolumeThreshold: 1,
+		ErrorPercentThreshold:  1,
+	}, map[string]hystrix.CommandConfig{
+		"/test.Service/Slow": {Timeout: 5000},
+	})
+	slow := func(name string) error {
+		return hystrix.Do(name, func() error {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		}, nil)
+	}
+
+	if err := slow("/test.Service/Fast"); !errors.Is(err, hystrix.ErrTimeout) {
+		t.Fatalf("command using the configured default timeout returned %v, want %v", err, hystrix.ErrTimeout)
+	}
+	// the hystrix metrics are collected asynchronously, the breaker opens once they report the timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := hystrix.Do("/test.Service/Fast", func() error { return nil }, nil)
+		if errors.Is(err, hystrix.ErrCircuitOpen) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker did not open after the timeout, last call returned %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := slow("/test.Service/Slow"); err != nil {
+		t.Fatalf("command with an overridden timeout returned %v", err)
+	}
+}
+
+func TestMaxProcsFromConfig(t *testing.T) {
+	previous := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(previous)
+
+	cfg := testConfig()
+	// MaxProcs takes precedence over automaxprocs
+	cfg.DisableAutoMaxProcs = false
+	cfg.MaxProcs = previous + 3
+	newTestCB(t, cfg)
+	if got := runtime.GOMAXPROCS(0); got != cfg.MaxProcs {
+		t.Fatalf("GOMAXPROCS = %d, want the configured %d", got, cfg.MaxProcs)
+	}
+
+	SetupMaxProcs(0)
+	if got := runtime.GOMAXPROCS(0); got != cfg.MaxProcs {
+		t.Fatalf("SetupMaxProcs(0) changed GOMAXPROCS to %d", got)
+	}
+}
+
+// faultyVTMessage is a vtprotoMessage whose marshaling panics and whose unmarshaling fails
+type faultyVTMessage struct{}
+
+func (faultyVTMessage) MarshalVT() ([]byte, error) { panic("boom") }
+func (faultyVTMessage) UnmarshalVT([]byte) error   { return errors.New("invalid wire format") }
+
+func TestVTProtoCodecErrorMetrics(t *testing.T) {
+	codec := vtprotoCodec{}
+	marshalErrors, unmarshalErrors := testutil.ToFloat64(codecMarshalErrors), testutil.ToFloat64(codecUnmarshalErrors)
+
+	data, err := codec.Marshal(wrapperspb.String("coldbrew"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Unmarshal(data, &wrapperspb.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := codec.Marshal(faultyVTMessage{}); err == nil {
+		t.Error("marshaling a message that panics did not fail")
+	}
+	if _, err := codec.Marshal("not a message"); err == nil {
+		t.Error("marshaling a value that is not a message did not fail")
+	}
+	if err := codec.Unmarshal(data, faultyVTMessage{}); err == nil {
+		t.Error("unmarshaling into a message that fails did not fail")
+	}
+
+	if got := testutil.ToFloat64(codecMarshalErrors) - marshalErrors; got != 2 {
+		t.Errorf("grpc_codec_marshal_errors_total increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(codecUnmarshalErrors) - unmarshalErrors; got != 1 {
+		t.Errorf("grpc_codec_unmarshal_errors_total increased by %v, want 1", got)
+	}
+}
+
+func TestNewRelicFlushedOnStop(t *testing.T) {
+	closer := func(c *cb) (newRelicCloser, bool) {
+		for _, cl := range c.closers {
+			if n, ok := cl.(newRelicCloser); ok {
+				return n, true
+			}
+		}
+		return newRelicCloser{}, false
+	}
+	if _, ok := closer(newTestCB(t, testConfig())); ok {
+		t.Error("New Relic closer registered although New Relic is not set up")
+	}
+
+	app, err := newrelic.NewApplication(
+		newrelic.ConfigEnabled(false),
+		newrelic.ConfigAppName("coldbrew-test"),
+		newrelic.ConfigLicense(strings.Repeat("0", 40)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrutil.SetNewRelicApp(app)
+	t.Cleanup(func() { nrutil.SetNewRelicApp(nil) })
+	cfg := testConfig()
+	cfg.NewRelicShutdownTimeoutSeconds = 2
+	n, ok := closer(newTestCB(t, cfg))
+	if !ok {
+		t.Fatal("New Relic closer not registered although New Relic is set up")
+	}
+	if n.timeout != 2*time.Second {
+		t.Errorf("New Relic shutdown timeout = %v, want 2s", n.timeout)
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+}
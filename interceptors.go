@@ -0,0 +1,430 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-coldbrew/errors/notifier"
+	"github.com/go-coldbrew/interceptors"
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type handlerTimingKey struct{}
+
+// handlerTiming holds the time spent in the handler of a call
+type handlerTiming struct {
+	took time.Duration
+}
+
+// interceptorTimingInterceptor is the outermost interceptor, it measures the time spent in the whole chain
+// and reports the time spent in interceptors excluding the handler
+func interceptorTimingInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ht := &handlerTiming{}
+		begin := time.Now()
+		resp, err := handler(context.WithValue(ctx, handlerTimingKey{}, ht), req)
+		grpcInterceptorDuration.WithLabelValues(info.FullMethod).Observe((time.Since(begin) - ht.took).Seconds())
+		return resp, err
+	}
+}
+
+// handlerTimingInterceptor is the innermost interceptor, it measures the time spent in the handler
+func handlerTimingInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		begin := time.Now()
+		resp, err := handler(ctx, req)
+		took := time.Since(begin)
+		if ht, ok := ctx.Value(handlerTimingKey{}).(*handlerTiming); ok {
+			ht.took = took
+		}
+		grpcHandlerDuration.WithLabelValues(info.FullMethod).Observe(took.Seconds())
+		return resp, err
+	}
+}
+
+// interceptorTimingStreamInterceptor is the stream equivalent of interceptorTimingInterceptor
+func interceptorTimingStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ht := &handlerTiming{}
+		begin := time.Now()
+		err := handler(srv, &contextServerStream{
+			ServerStream: stream,
+			ctx:          context.WithValue(stream.Context(), handlerTimingKey{}, ht),
+		})
+		grpcInterceptorDuration.WithLabelValues(info.FullMethod).Observe((time.Since(begin) - ht.took).Seconds())
+		return err
+	}
+}
+
+// handlerTimingStreamInterceptor is the stream equivalent of handlerTimingInterceptor
+func handlerTimingStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		begin := time.Now()
+		err := handler(srv, stream)
+		took := time.Since(begin)
+		if ht, ok := stream.Context().Value(handlerTimingKey{}).(*handlerTiming); ok {
+			ht.took = took
+		}
+		grpcHandlerDuration.WithLabelValues(info.FullMethod).Observe(took.Seconds())
+		return err
+	}
+}
+
+// contextServerStream is a grpc.ServerStream with an overridden context
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// ContextKey is the type of the keys used to store the values configured in ContextValues in the request context
+type ContextKey string
+
+// ContextValue returns the value configured in ContextValues for the key, empty if it is not set
+func ContextValue(ctx context.Context, key string) string {
+	v, _ := ctx.Value(ContextKey(key)).(string)
+	return v
+}
+
+// withContextValues returns a context with all the values stored under their ContextKey
+func withContextValues(ctx context.Context, values map[string]string) context.Context {
+	for k, v := range values {
+		ctx = context.WithValue(ctx, ContextKey(k), v)
+	}
+	return ctx
+}
+
+// contextValuesInterceptor injects static values into the context of every call
+func contextValuesInterceptor(values map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withContextValues(ctx, values), req)
+	}
+}
+
+// contextValuesStreamInterceptor injects static values into the context of every stream
+func contextValuesStreamInterceptor(values map[string]string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextServerStream{
+			ServerStream: stream,
+			ctx:          withContextValues(stream.Context(), values),
+		})
+	}
+}
+
+// gatewayLatencyInterceptor measures the latency of the gRPC calls made by the HTTP gateway
+// so that gateway overhead can be told apart from handler time, calls slower than slowThreshold are logged
+// a zero slowThreshold disables logging
+func gatewayLatencyInterceptor(slowThreshold time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		begin := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		took := time.Since(begin)
+		gatewayUpstreamDuration.WithLabelValues(method).Observe(took.Seconds())
+		if slowThreshold > 0 && took >= slowThreshold {
+			log.Warn(ctx, "msg", "slow gateway upstream call", "grpc_method", method, "duration", took, "err", err)
+		}
+		return err
+	}
+}
+
+// maxDurationInterceptor cancels the context of calls running longer than limit and returns DeadlineExceeded
+// regardless of the deadline set by the client, the handler must honour its context for the limit to take effect
+func maxDurationInterceptor(limit time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		limited, cancel := context.WithTimeout(ctx, limit)
+		defer cancel()
+		resp, err := handler(limited, req)
+		// the deadline of the client is reported as is
+		if err != nil && errors.Is(limited.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			log.Warn(ctx, "msg", "call exceeded the maximum duration", "grpc_method", info.FullMethod, "limit", limit)
+			return resp, status.Errorf(codes.DeadlineExceeded, "call exceeded the maximum duration of %s", limit)
+		}
+		return resp, err
+	}
+}
+
+// maxDurationStreamInterceptor cancels the context of streams running longer than limit and returns DeadlineExceeded
+// the handler must honour the context of the stream for the limit to take effect
+func maxDurationStreamInterceptor(limit time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithTimeout(stream.Context(), limit)
+		defer cancel()
+		err := handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+		// the deadline of the client is reported as is
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && stream.Context().Err() == nil {
+			log.Warn(ctx, "msg", "stream exceeded the maximum duration", "grpc_method", info.FullMethod, "limit", limit)
+			return status.Errorf(codes.DeadlineExceeded, "stream exceeded the maximum duration of %s", limit)
+		}
+		return err
+	}
+}
+
+// defaultTimeoutInterceptor applies timeout to calls without a deadline, calls with a deadline set by the client are left untouched
+// methods excluded by interceptors.FilterMethods (e.g. health checks) are not affected
+func defaultTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := ctx.Deadline(); ok || !interceptors.FilterMethodsFunc(ctx, info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// defaultTimeoutStreamInterceptor is the stream equivalent of defaultTimeoutInterceptor
+func defaultTimeoutStreamInterceptor(timeout time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := stream.Context()
+		if _, ok := ctx.Deadline(); ok || !interceptors.FilterMethodsFunc(ctx, info.FullMethod) {
+			return handler(srv, stream)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// responseCompressionInterceptor compresses responses of at least minBytes with gzip when the client advertises gzip support
+// in grpc-accept-encoding, clients explicitly requesting a compressor are not affected
+func responseCompressionInterceptor(minBytes int) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		if m, ok := resp.(proto.Message); ok && proto.Size(m) >= minBytes && clientSupportsCompressor(ctx, gzip.Name) {
+			// fails if the handler already sent the headers, the response is then sent uncompressed
+			_ = grpc.SetSendCompressor(ctx, gzip.Name)
+		}
+		return resp, err
+	}
+}
+
+// defaultCompressorInterceptor compresses responses with the named compressor when the client advertises support for it
+// handlers can still override the compressor with grpc.SetSendCompressor
+func defaultCompressorInterceptor(name string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if clientSupportsCompressor(ctx, name) {
+			_ = grpc.SetSendCompressor(ctx, name)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// defaultCompressorStreamInterceptor is the stream equivalent of defaultCompressorInterceptor
+func defaultCompressorStreamInterceptor(name string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if ctx := stream.Context(); clientSupportsCompressor(ctx, name) {
+			_ = grpc.SetSendCompressor(ctx, name)
+		}
+		return handler(srv, stream)
+	}
+}
+
+// clientSupportsCompressor reports whether the client advertised the compressor in grpc-accept-encoding
+func clientSupportsCompressor(ctx context.Context, name string) bool {
+	compressors, err := grpc.ClientSupportedCompressors(ctx)
+	if err != nil {
+		return false
+	}
+	for _, c := range compressors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withMetadataLogFields adds the values of the configured incoming metadata keys to the log context
+// values of keys in masked are replaced by a hash
+func withMetadataLogFields(ctx context.Context, keys []string, masked redactKeys) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	for _, k := range keys {
+		values := md.Get(k)
+		if len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ",")
+		if masked.has(k) {
+			value = redactValue(value)
+		}
+		ctx = loggers.AddToLogContext(ctx, "metadata."+strings.ToLower(k), value)
+	}
+	return ctx
+}
+
+// metadataLogKeys returns the metadata keys to log, masked keys are logged as well
+func metadataLogKeys(keys, masked []string) []string {
+	all := make([]string, 0, len(keys)+len(masked))
+	seen := map[string]bool{}
+	for _, k := range append(append([]string{}, keys...), masked...) {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" && !seen[k] {
+			seen[k] = true
+			all = append(all, k)
+		}
+	}
+	return all
+}
+
+// metadataLoggingInterceptor adds the values of the configured metadata keys to the log context of every call
+// it has to run after the logging interceptor so that the fields end up in the request log
+func metadataLoggingInterceptor(keys, masked []string) grpc.UnaryServerInterceptor {
+	all, mk := metadataLogKeys(keys, masked), newRedactKeys(masked)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withMetadataLogFields(ctx, all, mk), req)
+	}
+}
+
+// metadataLoggingStreamInterceptor is the stream equivalent of metadataLoggingInterceptor
+func metadataLoggingStreamInterceptor(keys, masked []string) grpc.StreamServerInterceptor {
+	all, mk := metadataLogKeys(keys, masked), newRedactKeys(masked)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextServerStream{
+			ServerStream: stream,
+			ctx:          withMetadataLogFields(stream.Context(), all, mk),
+		})
+	}
+}
+
+// peerIdentity returns the authenticated identity of the peer of the call, empty when the peer is not authenticated
+// for TLS it is the SPIFFE ID, the common name or the first DNS name of the verified client certificate
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+	switch info := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		if len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+			return ""
+		}
+		cert := info.State.VerifiedChains[0][0]
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				return uri.String()
+			}
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case interface{ PeerServiceAccount() string }:
+		// ALTS
+		return info.PeerServiceAccount()
+	}
+	return ""
+}
+
+// peerIdentityInterceptor adds the authenticated identity of the peer to the log context as peer_identity
+func peerIdentityInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if id := peerIdentity(ctx); id != "" {
+			ctx = loggers.AddToLogContext(ctx, "peer_identity", id)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// peerIdentityStreamInterceptor is the stream equivalent of peerIdentityInterceptor
+func peerIdentityStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id := peerIdentity(stream.Context())
+		if id == "" {
+			return handler(srv, stream)
+		}
+		return handler(srv, &contextServerStream{
+			ServerStream: stream,
+			ctx:          loggers.AddToLogContext(stream.Context(), "peer_identity", id),
+		})
+	}
+}
+
+// setTraceIDHeader sends the trace id of the call to the client in the response header metadata
+func setTraceIDHeader(ctx context.Context, set func(metadata.MD) error) {
+	traceID := notifier.GetTraceId(ctx)
+	if traceID == "" {
+		return
+	}
+	if err := set(metadata.Pairs(notifier.GetTraceHeaderName(), traceID)); err != nil {
+		log.Debug(ctx, "msg", "could not set trace id header", "err", err)
+	}
+}
+
+// traceIDHeaderInterceptor echoes the trace id, received or generated, in the response header metadata
+// it must run after the default interceptors which set the trace id
+func traceIDHeaderInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		setTraceIDHeader(ctx, func(md metadata.MD) error {
+			return grpc.SetHeader(ctx, md)
+		})
+		return handler(ctx, req)
+	}
+}
+
+// traceIDHeaderStreamInterceptor is the stream equivalent of traceIDHeaderInterceptor
+func traceIDHeaderStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		setTraceIDHeader(stream.Context(), stream.SetHeader)
+		return handler(srv, stream)
+	}
+}
+
+// parseMethodLogLevels parses a map of full gRPC method names to log levels, invalid levels are logged and ignored
+func parseMethodLogLevels(levels map[string]string) map[string]loggers.Level {
+	parsed := make(map[string]loggers.Level, len(levels))
+	for method, level := range levels {
+		l, err := loggers.ParseLevel(strings.TrimSpace(level))
+		if err != nil {
+			log.Warn(context.Background(), "msg", "invalid log level for method, ignoring it", "grpc_method", method, "level", level)
+			continue
+		}
+		parsed["/"+strings.TrimPrefix(strings.TrimSpace(method), "/")] = l
+	}
+	return parsed
+}
+
+// methodLogLevelInterceptor overrides the log level of the calls to the configured methods, including the request log
+// it must run after the default interceptors as it updates the options they added to the context
+func methodLogLevelInterceptor(levels map[string]loggers.Level) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if level, ok := levels[info.FullMethod]; ok {
+			ctx = log.OverrideLogLevel(ctx, level)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// methodLogLevelStreamInterceptor is the stream equivalent of methodLogLevelInterceptor
+func methodLogLevelStreamInterceptor(levels map[string]loggers.Level) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		level, ok := levels[info.FullMethod]
+		if !ok {
+			return handler(srv, stream)
+		}
+		return handler(srv, &contextServerStream{
+			ServerStream: stream,
+			ctx:          log.OverrideLogLevel(stream.Context(), level),
+		})
+	}
+}
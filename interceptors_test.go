@@ -0,0 +1,497 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// chainUnary calls handler through interceptors, the first one being the outermost
+func chainUnary(ctx context.Context, method string, handler grpc.UnaryHandler, interceptors ...grpc.UnaryServerInterceptor) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler(ctx, nil)
+}
+
+// histogramSum returns the count and sum of the histogram of vec with labels
+func histogramSum(t *testing.T, vec *prometheus.HistogramVec, labels ...string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues(labels...).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestInterceptorTiming(t *testing.T) {
+	const method = "/coldbrew.test.Timing/Unary"
+	slowInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return handler(ctx, req)
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	}
+	if _, err := chainUnary(context.Background(), method, handler, interceptorTimingInterceptor(), slowInterceptor, handlerTimingInterceptor()); err != nil {
+		t.Fatal(err)
+	}
+
+	count, sum := histogramSum(t, grpcInterceptorDuration, method)
+	if count != 1 || sum < 0.05 || sum >= 0.1 {
+		t.Errorf("interceptor duration observed %d times with %fs, want once with the 50ms spent in interceptors", count, sum)
+	}
+	count, sum = histogramSum(t, grpcHandlerDuration, method)
+	if count != 1 || sum < 0.1 || sum >= 0.15 {
+		t.Errorf("handler duration observed %d times with %fs, want once with the 100ms spent in the handler", count, sum)
+	}
+}
+
+func TestContextValues(t *testing.T) {
+	cfg := testConfig()
+	cfg.ContextValues = map[string]string{"region": "us-east-1", "cluster": "main"}
+	c := newTestCB(t, cfg)
+	srv := runEchoServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String("hello"), &wrapperspb.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := srv.lastContext()
+	for k, v := range cfg.ContextValues {
+		if got := ContextValue(ctx, k); got != v {
+			t.Errorf("ContextValue(%s) = %q, want %q", k, got, v)
+		}
+	}
+	if got := ContextValue(ctx, "missing"); got != "" {
+		t.Errorf("ContextValue of a key that is not configured = %q", got)
+	}
+
+	// streams get the values as well
+	stream := contextValuesStreamInterceptor(cfg.ContextValues)
+	err = stream(nil, &contextServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+		if got := ContextValue(ss.Context(), "region"); got != "us-east-1" {
+			t.Errorf("stream ContextValue(region) = %q", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatewayUpstreamLatency(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		name := map[bool]string{false: "enabled", true: "disabled"}[disabled]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DisableGatewayUpstreamMetrics = disabled
+			c := newTestCB(t, cfg)
+			svc := &dialService{testService: testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+				server.RegisterService(&echoServiceDesc, &echoServer{})
+				return nil
+			}}}
+			c.SetService(svc)
+			runTestServer(t, c)
+			defer svc.conn.Close()
+
+			before, _ := histogramSum(t, gatewayUpstreamDuration, echoMethod)
+			if err := svc.conn.Invoke(context.Background(), echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{}); err != nil {
+				t.Fatal(err)
+			}
+			after, _ := histogramSum(t, gatewayUpstreamDuration, echoMethod)
+			want := map[bool]uint64{false: 1, true: 0}[disabled]
+			if got := after - before; got != want {
+				t.Errorf("gateway upstream latency observed %d times, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxDurationInterceptor(t *testing.T) {
+	const method = "/coldbrew.test.Timing/Unary"
+	errHandler := errors.New("handler failed")
+	waitDone := func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	tests := []struct {
+		name          string
+		clientTimeout time.Duration
+		handler       grpc.UnaryHandler
+		code          codes.Code
+		err           error
+	}{
+		{name: "within the limit", handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		}, code: codes.OK},
+		{name: "handler error within the limit", handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, errHandler
+		}, err: errHandler},
+		{name: "over the limit", handler: waitDone, code: codes.DeadlineExceeded},
+		{name: "client deadline first", clientTimeout: 20 * time.Millisecond, handler: waitDone, err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.clientTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.clientTimeout)
+				defer cancel()
+			}
+			_, err := chainUnary(ctx, method, tt.handler, maxDurationInterceptor(200*time.Millisecond))
+			if tt.err != nil {
+				if err != tt.err {
+					t.Fatalf("returned %v, want the error of the handler %v as is", err, tt.err)
+				}
+				return
+			}
+			if status.Code(err) != tt.code {
+				t.Fatalf("returned %v, want %v", err, tt.code)
+			}
+			if tt.code == codes.DeadlineExceeded && !strings.Contains(err.Error(), "maximum duration") {
+				t.Errorf("error %q does not mention the maximum duration", err)
+			}
+		})
+	}
+}
+
+func TestMaxDurationStreamInterceptor(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/coldbrew.test.Timing/Stream"}
+	errHandler := errors.New("handler failed")
+	waitDone := func(srv interface{}, stream grpc.ServerStream) error {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	tests := []struct {
+		name          string
+		clientTimeout time.Duration
+		handler       grpc.StreamHandler
+		code          codes.Code
+		err           error
+	}{
+		{name: "within the limit", handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return nil
+		}, code: codes.OK},
+		{name: "handler error within the limit", handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return errHandler
+		}, err: errHandler},
+		{name: "over the limit", handler: waitDone, code: codes.DeadlineExceeded},
+		{name: "client deadline first", clientTimeout: 20 * time.Millisecond, handler: waitDone, err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.clientTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.clientTimeout)
+				defer cancel()
+			}
+			err := maxDurationStreamInterceptor(200*time.Millisecond)(nil, &contextServerStream{ctx: ctx}, info, tt.handler)
+			if tt.err != nil {
+				if err != tt.err {
+					t.Fatalf("returned %v, want the error of the handler %v as is", err, tt.err)
+				}
+				return
+			}
+			if status.Code(err) != tt.code {
+				t.Fatalf("returned %v, want %v", err, tt.code)
+			}
+			if tt.code == codes.DeadlineExceeded && !strings.Contains(err.Error(), "maximum duration") {
+				t.Errorf("error %q does not mention the maximum duration", err)
+			}
+		})
+	}
+}
+
+func TestDefaultTimeoutInterceptor(t *testing.T) {
+	const timeout = time.Minute
+	clientDeadline := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		method   string
+		deadline time.Time
+		want     func(deadline time.Time, ok bool) bool
+	}{
+		{name: "no deadline", method: "/coldbrew.test.Timing/Unary", want: func(d time.Time, ok bool) bool {
+			return ok && time.Until(d) > timeout-time.Second && time.Until(d) <= timeout
+		}},
+		{name: "client deadline", method: "/coldbrew.test.Timing/Unary", deadline: clientDeadline, want: func(d time.Time, ok bool) bool {
+			return ok && d.Equal(clientDeadline)
+		}},
+		{name: "filtered method", method: "/coldbrew.test.Probe/HealthCheck", want: func(d time.Time, ok bool) bool {
+			return !ok
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if !tt.deadline.IsZero() {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, tt.deadline)
+				defer cancel()
+			}
+			var deadline time.Time
+			var ok bool
+			_, err := chainUnary(ctx, tt.method, func(ctx context.Context, req interface{}) (interface{}, error) {
+				deadline, ok = ctx.Deadline()
+				return nil, nil
+			}, defaultTimeoutInterceptor(timeout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(deadline, ok) {
+				t.Errorf("unary handler saw deadline %v (set %v)", deadline, ok)
+			}
+
+			stream := &contextServerStream{ctx: ctx}
+			err = defaultTimeoutStreamInterceptor(timeout)(nil, stream, &grpc.StreamServerInfo{FullMethod: tt.method}, func(srv interface{}, stream grpc.ServerStream) error {
+				deadline, ok = stream.Context().Deadline()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(deadline, ok) {
+				t.Errorf("stream handler saw deadline %v (set %v)", deadline, ok)
+			}
+		})
+	}
+}
+
+// payloadRecorder is a client stats.Handler recording the wire and decoded sizes of the last response received
+type payloadRecorder struct {
+	mu       sync.Mutex
+	length   int
+	wireSize int
+}
+
+func (p *payloadRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+func (p *payloadRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+func (p *payloadRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+func (p *payloadRecorder) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if in, ok := s.(*stats.InPayload); ok {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.length, p.wireSize = in.Length, in.CompressedLength
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	cfg := testConfig()
+	cfg.EnableGRPCResponseCompression = true
+	cfg.GRPCResponseCompressionMinBytes = 512
+	c := newTestCB(t, cfg)
+	runEchoServer(t, c)
+	recorder := &payloadRecorder{}
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithStatsHandler(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, size := range []int{64, 4096} {
+		if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String(strings.Repeat("a", size)), &wrapperspb.StringValue{}); err != nil {
+			t.Fatal(err)
+		}
+		recorder.mu.Lock()
+		length, wireSize := recorder.length, recorder.wireSize
+		recorder.mu.Unlock()
+		if compressed := wireSize < length; compressed != (size >= cfg.GRPCResponseCompressionMinBytes) {
+			t.Errorf("response of %d bytes was sent with %d bytes on the wire", length, wireSize)
+		}
+	}
+}
+
+func TestDefaultServerCompressor(t *testing.T) {
+	for _, tt := range []struct {
+		compressor string
+		compressed bool
+	}{
+		{compressor: "", compressed: false},
+		{compressor: "gzip", compressed: true},
+		// unknown compressors are logged and ignored
+		{compressor: "coldbrew-unknown", compressed: false},
+	} {
+		t.Run(tt.compressor, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DefaultServerCompressor = tt.compressor
+			c := newTestCB(t, cfg)
+			runEchoServer(t, c)
+			recorder := &payloadRecorder{}
+			conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithStatsHandler(recorder))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String(strings.Repeat("a", 4096)), &wrapperspb.StringValue{}); err != nil {
+				t.Fatal(err)
+			}
+			recorder.mu.Lock()
+			length, wireSize := recorder.length, recorder.wireSize
+			recorder.mu.Unlock()
+			if compressed := wireSize < length; compressed != tt.compressed {
+				t.Errorf("response of %d bytes was sent with %d bytes on the wire, want compressed %v", length, wireSize, tt.compressed)
+			}
+		})
+	}
+}
+
+func TestMetadataLogging(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-client-id", "mobile",
+		"authorization", "Bearer secret",
+		"x-tenant", "a",
+		"x-tenant", "b",
+		"x-not-logged", "value",
+	))
+	want := map[string]string{
+		"metadata.x-client-id":   "mobile",
+		"metadata.authorization": redactValue("Bearer secret"),
+		"metadata.x-tenant":      "a,b",
+	}
+	check := func(ctx context.Context) {
+		t.Helper()
+		got := map[string]string{}
+		if fields := loggers.FromContext(ctx); fields != nil {
+			fields.Range(func(k, v interface{}) bool {
+				got[k.(string)] = v.(string)
+				return true
+			})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("log context = %v, want %v", got, want)
+		}
+	}
+	keys, masked := []string{"X-Client-ID", "x-tenant", "x-missing"}, []string{"Authorization"}
+
+	_, err := chainUnary(ctx, echoMethod, func(ctx context.Context, req interface{}) (interface{}, error) {
+		check(ctx)
+		return nil, nil
+	}, metadataLoggingInterceptor(keys, masked))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := metadataLoggingStreamInterceptor(keys, masked)
+	err = stream(nil, &contextServerStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+		check(ss.Context())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEchoTraceIDInResponse(t *testing.T) {
+	cfg := testConfig()
+	cfg.EchoTraceIDInResponse = true
+	cfg.TraceHeaderName = "x-request-trace"
+	c := newTestCB(t, cfg)
+	runEchoServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(ctx context.Context) string {
+		t.Helper()
+		var header metadata.MD
+		if err := conn.Invoke(ctx, echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{}, grpc.Header(&header)); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(header.Get(cfg.TraceHeaderName), ",")
+	}
+
+	if got := call(metadata.AppendToOutgoingContext(context.Background(), cfg.TraceHeaderName, "trace-from-client")); got != "trace-from-client" {
+		t.Errorf("%s response header = %q, want the trace id sent by the client", cfg.TraceHeaderName, got)
+	}
+	if got := call(context.Background()); got == "" {
+		t.Errorf("%s response header is missing for a call without a trace id, want the generated one", cfg.TraceHeaderName)
+	}
+}
+
+func TestMethodLogLevels(t *testing.T) {
+	levels := parseMethodLogLevels(map[string]string{
+		"coldbrew.test.Echo/Echo":   "error",
+		" /coldbrew.test.Echo/Get ": " debug ",
+		"/coldbrew.test.Echo/Loud":  "loudest",
+	})
+	want := map[string]loggers.Level{
+		"/coldbrew.test.Echo/Echo": loggers.ErrorLevel,
+		"/coldbrew.test.Echo/Get":  loggers.DebugLevel,
+	}
+	if len(levels) != len(want) {
+		t.Errorf("parsed levels %v, want %v", levels, want)
+	}
+	for method, level := range want {
+		if levels[method] != level {
+			t.Errorf("level of %s = %v, want %v", method, levels[method], level)
+		}
+	}
+
+	for _, tt := range []struct {
+		method string
+		level  loggers.Level
+		ok     bool
+	}{
+		{method: "/coldbrew.test.Echo/Echo", level: loggers.ErrorLevel, ok: true},
+		{method: "/coldbrew.test.Echo/Other"},
+	} {
+		var level loggers.Level
+		var ok bool
+		_, err := chainUnary(context.Background(), tt.method, func(ctx context.Context, req interface{}) (interface{}, error) {
+			level, ok = log.GetOverridenLogLevel(ctx)
+			return nil, nil
+		}, methodLogLevelInterceptor(levels))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok || level != tt.level {
+			t.Errorf("unary handler of %s saw level %v (overridden %v), want %v (%v)", tt.method, level, ok, tt.level, tt.ok)
+		}
+
+		stream := &contextServerStream{ctx: context.Background()}
+		err = methodLogLevelStreamInterceptor(levels)(nil, stream, &grpc.StreamServerInfo{FullMethod: tt.method}, func(srv interface{}, stream grpc.ServerStream) error {
+			level, ok = log.GetOverridenLogLevel(stream.Context())
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok || level != tt.level {
+			t.Errorf("stream handler of %s saw level %v (overridden %v), want %v (%v)", tt.method, level, ok, tt.level, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimitedListener is a net.Listener that accepts at most rate new connections per second
+// with bursts of up to rate connections, connections above the rate wait in the listen backlog
+type rateLimitedListener struct {
+	net.Listener
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimitedListener wraps the listener to accept at most rate new connections per second
+func newRateLimitedListener(l net.Listener, rate int) net.Listener {
+	if rate <= 0 {
+		return l
+	}
+	return &rateLimitedListener{
+		Listener: l,
+		rate:     float64(rate),
+		tokens:   float64(rate),
+		last:     time.Now(),
+	}
+}
+
+// Accept waits for the rate limit to allow a new connection and accepts it
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	l.wait()
+	return l.Listener.Accept()
+}
+
+// wait blocks until a token is available and consumes it
+func (l *rateLimitedListener) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		time.Sleep(d)
+		l.tokens = 1
+		l.last = time.Now()
+	}
+	l.tokens--
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if newRateLimitedListener(lis, 0) != lis {
+		t.Fatal("a rate of zero must not limit the listener")
+	}
+
+	const rate = 20
+	limited := newRateLimitedListener(lis, rate)
+	// connections wait in the backlog until they are accepted
+	for i := 0; i < 2*rate; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	accept := func(n int) time.Duration {
+		t.Helper()
+		begin := time.Now()
+		for i := 0; i < n; i++ {
+			conn, err := limited.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+		return time.Since(begin)
+	}
+	if took := accept(rate); took > 200*time.Millisecond {
+		t.Fatalf("accepting a burst of %d connections took %v", rate, took)
+	}
+	// the burst used up the tokens, the next connections are accepted at the rate
+	if took := accept(rate / 2); took < 400*time.Millisecond {
+		t.Fatalf("accepted %d connections over the burst in %v, want about %v", rate/2, took, time.Second/2)
+	}
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	kitlog "github.com/go-kit/log"
+	"github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// LogFormatJSON is the default coldbrew log format
+	LogFormatJSON = "json"
+	// LogFormatGCP is a JSON log format understood by GCP Cloud Logging (Stackdriver)
+	LogFormatGCP = "gcp"
+)
+
+// gcpTraceKey is the field used by Cloud Logging to correlate logs with traces
+const gcpTraceKey = "logging.googleapis.com/trace"
+
+// gcpLogger is a BaseLogger emitting JSON logs with the field names and severities expected by GCP Cloud Logging
+// https://cloud.google.com/logging/docs/structured-logging
+type gcpLogger struct {
+	logger    kitlog.Logger
+	level     loggers.Level
+	projectID string
+}
+
+// newGCPLogger returns a BaseLogger writing GCP structured logs to stdout
+// projectID is used to build the trace field, the trace field is omitted when it is empty
+func newGCPLogger(projectID string) loggers.BaseLogger {
+	l := kitlog.NewJSONLogger(kitlog.NewSyncWriter(os.Stdout))
+	return &gcpLogger{
+		logger:    kitlog.With(l, "time", kitlog.DefaultTimestampUTC),
+		level:     loggers.InfoLevel,
+		projectID: projectID,
+	}
+}
+
+// gcpSeverity maps a coldbrew level to a Cloud Logging severity
+func gcpSeverity(level loggers.Level) string {
+	switch level {
+	case loggers.DebugLevel:
+		return "DEBUG"
+	case loggers.InfoLevel:
+		return "INFO"
+	case loggers.WarnLevel:
+		return "WARNING"
+	case loggers.ErrorLevel:
+		return "ERROR"
+	}
+	return "DEFAULT"
+}
+
+func (l *gcpLogger) Log(ctx context.Context, level loggers.Level, skip int, args ...interface{}) {
+	function, file, line := loggers.FetchCallerInfo(skip+1, 2)
+	lgr := kitlog.With(l.logger,
+		"severity", gcpSeverity(level),
+		"logging.googleapis.com/sourceLocation", map[string]interface{}{"file": file, "line": line, "function": function},
+	)
+	if traceID := traceIDFromContext(ctx); traceID != "" && l.projectID != "" {
+		lgr = kitlog.With(lgr, gcpTraceKey, fmt.Sprintf("projects/%s/traces/%s", l.projectID, traceID))
+	}
+	if ctxFields := loggers.FromContext(ctx); ctxFields != nil {
+		ctxFields.Range(func(k, v interface{}) bool {
+			lgr = kitlog.With(lgr, k, v)
+			return true
+		})
+	}
+	if len(args) == 1 {
+		lgr.Log("message", args[0])
+		return
+	}
+	// Cloud Logging shows the message field as the summary of the entry
+	kv := make([]interface{}, len(args))
+	copy(kv, args)
+	for i := 0; i < len(kv); i += 2 {
+		if kv[i] == "msg" {
+			kv[i] = "message"
+		}
+	}
+	lgr.Log(kv...)
+}
+
+func (l *gcpLogger) SetLevel(level loggers.Level) {
+	l.level = level
+}
+
+func (l *gcpLogger) GetLevel() loggers.Level {
+	return l.level
+}
+
+// traceIDFromContext returns the hex encoded trace id of the span in the context, empty if there is none
+func traceIDFromContext(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if sc, ok := span.Context().(jaeger.SpanContext); ok && sc.TraceID().IsValid() {
+			tid := sc.TraceID()
+			return fmt.Sprintf("%016x%016x", tid.High, tid.Low)
+		}
+	}
+	return ""
+}
+
+// otelLogger is a coldbrew logger that also emits every log it writes as an OpenTelemetry log record
+type otelLogger struct {
+	log.Logger
+	otel otellog.Logger
+}
+
+// newOTelLogger returns a logger writing to next and emitting to otel
+func newOTelLogger(next log.Logger, otel otellog.Logger) log.Logger {
+	return &otelLogger{Logger: next, otel: otel}
+}
+
+func (l *otelLogger) Debug(ctx context.Context, args ...interface{}) {
+	l.Log(ctx, loggers.DebugLevel, 1, args...)
+}
+
+func (l *otelLogger) Info(ctx context.Context, args ...interface{}) {
+	l.Log(ctx, loggers.InfoLevel, 1, args...)
+}
+
+func (l *otelLogger) Warn(ctx context.Context, args ...interface{}) {
+	l.Log(ctx, loggers.WarnLevel, 1, args...)
+}
+
+func (l *otelLogger) Error(ctx context.Context, args ...interface{}) {
+	l.Log(ctx, loggers.ErrorLevel, 1, args...)
+}
+
+func (l *otelLogger) Log(ctx context.Context, level loggers.Level, skip int, args ...interface{}) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	logLevel := l.GetLevel()
+	if overridden, found := log.GetOverridenLogLevel(ctx); found {
+		logLevel = overridden
+	}
+	if logLevel >= level {
+		l.emit(ctx, level, args)
+	}
+	l.Logger.Log(ctx, level, skip+1, args...)
+}
+
+// emit sends the log as a record, the msg value is the body and the other key values and log context fields are attributes
+// the sdk adds the trace and span ids of the span in ctx
+func (l *otelLogger) emit(ctx context.Context, level loggers.Level, args []interface{}) {
+	var r otellog.Record
+	r.SetTimestamp(time.Now())
+	r.SetSeverity(otelSeverity(level))
+	r.SetSeverityText(level.String())
+	if len(args) == 1 {
+		r.SetBody(otellog.StringValue(fmt.Sprint(args[0])))
+	} else {
+		for i := 0; i+1 < len(args); i += 2 {
+			key := fmt.Sprint(args[i])
+			if key == "msg" {
+				r.SetBody(otellog.StringValue(fmt.Sprint(args[i+1])))
+				continue
+			}
+			r.AddAttributes(otellog.KeyValue{Key: key, Value: otelLogValue(args[i+1])})
+		}
+	}
+	if ctxFields := loggers.FromContext(ctx); ctxFields != nil {
+		ctxFields.Range(func(k, v interface{}) bool {
+			r.AddAttributes(otellog.KeyValue{Key: fmt.Sprint(k), Value: otelLogValue(v)})
+			return true
+		})
+	}
+	l.otel.Emit(ctx, r)
+}
+
+// otelSeverity maps a coldbrew level to an OpenTelemetry severity
+func otelSeverity(level loggers.Level) otellog.Severity {
+	switch level {
+	case loggers.DebugLevel:
+		return otellog.SeverityDebug
+	case loggers.InfoLevel:
+		return otellog.SeverityInfo
+	case loggers.WarnLevel:
+		return otellog.SeverityWarn
+	case loggers.ErrorLevel:
+		return otellog.SeverityError
+	}
+	return otellog.SeverityUndefined
+}
+
+// otelLogValue converts a log value to an OpenTelemetry value, values of other types are formatted as strings
+func otelLogValue(v interface{}) otellog.Value {
+	switch v := v.(type) {
+	case string:
+		return otellog.StringValue(v)
+	case bool:
+		return otellog.BoolValue(v)
+	case int:
+		return otellog.IntValue(v)
+	case int64:
+		return otellog.Int64Value(v)
+	case float64:
+		return otellog.Float64Value(v)
+	case error:
+		return otellog.StringValue(v.Error())
+	}
+	return otellog.StringValue(fmt.Sprint(v))
+}
+
+// SetupGCPLogger sets up a logger emitting structured logs for GCP Cloud Logging
+// logLevel is the level to log at, projectID is the GCP project used to link logs to Cloud Trace
+func SetupGCPLogger(logLevel, projectID string) error {
+	log.SetLogger(log.NewLogger(newGCPLogger(projectID)))
+
+	ll, err := loggers.ParseLevel(logLevel)
+	if err != nil {
+		log.Error(context.Background(), "err", "could not set log level", "level", logLevel)
+		return err
+	}
+	log.SetLevel(ll)
+	return nil
+}
+
+// setupLogger sets up the logger for the configured format
+func setupLogger(format, logLevel string, jsonlogs bool, projectID string) error {
+	switch strings.ToLower(format) {
+	case LogFormatGCP:
+		return SetupGCPLogger(logLevel, projectID)
+	case "", LogFormatJSON:
+		return SetupLogger(logLevel, jsonlogs)
+	}
+	err := SetupLogger(logLevel, jsonlogs)
+	log.Warn(context.Background(), "msg", "unknown log format, using the default format", "format", format)
+	return err
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	kitlog "github.com/go-kit/log"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestGCPLogger(t *testing.T) {
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	spanCtx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  trace.SpanID{0, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	}))
+	tests := []struct {
+		name      string
+		projectID string
+		ctx       context.Context
+		args      []interface{}
+		want      map[string]interface{}
+		wantTrace string
+	}{
+		{
+			name:      "key values with trace",
+			projectID: "coldbrew",
+			ctx:       loggers.AddToLogContext(spanCtx, "request_id", "abc"),
+			args:      []interface{}{"msg", "slow call", "grpc_method", "/Echo"},
+			want:      map[string]interface{}{"severity": "WARNING", "message": "slow call", "grpc_method": "/Echo", "request_id": "abc"},
+			wantTrace: "projects/coldbrew/traces/" + traceID.String(),
+		},
+		{
+			name: "single value without project",
+			ctx:  spanCtx,
+			args: []interface{}{"started"},
+			want: map[string]interface{}{"severity": "WARNING", "message": "started"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &gcpLogger{logger: kitlog.NewJSONLogger(&buf), level: loggers.InfoLevel, projectID: tt.projectID}
+			l.Log(tt.ctx, loggers.WarnLevel, 0, tt.args...)
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("log entry %q is not JSON: %v", buf.String(), err)
+			}
+			for k, v := range tt.want {
+				if entry[k] != v {
+					t.Errorf("%s = %v, want %v", k, entry[k], v)
+				}
+			}
+			if _, ok := entry["msg"]; ok {
+				t.Error("msg was not renamed to message")
+			}
+			if got, _ := entry[gcpTraceKey].(string); got != tt.wantTrace {
+				t.Errorf("%s = %q, want %q", gcpTraceKey, got, tt.wantTrace)
+			}
+			if _, ok := entry["logging.googleapis.com/sourceLocation"].(map[string]interface{}); !ok {
+				t.Errorf("entry %v has no source location", entry)
+			}
+		})
+	}
+}
+
+func TestGCPSeverity(t *testing.T) {
+	for level, want := range map[loggers.Level]string{
+		loggers.DebugLevel: "DEBUG",
+		loggers.InfoLevel:  "INFO",
+		loggers.WarnLevel:  "WARNING",
+		loggers.ErrorLevel: "ERROR",
+	} {
+		if got := gcpSeverity(level); got != want {
+			t.Errorf("gcpSeverity(%v) = %q, want %q", level, got, want)
+		}
+	}
+}
+
+// recordingLogProcessor keeps the OpenTelemetry log records emitted
+type recordingLogProcessor struct {
+	records []sdklog.Record
+}
+
+func (p *recordingLogProcessor) OnEmit(_ context.Context, r *sdklog.Record) error {
+	p.records = append(p.records, r.Clone())
+	return nil
+}
+func (p *recordingLogProcessor) Shutdown(context.Context) error   { return nil }
+func (p *recordingLogProcessor) ForceFlush(context.Context) error { return nil }
+
+func TestOTelLogger(t *testing.T) {
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{0, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	ctx = loggers.AddToLogContext(ctx, "request_id", "abc")
+	var buf bytes.Buffer
+	processor := &recordingLogProcessor{}
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(processor))
+	l := newOTelLogger(log.NewLogger(&gcpLogger{logger: kitlog.NewJSONLogger(&buf), level: loggers.InfoLevel}), provider.Logger("coldbrew-test"))
+
+	l.Warn(ctx, "msg", "slow call", "grpc_method", "/Echo", "attempt", 2)
+	l.Debug(ctx, "msg", "below the level")
+	l.Debug(log.OverrideLogLevel(ctx, loggers.DebugLevel), "overridden level")
+
+	if !strings.Contains(buf.String(), "slow call") || strings.Contains(buf.String(), "below the level") {
+		t.Errorf("logs written by the wrapped logger: %s", buf.String())
+	}
+	if len(processor.records) != 2 {
+		t.Fatalf("emitted %d records, want the warning and the debug log with an overridden level", len(processor.records))
+	}
+	r := processor.records[0]
+	if r.Body().AsString() != "slow call" || r.Severity() != otellog.SeverityWarn || r.SeverityText() != "warning" {
+		t.Errorf("record body %q severity %v %q, want the msg as body at warning", r.Body().AsString(), r.Severity(), r.SeverityText())
+	}
+	if r.TraceID() != traceID {
+		t.Errorf("record trace id = %s, want the trace of the context", r.TraceID())
+	}
+	attrs := map[string]otellog.Value{}
+	r.WalkAttributes(func(kv otellog.KeyValue) bool {
+		attrs[kv.Key] = kv.Value
+		return true
+	})
+	if attrs["grpc_method"].AsString() != "/Echo" || attrs["attempt"].AsInt64() != 2 || attrs["request_id"].AsString() != "abc" {
+		t.Errorf("record attributes = %v, want the key values and the log context fields", attrs)
+	}
+	if _, ok := attrs["msg"]; ok {
+		t.Error("msg was added as an attribute, it is the body")
+	}
+	if r := processor.records[1]; r.Body().AsString() != "overridden level" || r.Severity() != otellog.SeverityDebug {
+		t.Errorf("record body %q severity %v, want the single value as body at debug", r.Body().AsString(), r.Severity())
+	}
+}
@@ -0,0 +1,349 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	goruntime "runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// grpcInterceptorDuration measures the time spent in the interceptor chain excluding the handler
+	grpcInterceptorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_interceptor_duration_seconds",
+		Help:    "Time spent in gRPC server interceptors excluding the handler",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_method"})
+
+	// grpcHandlerDuration measures the time spent in the handler
+	grpcHandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_handler_duration_seconds",
+		Help:    "Time spent in gRPC server handlers",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_method"})
+
+	// gatewayUpstreamDuration measures the latency of the calls made by the HTTP gateway to the gRPC server
+	gatewayUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_gateway_upstream_duration_seconds",
+		Help:    "Latency of the gRPC calls made by the HTTP gateway",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_method"})
+
+	// grpcHandledByClass counts completed gRPC calls by a simplified classification of their status code
+	grpcHandledByClass = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_by_class_total",
+		Help: "Total number of gRPC calls completed on the server by status class (ok, client_error, server_error)",
+	}, []string{"grpc_method", "class"})
+
+	// codecMarshalErrors counts the messages the vtproto codec failed to marshal, including recovered panics
+	codecMarshalErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "grpc_codec_marshal_errors_total",
+		Help: "Total number of gRPC messages that could not be marshaled by the codec",
+	})
+
+	// codecUnmarshalErrors counts the messages the vtproto codec failed to unmarshal, including recovered panics
+	codecUnmarshalErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "grpc_codec_unmarshal_errors_total",
+		Help: "Total number of gRPC messages that could not be unmarshaled by the codec",
+	})
+
+	// grpcServerConnections is the number of open connections to the gRPC server
+	grpcServerConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_server_connections",
+		Help: "Number of currently open connections to the gRPC server",
+	})
+
+	// shutdownDuration measures the time spent in Stop, including the healthcheck wait, the drain and stopping the services
+	shutdownDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "coldbrew_shutdown_duration_seconds",
+		Help:    "Time spent gracefully shutting down the server",
+		Buckets: shutdownBuckets,
+	})
+
+	// shutdownDrainDuration measures the time spent draining the HTTP and gRPC servers during shutdown
+	shutdownDrainDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "coldbrew_shutdown_drain_duration_seconds",
+		Help:    "Time spent draining the HTTP and gRPC servers during a graceful shutdown",
+		Buckets: shutdownBuckets,
+	})
+
+	// shutdownInFlightRequests is the number of gRPC calls in progress when the last graceful shutdown started
+	shutdownInFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "coldbrew_shutdown_in_flight_requests",
+		Help: "Number of gRPC calls in progress when the last graceful shutdown started",
+	})
+
+	// goMaxProcs reports the current GOMAXPROCS value, it is evaluated on every scrape so that it reflects changes
+	goMaxProcs = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "go_maxprocs",
+		Help: "Current value of GOMAXPROCS",
+	}, func() float64 {
+		return float64(goruntime.GOMAXPROCS(0))
+	})
+)
+
+var (
+	// metricsRegistry is the registry set by SetPrometheusRegistry, nil when the default prometheus registry is used
+	metricsRegistry *prometheus.Registry
+	// collectors are the collectors registered by registerCollector, they are registered again when the registry changes
+	collectors   []prometheus.Collector
+	collectorsMu sync.Mutex
+)
+
+// SetPrometheusRegistry sets the prometheus registry coldbrew registers its metrics with and serves on /metrics
+// nil restores the default prometheus registry, the metrics already registered by coldbrew are registered with the new registry
+// so that it can be called after New, the /metrics endpoint serves the registry set when the HTTP server is initialized by Run
+// the registry is used as is, add collectors like collectors.NewGoCollector to it to expose them
+func SetPrometheusRegistry(reg *prometheus.Registry) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	metricsRegistry = reg
+	for _, c := range collectors {
+		register(c)
+	}
+}
+
+// prometheusRegistry returns the registry set by SetPrometheusRegistry, nil when the default prometheus registry is used
+func prometheusRegistry() *prometheus.Registry {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	return metricsRegistry
+}
+
+// prometheusRegisterer returns the registerer metrics are registered with, collectorsMu must be held
+func prometheusRegisterer() prometheus.Registerer {
+	if metricsRegistry != nil {
+		return metricsRegistry
+	}
+	return prometheus.DefaultRegisterer
+}
+
+// registerCollector registers the collector with the prometheus registry
+// collectors that are already registered are ignored so that it is safe to call this more than once
+func registerCollector(c prometheus.Collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	known := false
+	for _, k := range collectors {
+		if k == c {
+			known = true
+			break
+		}
+	}
+	if !known {
+		collectors = append(collectors, c)
+	}
+	register(c)
+}
+
+// register registers the collector with the current registry, collectorsMu must be held
+func register(c prometheus.Collector) {
+	if err := prometheusRegisterer().Register(c); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			log.Error(context.Background(), "msg", "could not register prometheus collector", "err", err)
+		}
+	}
+}
+
+// setupInterceptorMetrics registers the interceptor and handler duration metrics
+func setupInterceptorMetrics() {
+	registerCollector(grpcInterceptorDuration)
+	registerCollector(grpcHandlerDuration)
+}
+
+// shutdownBuckets are the histogram buckets of the shutdown durations, shutdowns take seconds rather than milliseconds
+var shutdownBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90, 120}
+
+// setupShutdownMetrics registers the graceful shutdown metrics
+func setupShutdownMetrics() {
+	registerCollector(shutdownDuration)
+	registerCollector(shutdownDrainDuration)
+	registerCollector(shutdownInFlightRequests)
+}
+
+// observeShutdown records the report of a completed graceful shutdown
+func observeShutdown(r ShutdownReport) {
+	shutdownDuration.Observe(r.Duration.Seconds())
+	shutdownDrainDuration.Observe(r.DrainDuration.Seconds())
+	shutdownInFlightRequests.Set(float64(r.InFlightAtStart))
+}
+
+// labeledMetrics records gRPC request counts and latencies with extra labels taken from the request metadata
+type labeledMetrics struct {
+	// labels are the extra label names and metadataKeys the metadata keys their values are read from
+	labels       []string
+	metadataKeys []string
+	handled      *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+}
+
+// labelNamePattern matches the valid prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateMetricsLabels returns an error when labels, a map of label name to metadata key, can not be added to the labeled metrics
+func validateMetricsLabels(labels map[string]string) error {
+	for label, key := range labels {
+		switch {
+		case !labelNamePattern.MatchString(label) || strings.HasPrefix(label, "__"):
+			return fmt.Errorf("invalid metrics label name %q", label)
+		case label == "grpc_method" || label == "grpc_code":
+			return fmt.Errorf("metrics label %q is already used by the labeled metrics", label)
+		case key == "":
+			return fmt.Errorf("metrics label %q has no metadata key", label)
+		}
+	}
+	return nil
+}
+
+// newLabeledMetrics creates and registers the metrics for labels, a map of label name to metadata key
+func newLabeledMetrics(labels map[string]string) *labeledMetrics {
+	m := &labeledMetrics{}
+	for label := range labels {
+		m.labels = append(m.labels, label)
+	}
+	sort.Strings(m.labels)
+	for _, label := range m.labels {
+		m.metadataKeys = append(m.metadataKeys, strings.ToLower(labels[label]))
+	}
+	names := append([]string{"grpc_method", "grpc_code"}, m.labels...)
+	m.handled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_labeled_handled_total",
+		Help: "Total number of gRPC calls completed on the server with the labels configured in MetricsLabelsFromMetadata",
+	}, names)
+	m.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_labeled_handling_seconds",
+		Help:    "Latency of gRPC calls on the server with the labels configured in MetricsLabelsFromMetadata",
+		Buckets: prometheus.DefBuckets,
+	}, names)
+	registerCollector(m.handled)
+	registerCollector(m.duration)
+	return m
+}
+
+// observe records a completed call
+func (m *labeledMetrics) observe(ctx context.Context, method string, err error, took time.Duration) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := make([]string, 0, 2+len(m.labels))
+	values = append(values, method, status.Code(err).String())
+	for _, key := range m.metadataKeys {
+		v := ""
+		if vs := md.Get(key); len(vs) > 0 {
+			v = vs[0]
+		}
+		values = append(values, v)
+	}
+	m.handled.WithLabelValues(values...).Inc()
+	m.duration.WithLabelValues(values...).Observe(took.Seconds())
+}
+
+func (m *labeledMetrics) interceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		begin := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(ctx, info.FullMethod, err, time.Since(begin))
+		return resp, err
+	}
+}
+
+func (m *labeledMetrics) streamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		begin := time.Now()
+		err := handler(srv, stream)
+		m.observe(stream.Context(), info.FullMethod, err, time.Since(begin))
+		return err
+	}
+}
+
+// statusClass classifies a status code as ok, client_error or server_error
+// following the HTTP status the gateway maps the code to, e.g. FailedPrecondition (400) is a client error
+func statusClass(code codes.Code) string {
+	switch {
+	case code == codes.OK:
+		return "ok"
+	case runtime.HTTPStatusFromCode(code) < 500:
+		return "client_error"
+	}
+	return "server_error"
+}
+
+// statusClassInterceptor counts completed calls in grpc_server_handled_by_class_total
+func statusClassInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		grpcHandledByClass.WithLabelValues(info.FullMethod, statusClass(status.Code(err))).Inc()
+		return resp, err
+	}
+}
+
+// statusClassStreamInterceptor is the stream equivalent of statusClassInterceptor
+func statusClassStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, stream)
+		grpcHandledByClass.WithLabelValues(info.FullMethod, statusClass(status.Code(err))).Inc()
+		return err
+	}
+}
+
+// collectorRegisterer is a prometheus.Registerer that registers with registerCollector
+// so that registering the same collectors more than once does not panic
+type collectorRegisterer struct{}
+
+func (collectorRegisterer) Register(c prometheus.Collector) error {
+	registerCollector(c)
+	return nil
+}
+
+func (collectorRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		registerCollector(c)
+	}
+}
+
+func (collectorRegisterer) Unregister(c prometheus.Collector) bool {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	for i, k := range collectors {
+		if k == c {
+			collectors = append(collectors[:i], collectors[i+1:]...)
+			break
+		}
+	}
+	return prometheusRegisterer().Unregister(c)
+}
+
+// connectionStatsHandler is a grpc stats.Handler tracking the open connections in grpc_server_connections
+type connectionStatsHandler struct{}
+
+func (connectionStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (connectionStatsHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (connectionStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (connectionStatsHandler) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		grpcServerConnections.Inc()
+	case *stats.ConnEnd:
+		grpcServerConnections.Dec()
+	}
+}
@@ -0,0 +1,307 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestSetPrometheusRegistryRegistersKnownCollectors(t *testing.T) {
+	first := prometheus.NewRegistry()
+	SetPrometheusRegistry(first)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "coldbrew_test_switch_total",
+		Help: "Counter registered before the registry is switched",
+	})
+	registerCollector(counter)
+	counter.Inc()
+
+	second := prometheus.NewRegistry()
+	SetPrometheusRegistry(second)
+	if n, err := testutil.GatherAndCount(second, "coldbrew_test_switch_total"); err != nil || n != 1 {
+		t.Fatalf("collector registered before the switch is not exposed by the new registry: %d, %v", n, err)
+	}
+	if got := testutil.ToFloat64(counter); got != 1 {
+		t.Fatalf("counter value = %v, want 1", got)
+	}
+}
+
+// shutdownCount returns the number of shutdowns observed by coldbrew_shutdown_duration_seconds
+func shutdownCount(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := shutdownDuration.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestShutdownMetricsExposedByNextStart(t *testing.T) {
+	cfg := testConfig()
+	cfg.ShutdownReportFile = filepath.Join(t.TempDir(), "shutdown.json")
+	previous := newTestCB(t, cfg)
+	previous.SetService(&testService{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- previous.Run()
+	}()
+	<-previous.Started()
+	previous.Stop(time.Second)
+	<-errs
+	if _, err := os.Stat(cfg.ShutdownReportFile); err != nil {
+		t.Fatalf("shutdown report was not written: %v", err)
+	}
+	want := shutdownCount(t) + 1
+
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+	resp, err := http.Get("http://" + c.httpAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		fmt.Sprintf("coldbrew_shutdown_duration_seconds_count %d", want),
+		fmt.Sprintf("coldbrew_shutdown_drain_duration_seconds_count %d", want),
+		"coldbrew_shutdown_in_flight_requests 0",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("/metrics does not contain %q", line)
+		}
+	}
+	if _, err := os.Stat(cfg.ShutdownReportFile); !os.IsNotExist(err) {
+		t.Errorf("shutdown report was not removed after it was recorded: %v", err)
+	}
+}
+
+func TestGoMaxProcsGauge(t *testing.T) {
+	// testConfig disables automaxprocs, the gauge is reported all the same
+	newTestCB(t, testConfig())
+	reg := prometheusRegistry()
+	if n, err := testutil.GatherAndCount(reg, "go_maxprocs"); err != nil || n != 1 {
+		t.Fatalf("go_maxprocs is not exposed: %d, %v", n, err)
+	}
+	previous := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(previous)
+	runtime.GOMAXPROCS(previous + 1)
+	if got := testutil.ToFloat64(goMaxProcs); got != float64(previous+1) {
+		t.Fatalf("go_maxprocs = %v after GOMAXPROCS changed to %d", got, previous+1)
+	}
+}
+
+func TestValidateMetricsLabels(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		valid  bool
+	}{
+		{labels: map[string]string{"tenant": "x-tenant", "client_app": "x-client"}, valid: true},
+		{labels: map[string]string{"tenant-id": "x-tenant"}},
+		{labels: map[string]string{"1tenant": "x-tenant"}},
+		{labels: map[string]string{"__tenant": "x-tenant"}},
+		{labels: map[string]string{"grpc_code": "x-code"}},
+		{labels: map[string]string{"tenant": ""}},
+	}
+	for _, tt := range tests {
+		if err := validateMetricsLabels(tt.labels); (err == nil) != tt.valid {
+			t.Errorf("validateMetricsLabels(%v) = %v, want valid %v", tt.labels, err, tt.valid)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.MetricsLabelsFromMetadata = map[string]string{"grpc_method": "x-method"}
+	if err := newTestCB(t, cfg).Run(); err == nil || !strings.Contains(err.Error(), "grpc_method") {
+		t.Fatalf("Run returned %v, want the invalid label to fail the startup", err)
+	}
+}
+
+func TestLabeledMetricsCountRejectedCalls(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxConcurrentRequests = 1
+	cfg.MetricsLabelsFromMetadata = map[string]string{"tenant": "X-Tenant"}
+	registry := prometheus.NewRegistry()
+	SetPrometheusRegistry(registry)
+	c := New(cfg).(*cb)
+	srv := newBlockingServer()
+	c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&blockingServiceDesc, srv)
+		return nil
+	}})
+	runTestServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(tenant string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", tenant)
+		return conn.Invoke(ctx, blockingMethod, &emptypb.Empty{}, &emptypb.Empty{})
+	}
+
+	held := make(chan error, 1)
+	go func() { held <- call("acme") }()
+	srv.waitEntered(t)
+	if err := call("globex"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("call over the limit returned %v, want ResourceExhausted", err)
+	}
+	close(srv.release)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP grpc_server_labeled_handled_total Total number of gRPC calls completed on the server with the labels configured in MetricsLabelsFromMetadata
+# TYPE grpc_server_labeled_handled_total counter
+grpc_server_labeled_handled_total{grpc_code="OK",grpc_method="` + blockingMethod + `",tenant="acme"} 1
+grpc_server_labeled_handled_total{grpc_code="ResourceExhausted",grpc_method="` + blockingMethod + `",tenant="globex"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "grpc_server_labeled_handled_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	for code, want := range map[codes.Code]string{
+		codes.OK:                 "ok",
+		codes.InvalidArgument:    "client_error",
+		codes.FailedPrecondition: "client_error",
+		codes.NotFound:           "client_error",
+		codes.ResourceExhausted:  "client_error",
+		codes.Internal:           "server_error",
+		codes.Unavailable:        "server_error",
+		codes.Unknown:            "server_error",
+	} {
+		if got := statusClass(code); got != want {
+			t.Errorf("statusClass(%v) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+// panicMethod is the method of panicServiceDesc, it panics
+const panicMethod = "/coldbrew.test.Panic/Panic"
+
+var panicServiceDesc = grpc.ServiceDesc{
+	ServiceName: "coldbrew.test.Panic",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Panic",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(emptypb.Empty)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: panicMethod}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				panic("boom")
+			})
+		},
+	}},
+}
+
+func TestStatusClassCountsRejectedCallsAndPanics(t *testing.T) {
+	cfg := testConfig()
+	cfg.EnableGRPCStatusClassMetrics = true
+	cfg.MaxConcurrentRequests = 1
+	c := newTestCB(t, cfg)
+	srv := newBlockingServer()
+	c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&blockingServiceDesc, srv)
+		server.RegisterService(&panicServiceDesc, struct{}{})
+		return nil
+	}})
+	runTestServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(method string) error {
+		return conn.Invoke(context.Background(), method, &emptypb.Empty{}, &emptypb.Empty{})
+	}
+	count := func(method, class string) float64 {
+		return testutil.ToFloat64(grpcHandledByClass.WithLabelValues(method, class))
+	}
+	okBefore, rejectedBefore, panicBefore := count(blockingMethod, "ok"), count(blockingMethod, "client_error"), count(panicMethod, "server_error")
+
+	if err := call(panicMethod); status.Code(err) == codes.OK {
+		t.Fatal("call of a panicking handler succeeded")
+	}
+	held := make(chan error, 1)
+	go func() { held <- call(blockingMethod) }()
+	srv.waitEntered(t)
+	if err := call(blockingMethod); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("call over the limit returned %v, want ResourceExhausted", err)
+	}
+	close(srv.release)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := count(panicMethod, "server_error") - panicBefore; got != 1 {
+		t.Errorf("counted %v panics as server errors, want 1", got)
+	}
+	if got := count(blockingMethod, "client_error") - rejectedBefore; got != 1 {
+		t.Errorf("counted %v rejected calls as client errors, want 1", got)
+	}
+	if got := count(blockingMethod, "ok") - okBefore; got != 1 {
+		t.Errorf("counted %v successful calls, want 1", got)
+	}
+}
+
+func TestGRPCServerConnectionsGauge(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	runEchoServer(t, c)
+	waitConnections := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(grpcServerConnections) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("grpc_server_connections = %v, want %v", testutil.ToFloat64(grpcServerConnections), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	before := testutil.ToFloat64(grpcServerConnections)
+
+	var conns []*grpc.ClientConn
+	for i := 1; i <= 2; i++ {
+		conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.Invoke(context.Background(), echoMethod, wrapperspb.String("ping"), &wrapperspb.StringValue{}); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		waitConnections(before + float64(i))
+	}
+	if n, err := testutil.GatherAndCount(prometheusRegistry(), "grpc_server_connections"); err != nil || n != 1 {
+		t.Fatalf("grpc_server_connections is not exposed: %d, %v", n, err)
+	}
+	for i, conn := range conns {
+		conn.Close()
+		waitConnections(before + float64(len(conns)-i-1))
+	}
+}
@@ -0,0 +1,670 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/interceptors"
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/go-logr/logr"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelBridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+)
+
+// OTLPConfig is the configuration used to export traces, and optionally metrics and logs, to an OTLP collector
+type OTLPConfig struct {
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string
+	// Headers are sent with every export, e.g. authentication headers
+	Headers map[string]string
+	// ServiceName is the name of the service used to display traces in backends
+	ServiceName string
+	// ServiceVersion is the version of the service
+	ServiceVersion string
+	// SamplingRatio is the ratio of traces to sample, between 0 and 1
+	SamplingRatio float64
+	// Compression is the compression used for exports, "gzip" or "none"
+	Compression string
+	// Insecure disables TLS when connecting to the collector
+	Insecure bool
+	// VerifyConnection makes SetupOpenTelemetry fail when the collector can not be reached
+	VerifyConnection bool
+	// DisableRetry disables retrying failed exports
+	DisableRetry bool
+	// RetryInitialInterval is the time to wait before the first retry of a failed export, the exporter default is used when zero
+	RetryInitialInterval time.Duration
+	// RetryMaxInterval is the upper bound of the backoff between retries, the exporter default is used when zero
+	RetryMaxInterval time.Duration
+	// RetryMaxElapsedTime is the maximum time spent retrying an export before the spans are dropped, the exporter default is used when zero
+	RetryMaxElapsedTime time.Duration
+	// EnableMetrics exports OpenTelemetry metrics to the same collector in addition to traces
+	EnableMetrics bool
+	// MetricsInterval is the interval between metric exports, the reader default of one minute is used when zero
+	MetricsInterval time.Duration
+	// MetricsCompression is the compression used for metric exports, "gzip" or "none", defaults to gzip when empty
+	// metrics are exported independently from Compression as they are sent far more often than spans
+	MetricsCompression string
+	// Protocol is the OTLP transport, "grpc" or "http/protobuf", defaults to grpc
+	Protocol string
+	// ForceSampleHeader is the request header, e.g. x-force-sample, that forces the sampling decision of the request
+	// true samples the request and false drops it regardless of SamplingRatio, it is also read from the baggage
+	// other requests keep following the decision of their parent or SamplingRatio
+	ForceSampleHeader string
+	// EnableLogs exports the logs written with the coldbrew logger to the same collector, correlated with the active span
+	EnableLogs bool
+	// DisableOpenTracingBridge sets the tracer provider without registering the OpenTracing bridge
+	// the HTTP gateway and the gRPC server are then traced with otelhttp and otelgrpc, spans started with OpenTracing are not exported
+	DisableOpenTracingBridge bool
+	// RedactAttributes are span attribute keys whose values are replaced by a hash before the spans are exported
+	RedactAttributes []string
+}
+
+const (
+	// OTLPProtocolGRPC exports over OTLP/gRPC, usually on port 4317
+	OTLPProtocolGRPC = "grpc"
+	// OTLPProtocolHTTP exports over OTLP/HTTP with protobuf payloads, usually on port 4318
+	OTLPProtocolHTTP = "http/protobuf"
+)
+
+// useHTTP reports whether the exports are sent over OTLP/HTTP
+func (config OTLPConfig) useHTTP() (bool, error) {
+	switch config.Protocol {
+	case "", OTLPProtocolGRPC:
+		return false, nil
+	case OTLPProtocolHTTP:
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported OTLP protocol %q, must be %q or %q", config.Protocol, OTLPProtocolGRPC, OTLPProtocolHTTP)
+}
+
+// compressed reports whether the exports are compressed
+func (config OTLPConfig) compressed() bool {
+	return config.Compression != "" && config.Compression != "none"
+}
+
+// traceClient returns the client the trace exporter sends spans with over the configured protocol
+func (config OTLPConfig) traceClient() (otlptrace.Client, error) {
+	useHTTP, err := config.useHTTP()
+	if err != nil {
+		return nil, err
+	}
+	if useHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(config.Endpoint),
+			otlptracehttp.WithHeaders(config.Headers),
+			otlptracehttp.WithRetry(otlptracehttp.RetryConfig(config.retryConfig())),
+		}
+		if config.compressed() {
+			// gzip is the only compression supported by OTLP/HTTP
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.NewClient(opts...), nil
+	}
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(config.Endpoint),
+		otlptracegrpc.WithHeaders(config.Headers),
+		otlptracegrpc.WithRetry(config.retryConfig()),
+	}
+	if config.compressed() {
+		opts = append(opts, otlptracegrpc.WithCompressor(config.Compression))
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.NewClient(opts...), nil
+}
+
+// otlpDefaultRetry is the retry configuration of the OTLP exporter when none is set
+var otlpDefaultRetry = otlptracegrpc.RetryConfig{
+	Enabled:         true,
+	InitialInterval: 5 * time.Second,
+	MaxInterval:     30 * time.Second,
+	MaxElapsedTime:  time.Minute,
+}
+
+// retryConfig returns the retry configuration of the exporter
+func (config OTLPConfig) retryConfig() otlptracegrpc.RetryConfig {
+	if config.DisableRetry {
+		return otlptracegrpc.RetryConfig{Enabled: false}
+	}
+	rc := otlpDefaultRetry
+	if config.RetryInitialInterval > 0 {
+		rc.InitialInterval = config.RetryInitialInterval
+	}
+	if config.RetryMaxInterval > 0 {
+		rc.MaxInterval = config.RetryMaxInterval
+	}
+	if config.RetryMaxElapsedTime > 0 {
+		rc.MaxElapsedTime = config.RetryMaxElapsedTime
+	}
+	return rc
+}
+
+// metricsCompression returns the compression of the metric exports, empty when they are not compressed
+func (config OTLPConfig) metricsCompression() string {
+	switch config.MetricsCompression {
+	case "":
+		return "gzip"
+	case "none":
+		return ""
+	}
+	return config.MetricsCompression
+}
+
+// otlpDialTimeout is the timeout used to verify the connectivity to the OTLP collector
+const otlpDialTimeout = 5 * time.Second
+
+// SetupOpenTelemetry sets up the OpenTelemetry tracing
+// It uses the OTLP gRPC or HTTP exporter, depending on the protocol, to send traces to the configured collector
+// and registers the OpenTracing bridge so that existing OpenTracing instrumentation is exported as well, unless DisableOpenTracingBridge is set
+func SetupOpenTelemetry(config OTLPConfig) error {
+	return SetupOpenTelemetryExporters(config)
+}
+
+// SetupOpenTelemetryExporters sets up the OpenTelemetry tracing with a single tracer provider exporting to every configured collector
+// e.g. to send traces to a local Jaeger and to New Relic during a migration, configs without an endpoint are ignored
+// The service name, version and sampling settings are taken from the first config, the export settings from each config
+func SetupOpenTelemetryExporters(configs ...OTLPConfig) error {
+	var enabled []OTLPConfig
+	for _, config := range configs {
+		if config.Endpoint != "" {
+			enabled = append(enabled, config)
+		}
+	}
+	if len(enabled) == 0 {
+		log.Info(context.Background(), "msg", "not initializing opentelemetry tracing, no endpoint configured")
+		return nil
+	}
+	for _, config := range enabled {
+		if !config.VerifyConnection {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", config.Endpoint, otlpDialTimeout)
+		if err != nil {
+			log.Error(context.Background(), "msg", "OTLP endpoint is unreachable", "endpoint", config.Endpoint, "err", err)
+			return fmt.Errorf("OTLP endpoint %s is unreachable: %w", config.Endpoint, err)
+		}
+		conn.Close()
+	}
+
+	setupOTelLogging()
+	first := enabled[0]
+	d := resource.Default()
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(
+			// the service name used to display traces in backends
+			semconv.ServiceNameKey.String(first.ServiceName),
+			semconv.ServiceVersionKey.String(first.ServiceVersion),
+		),
+	)
+	if err != nil {
+		log.Error(context.Background(), "msg", "creating OTLP resource", "err", err)
+		return err
+	}
+	r, err := resource.Merge(d, res)
+	if err != nil {
+		log.Error(context.Background(), "msg", "merging OTLP resource", "err", err)
+		return err
+	}
+
+	tracingSampler = newAdjustableSampler(first.SamplingRatio)
+	var sampler sdktrace.Sampler = tracingSampler
+	forceSamplingKey = first.ForceSampleHeader
+	if forceSamplingKey != "" {
+		sampler = newForceSampler(tracingSampler, forceSamplingKey)
+	}
+	providerOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(r),
+	}
+	endpoints := make([]string, 0, len(enabled))
+	for _, config := range enabled {
+		client, err := config.traceClient()
+		if err != nil {
+			log.Error(context.Background(), "msg", "creating OTLP trace client", "endpoint", config.Endpoint, "err", err)
+			return err
+		}
+		otlpExporter, err := otlptrace.New(context.Background(), client)
+		if err != nil {
+			log.Error(context.Background(), "msg", "creating OTLP trace exporter", "endpoint", config.Endpoint, "err", err)
+			return err
+		}
+		var exporter sdktrace.SpanExporter = otlpExporter
+		if len(config.RedactAttributes) > 0 {
+			exporter = newRedactingExporter(exporter, config.RedactAttributes)
+		}
+		// every exporter gets its own batcher so that a slow collector does not hold back the others
+		providerOpts = append(providerOpts, sdktrace.WithSpanProcessor(newDroppingSpanProcessor(config.Endpoint,
+			sdktrace.NewBatchSpanProcessor(exporter, sdktrace.WithBlocking()), sdktrace.DefaultMaxQueueSize)))
+		endpoints = append(endpoints, config.Endpoint)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(providerOpts...)
+	if first.DisableOpenTracingBridge {
+		otel.SetTracerProvider(tracerProvider)
+	} else {
+		otelTracer := tracerProvider.Tracer("")
+		// Use the bridgeTracer as your OpenTracing tracer.
+		bridgeTracer, wrapperTracerProvider := otelBridge.NewTracerPair(otelTracer)
+
+		otel.SetTracerProvider(wrapperTracerProvider)
+		opentracing.SetGlobalTracer(bridgeTracer)
+	}
+	log.Info(context.Background(), "msg", "Initialized opentelemetry tracing", "endpoints", endpoints, "opentracing_bridge", !first.DisableOpenTracingBridge)
+
+	if err := setupOTelMetrics(enabled, r); err != nil {
+		return err
+	}
+	return setupOTelLogs(enabled, r)
+}
+
+// otelMeterProvider is the meter provider configured by SetupOpenTelemetry when metrics are enabled
+var otelMeterProvider *sdkmetric.MeterProvider
+
+// setupOTelMetrics configures a meter provider that periodically pushes metrics to the OTLP collectors with EnableMetrics
+// and registers it as the global meter provider
+func setupOTelMetrics(configs []OTLPConfig, res *resource.Resource) error {
+	var readers []sdkmetric.Reader
+	for _, config := range configs {
+		if !config.EnableMetrics {
+			continue
+		}
+		exporter, err := config.metricExporter()
+		if err != nil {
+			log.Error(context.Background(), "msg", "creating OTLP metric exporter", "endpoint", config.Endpoint, "err", err)
+			return err
+		}
+		var readerOpts []sdkmetric.PeriodicReaderOption
+		if config.MetricsInterval > 0 {
+			readerOpts = append(readerOpts, sdkmetric.WithInterval(config.MetricsInterval))
+		}
+		readers = append(readers, sdkmetric.NewPeriodicReader(exporter, readerOpts...))
+		log.Info(context.Background(), "msg", "Initialized opentelemetry metrics", "endpoint", config.Endpoint)
+	}
+	if len(readers) == 0 {
+		return nil
+	}
+	otelMeterProvider = newMeterProvider(res, readers...)
+	otel.SetMeterProvider(otelMeterProvider)
+	return nil
+}
+
+// metricExporter returns the metric exporter for the configured protocol
+func (config OTLPConfig) metricExporter() (sdkmetric.Exporter, error) {
+	useHTTP, err := config.useHTTP()
+	if err != nil {
+		return nil, err
+	}
+	if useHTTP {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(config.Endpoint),
+			otlpmetrichttp.WithHeaders(config.Headers),
+			otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig(config.retryConfig())),
+		}
+		if config.metricsCompression() != "" {
+			// gzip is the only compression supported by OTLP/HTTP
+			opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		if config.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(context.Background(), opts...)
+	}
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(config.Endpoint),
+		otlpmetricgrpc.WithHeaders(config.Headers),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig(config.retryConfig())),
+	}
+	if compression := config.metricsCompression(); compression != "" {
+		opts = append(opts, otlpmetricgrpc.WithCompressor(compression))
+	}
+	if config.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(context.Background(), opts...)
+}
+
+// newMeterProvider returns a meter provider that collects metrics with readers
+func newMeterProvider(res *resource.Resource, readers ...sdkmetric.Reader) *sdkmetric.MeterProvider {
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	for _, reader := range readers {
+		opts = append(opts, sdkmetric.WithReader(reader))
+	}
+	return sdkmetric.NewMeterProvider(opts...)
+}
+
+// otelLoggerProvider is the logger provider configured by SetupOpenTelemetry when logs are enabled
+var otelLoggerProvider *sdklog.LoggerProvider
+
+// setupOTelLogs configures a logger provider that batches logs to the OTLP collectors with EnableLogs
+// and wraps the coldbrew logger so that every log written with it is exported as well
+// loggers set with SetupLogger or log.SetLogger afterwards are not exported
+func setupOTelLogs(configs []OTLPConfig, res *resource.Resource) error {
+	providerOpts := []sdklog.LoggerProviderOption{sdklog.WithResource(res)}
+	var endpoints []string
+	for _, config := range configs {
+		if !config.EnableLogs {
+			continue
+		}
+		exporter, err := config.logExporter()
+		if err != nil {
+			log.Error(context.Background(), "msg", "creating OTLP log exporter", "endpoint", config.Endpoint, "err", err)
+			return err
+		}
+		providerOpts = append(providerOpts, sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)))
+		endpoints = append(endpoints, config.Endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	otelLoggerProvider = sdklog.NewLoggerProvider(providerOpts...)
+	log.SetLogger(newOTelLogger(log.GetLogger(), otelLoggerProvider.Logger(otelInstrumentationName)))
+	log.Info(context.Background(), "msg", "Initialized opentelemetry logs", "endpoints", endpoints)
+	return nil
+}
+
+// logExporter returns the log exporter for the configured protocol
+func (config OTLPConfig) logExporter() (sdklog.Exporter, error) {
+	useHTTP, err := config.useHTTP()
+	if err != nil {
+		return nil, err
+	}
+	if useHTTP {
+		opts := []otlploghttp.Option{
+			otlploghttp.WithEndpoint(config.Endpoint),
+			otlploghttp.WithHeaders(config.Headers),
+			otlploghttp.WithRetry(otlploghttp.RetryConfig(config.retryConfig())),
+		}
+		if config.compressed() {
+			opts = append(opts, otlploghttp.WithCompression(otlploghttp.GzipCompression))
+		}
+		if config.Insecure {
+			opts = append(opts, otlploghttp.WithInsecure())
+		}
+		return otlploghttp.New(context.Background(), opts...)
+	}
+	opts := []otlploggrpc.Option{
+		otlploggrpc.WithEndpoint(config.Endpoint),
+		otlploggrpc.WithHeaders(config.Headers),
+		otlploggrpc.WithRetry(otlploggrpc.RetryConfig(config.retryConfig())),
+	}
+	if config.compressed() {
+		opts = append(opts, otlploggrpc.WithCompressor(config.Compression))
+	}
+	if config.Insecure {
+		opts = append(opts, otlploggrpc.WithInsecure())
+	}
+	return otlploggrpc.New(context.Background(), opts...)
+}
+
+// otelInstrumentationName is the instrumentation scope of the telemetry emitted by coldbrew
+const otelInstrumentationName = "github.com/go-coldbrew/core"
+
+// otelShutdownTimeout is the time given to an OpenTelemetry provider to export the pending data on shutdown
+const otelShutdownTimeout = 5 * time.Second
+
+// otelProvider is an OpenTelemetry provider that exports its pending data when shut down
+type otelProvider interface {
+	Shutdown(ctx context.Context) error
+}
+
+// otelProviderCloser flushes and shuts down an OpenTelemetry meter or logger provider when it is closed
+type otelProviderCloser struct {
+	provider otelProvider
+	timeout  time.Duration
+}
+
+// Close exports the pending data and stops the provider
+func (o otelProviderCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	return o.provider.Shutdown(ctx)
+}
+
+// otelSpansDropped counts spans dropped because the queue of an exporter was full
+var otelSpansDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "otel_spans_dropped_total",
+	Help: "Total number of spans dropped because the OpenTelemetry export queue was full",
+}, []string{"endpoint"})
+
+// droppingSpanProcessor queues the ended spans of an exporter in front of its batch span processor
+// the batch span processor blocks when it is full, the queue drops the spans instead and counts them in otel_spans_dropped_total
+type droppingSpanProcessor struct {
+	next     sdktrace.SpanProcessor
+	endpoint string
+	queue    chan queuedSpan
+	done     chan struct{}
+	// mu guards closed, spans are queued under the read lock so that none is queued once Shutdown closed the queue
+	mu     sync.RWMutex
+	closed bool
+}
+
+// queuedSpan is an ended span or, when flushed is set, a marker closed once the spans queued before it reached the batch span processor
+type queuedSpan struct {
+	span    sdktrace.ReadOnlySpan
+	flushed chan struct{}
+}
+
+// newDroppingSpanProcessor returns a processor queueing up to size spans for next
+func newDroppingSpanProcessor(endpoint string, next sdktrace.SpanProcessor, size int) *droppingSpanProcessor {
+	p := &droppingSpanProcessor{
+		next:     next,
+		endpoint: endpoint,
+		queue:    make(chan queuedSpan, size),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// run hands the queued spans to the batch span processor until the queue is closed
+func (p *droppingSpanProcessor) run() {
+	defer close(p.done)
+	for q := range p.queue {
+		if q.flushed != nil {
+			close(q.flushed)
+			continue
+		}
+		p.next.OnEnd(q.span)
+	}
+}
+
+func (p *droppingSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.next.OnStart(parent, s)
+}
+
+func (p *droppingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		return
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- queuedSpan{span: s}:
+	default:
+		otelSpansDropped.WithLabelValues(p.endpoint).Inc()
+	}
+}
+
+// ForceFlush waits for the queued spans to reach the batch span processor and flushes it
+func (p *droppingSpanProcessor) ForceFlush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return nil
+	}
+	select {
+	case p.queue <- queuedSpan{flushed: flushed}:
+	case <-ctx.Done():
+		p.mu.RUnlock()
+		return ctx.Err()
+	}
+	p.mu.RUnlock()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.next.ForceFlush(ctx)
+}
+
+// Shutdown hands the queued spans to the batch span processor and shuts it down
+func (p *droppingSpanProcessor) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.next.Shutdown(ctx)
+}
+
+// otelLogSink receives the internal logs of OpenTelemetry and forwards them to the coldbrew logger
+// the logs more verbose than the coldbrew log level are disabled
+type otelLogSink struct{}
+
+func (s *otelLogSink) Init(logr.RuntimeInfo) {}
+
+func (s *otelLogSink) Enabled(level int) bool {
+	return otelLogLevel(level) <= log.GetLevel()
+}
+
+// otelLogLevel returns the coldbrew log level of an OpenTelemetry verbosity level
+// otel logs warnings at level 1, info at 4 and debug at 8
+func otelLogLevel(level int) loggers.Level {
+	switch {
+	case level <= 1:
+		return loggers.WarnLevel
+	case level <= 4:
+		return loggers.InfoLevel
+	default:
+		return loggers.DebugLevel
+	}
+}
+
+func (s *otelLogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	args := append([]interface{}{"msg", "opentelemetry: " + msg}, keysAndValues...)
+	switch otelLogLevel(level) {
+	case loggers.WarnLevel:
+		log.Warn(context.Background(), args...)
+	case loggers.InfoLevel:
+		log.Info(context.Background(), args...)
+	default:
+		log.Debug(context.Background(), args...)
+	}
+}
+
+func (s *otelLogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.Error(context.Background(), append([]interface{}{"msg", "opentelemetry: " + msg, "err", err}, keysAndValues...)...)
+}
+
+func (s *otelLogSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return s
+}
+
+func (s *otelLogSink) WithName(name string) logr.LogSink {
+	return s
+}
+
+// otelErrorHandler reports OpenTelemetry errors, e.g. failed exports, through the coldbrew logger
+type otelErrorHandler struct{}
+
+func (otelErrorHandler) Handle(err error) {
+	log.Error(context.Background(), "msg", "opentelemetry error", "err", err)
+}
+
+// setupOTelLogging routes the OpenTelemetry internal logs and errors to coldbrew and registers otel_spans_dropped_total
+func setupOTelLogging() {
+	registerCollector(otelSpansDropped)
+	otel.SetLogger(logr.New(&otelLogSink{}))
+	otel.SetErrorHandler(otelErrorHandler{})
+}
+
+// otelHTTPHandler traces the HTTP requests with otelhttp, it is used instead of the OpenTracing spans when the bridge is disabled
+// paths excluded by interceptors.FilterMethods (e.g. /healthcheck) are not traced
+func otelHTTPHandler(h http.Handler) http.Handler {
+	handler := otelhttp.NewHandler(h, "ServeHTTP",
+		otelhttp.WithPropagators(inboundPropagator()),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return interceptors.FilterMethodsFunc(r.Context(), r.URL.Path)
+		}),
+		otelhttp.WithSpanOptions(trace.WithAttributes(attribute.String("component", "grpc-gateway"))),
+	)
+	key := forceSamplingKey
+	if key == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get(key); v != "" {
+			// read by the sampler to force the sampling decision
+			r = r.WithContext(withForceSample(r.Context(), v))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// startBridgeHTTPSpan starts the span of an HTTP request traced through the OpenTracing bridge
+// the trace context is extracted with the inbound propagators and the span is started with the bridge tracer provider,
+// which adds it to the context as an OpenTracing span as well
+func startBridgeHTTPSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := inboundPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	attrs := []attribute.KeyValue{
+		attribute.String(string(ext.Component), "grpc-gateway"),
+		attribute.String(string(ext.HTTPUrl), r.URL.Path),
+		attribute.String(string(ext.HTTPMethod), r.Method),
+	}
+	if key := forceSamplingKey; key != "" {
+		if v := r.Header.Get(key); v != "" {
+			// read by the sampler to force the sampling decision
+			attrs = append(attrs, attribute.String(strings.ToLower(key), v))
+		}
+	}
+	ctx, span := otel.Tracer("").Start(ctx, "ServeHTTP", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
+
+// otelGRPCServerHandler traces the gRPC calls with otelgrpc, it is used instead of the OpenTracing interceptor when the bridge is disabled
+// methods excluded by interceptors.FilterMethods (e.g. health checks) are not traced
+func otelGRPCServerHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(otelgrpc.WithFilter(func(info *stats.RPCTagInfo) bool {
+		return interceptors.FilterMethodsFunc(context.Background(), info.FullMethodName)
+	}))
+}
@@ -0,0 +1,454 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestOTLPConfigs(t *testing.T) {
+	cfg := testConfig()
+	cfg.OTLPEndpoint = "collector:4317"
+	cfg.JaegerOTLPEndpoint = "jaeger:4317"
+	cfg.NewRelicOpentelemetry = true
+	cfg.NewRelicLicenseKey = "license"
+	cfg.OTLPEnableMetrics = true
+	cfg.OTLPEnableLogs = true
+	c := &cb{config: cfg}
+
+	configs := c.otlpConfigs()
+	endpoints := map[string]OTLPConfig{}
+	for _, config := range configs {
+		endpoints[config.Endpoint] = config
+	}
+	if len(configs) != 3 || len(endpoints) != 3 {
+		t.Fatalf("OTLPEndpoint, New Relic and jaeger must all be exported to, got %v", configs)
+	}
+	if configs[0].Endpoint != cfg.OTLPEndpoint {
+		t.Fatalf("OTLPEndpoint must come first to set the sampling ratio, got %s", configs[0].Endpoint)
+	}
+	for _, endpoint := range []string{cfg.OTLPEndpoint, "otlp.nr-data.net:4317"} {
+		if !endpoints[endpoint].EnableMetrics || !endpoints[endpoint].EnableLogs {
+			t.Errorf("%s does not receive metrics and logs", endpoint)
+		}
+	}
+	if jaeger := endpoints[cfg.JaegerOTLPEndpoint]; jaeger.EnableMetrics || jaeger.EnableLogs {
+		t.Error("jaeger only accepts traces, it must not receive metrics or logs")
+	}
+
+	// OTLPEndpoint pointing at New Relic is not exported to twice
+	c.config.OTLPEndpoint = "otlp.nr-data.net:4317"
+	c.config.JaegerOTLPEndpoint = ""
+	if configs := c.otlpConfigs(); len(configs) != 1 {
+		t.Fatalf("New Relic is exported to %d times", len(configs))
+	}
+}
+
+func TestSamplingRatioByEnvironment(t *testing.T) {
+	cfg := testConfig()
+	cfg.OTLPEndpoint = "collector:4317"
+	cfg.JaegerOTLPEndpoint = "jaeger:4317"
+	cfg.OTLPSamplingRatio = 0.5
+	cfg.TracingSamplingRatioByEnvironment = map[string]float64{"production": 0.01, "staging": 1}
+	for env, want := range map[string]float64{"production": 0.01, "staging": 1, "development": 0.5} {
+		c := &cb{config: cfg}
+		c.config.Environment = env
+		for _, config := range c.otlpConfigs() {
+			if config.SamplingRatio != want {
+				t.Errorf("%s samples %s at %v, want %v", env, config.Endpoint, config.SamplingRatio, want)
+			}
+		}
+	}
+}
+
+func TestOTLPRetryConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.OTLPEndpoint = "collector:4317"
+	cfg.OTLPRetryInitialIntervalSeconds = 1
+	cfg.OTLPRetryMaxIntervalSeconds = 0
+	cfg.OTLPRetryMaxElapsedTimeSeconds = 10
+	c := &cb{config: cfg}
+	rc := c.otlpConfigs()[0].retryConfig()
+	if !rc.Enabled || rc.InitialInterval != time.Second || rc.MaxInterval != otlpDefaultRetry.MaxInterval || rc.MaxElapsedTime != 10*time.Second {
+		t.Errorf("retry config = %+v, want the configured intervals and the default for the ones not set", rc)
+	}
+
+	c.config.OTLPDisableRetry = true
+	if rc := c.otlpConfigs()[0].retryConfig(); rc.Enabled {
+		t.Errorf("retry config = %+v although retries are disabled", rc)
+	}
+}
+
+// echoRoute registers POST /v1/echo on mux, it reads the request body and answers with an empty message through the gateway
+func echoRoute(ctx context.Context, mux *runtime.ServeMux) error {
+	return mux.HandlePath(http.MethodPost, "/v1/echo", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		io.ReadAll(r.Body)
+		_, outbound := runtime.MarshalerForRequest(mux, r)
+		ctx := runtime.NewServerMetadataContext(r.Context(), runtime.ServerMetadata{})
+		runtime.ForwardResponseMessage(ctx, mux, outbound, w, r, &emptypb.Empty{}, mux.GetForwardResponseOptions()...)
+	})
+}
+
+func TestSpansInTracingModes(t *testing.T) {
+	for _, mode := range []tracingMode{tracingBridge, tracingNative} {
+		name := map[tracingMode]string{tracingBridge: "bridge", tracingNative: "native"}[mode]
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.EnableGatewayMarshalSpans = true
+			c := newTestCB(t, cfg)
+			// stands for SetupOpenTelemetryExporters succeeding in processConfig, which replaces the jaeger tracer set up by New
+			exporter := setupTestTracing(t, mode, "http.method")
+			c.tracing = mode
+			c.SetService(&testService{initHTTP: echoRoute})
+			runTestServer(t, c)
+
+			req, err := http.NewRequest(http.MethodPost, "http://"+c.httpAddr+"/v1/echo", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("traceparent", incomingTraceparent)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("/v1/echo returned %d", resp.StatusCode)
+			}
+
+			conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", incomingTraceparent)
+			if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// the server spans end after the responses are sent
+			spans := map[string]tracetest.SpanStub{}
+			for deadline := time.Now().Add(5 * time.Second); len(exporter.GetSpans()) < 4 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, s := range exporter.GetSpans() {
+				if s.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+					t.Errorf("span %s did not join the incoming trace", s.Name)
+				}
+				if strings.HasSuffix(s.Name, "grpc.health.v1.Health/Check") {
+					s.Name = "grpc.health.v1.Health/Check"
+				}
+				spans[s.Name] = s
+			}
+			request, ok := spans["ServeHTTP"]
+			if !ok {
+				t.Fatalf("the HTTP request was not traced, got %v", spans)
+			}
+			for _, name := range []string{"gateway.unmarshal", "gateway.marshal"} {
+				if s, ok := spans[name]; !ok {
+					t.Errorf("%s span was not recorded", name)
+				} else if s.Parent.SpanID() != request.SpanContext.SpanID() {
+					t.Errorf("%s span is not a child of the request span", name)
+				}
+			}
+			if s, ok := spans["grpc.health.v1.Health/Check"]; !ok {
+				t.Error("the gRPC call was not traced")
+			} else if s.SpanKind != trace.SpanKindServer {
+				t.Errorf("the gRPC span kind is %s, want server", s.SpanKind)
+			}
+			method := ""
+			for _, attr := range request.Attributes {
+				if attr.Key == "http.method" {
+					method = attr.Value.AsString()
+				}
+			}
+			if method != redactValue(http.MethodPost) {
+				t.Errorf("http.method was exported as %q, want it redacted", method)
+			}
+		})
+	}
+}
+
+func TestOTLPMetricsExport(t *testing.T) {
+	cfg := testConfig()
+	cfg.OTLPEndpoint = "collector:4317"
+	cfg.OTLPEnableMetrics = true
+	cfg.OTLPMetricsIntervalSeconds = 30
+	if configs := (&cb{config: cfg}).otlpConfigs(); configs[0].MetricsInterval != 30*time.Second {
+		t.Errorf("MetricsInterval = %v, want the 30s of OTLPMetricsIntervalSeconds", configs[0].MetricsInterval)
+	}
+
+	prevProvider, prevGlobal := otelMeterProvider, otel.GetMeterProvider()
+	t.Cleanup(func() {
+		otelMeterProvider = prevProvider
+		otel.SetMeterProvider(prevGlobal)
+	})
+	exports := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case exports <- r.URL.Path:
+		default:
+		}
+	}))
+	defer collector.Close()
+	config := OTLPConfig{
+		Endpoint:        strings.TrimPrefix(collector.URL, "http://"),
+		Protocol:        OTLPProtocolHTTP,
+		Insecure:        true,
+		DisableRetry:    true,
+		MetricsInterval: 50 * time.Millisecond,
+	}
+
+	otelMeterProvider = nil
+	if err := setupOTelMetrics([]OTLPConfig{config}, resource.Empty()); err != nil {
+		t.Fatal(err)
+	}
+	if otelMeterProvider != nil {
+		t.Fatal("meter provider configured although no config enables metrics")
+	}
+
+	config.EnableMetrics = true
+	if err := setupOTelMetrics([]OTLPConfig{config}, resource.Empty()); err != nil {
+		t.Fatal(err)
+	}
+	if otelMeterProvider == nil || otel.GetMeterProvider() != otelMeterProvider {
+		t.Fatal("meter provider is not configured as the global one")
+	}
+	counter, err := otel.Meter("coldbrew-test").Int64Counter("coldbrew_test_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(context.Background(), 1)
+	select {
+	case path := <-exports:
+		if path != "/v1/metrics" {
+			t.Errorf("metrics exported to %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics were not exported within the interval")
+	}
+	if err := (otelProviderCloser{provider: otelMeterProvider, timeout: time.Second}).Close(); err != nil {
+		t.Errorf("closing the meter provider returned %v", err)
+	}
+}
+
+func TestOTLPOverHTTP(t *testing.T) {
+	cfg := testConfig()
+	cfg.OTLPEndpoint = "collector:4318"
+	cfg.OTLPProtocol = OTLPProtocolHTTP
+	if configs := (&cb{config: cfg}).otlpConfigs(); configs[0].Protocol != OTLPProtocolHTTP {
+		t.Errorf("Protocol = %q, want the OTLPProtocol of the config", configs[0].Protocol)
+	}
+
+	type upload struct {
+		path, encoding, apiKey string
+	}
+	uploads := make(chan upload, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads <- upload{path: r.URL.Path, encoding: r.Header.Get("Content-Encoding"), apiKey: r.Header.Get("api-key")}
+	}))
+	defer collector.Close()
+	config := OTLPConfig{
+		Endpoint:     strings.TrimPrefix(collector.URL, "http://"),
+		Protocol:     OTLPProtocolHTTP,
+		Headers:      map[string]string{"api-key": "license"},
+		Insecure:     true,
+		DisableRetry: true,
+		Compression:  "gzip",
+	}
+	client, err := config.traceClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop(context.Background())
+	if err := client.UploadTraces(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-uploads; got != (upload{path: "/v1/traces", encoding: "gzip", apiKey: "license"}) {
+		t.Errorf("traces uploaded as %+v, want gzip to /v1/traces with the configured headers", got)
+	}
+
+	config.Protocol = "thrift"
+	if _, err := config.traceClient(); err == nil {
+		t.Error("unsupported protocol was accepted")
+	}
+}
+
+func TestMetricsCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		encoding    string
+	}{
+		{compression: "", encoding: "gzip"},
+		{compression: "gzip", encoding: "gzip"},
+		{compression: "none", encoding: ""},
+	} {
+		encodings := make(chan string, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings <- r.Header.Get("Content-Encoding")
+		}))
+		// the traces compression must not apply to the metrics
+		config := OTLPConfig{
+			Endpoint:           strings.TrimPrefix(collector.URL, "http://"),
+			Protocol:           OTLPProtocolHTTP,
+			Insecure:           true,
+			DisableRetry:       true,
+			Compression:        "none",
+			MetricsCompression: tc.compression,
+		}
+		exporter, err := config.metricExporter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exporter.Export(context.Background(), &metricdata.ResourceMetrics{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-encodings; got != tc.encoding {
+			t.Errorf("MetricsCompression %q: metrics sent with Content-Encoding %q, want %q", tc.compression, got, tc.encoding)
+		}
+		exporter.Shutdown(context.Background())
+		collector.Close()
+	}
+}
+
+func TestRequireTracing(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the endpoint anymore
+	unreachable := lis.Addr().String()
+	lis.Close()
+
+	for name, endpoint := range map[string]string{"no endpoint": "", "unreachable collector": unreachable} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.RequireTracing = true
+			cfg.OTLPEndpoint = endpoint
+			c := newTestCB(t, cfg)
+			if c.setupErr == nil {
+				t.Fatal("New succeeded although tracing can not be set up")
+			}
+			if endpoint != "" && !strings.Contains(c.setupErr.Error(), endpoint) {
+				t.Errorf("setup error %q does not name the unreachable endpoint", c.setupErr)
+			}
+			if c.tracing != tracingOpenTracing {
+				t.Errorf("tracing mode = %d although no exporter was set up", c.tracing)
+			}
+			c.SetService(&testService{})
+			if err := c.Run(); err != c.setupErr {
+				t.Fatalf("Run returned %v, want the setup error %v", err, c.setupErr)
+			}
+			if c.GRPCServer() != nil {
+				t.Error("servers were started although the setup failed")
+			}
+		})
+	}
+}
+
+// blockingSpanProcessor counts the ended spans it receives, OnEnd blocks until release is closed
+type blockingSpanProcessor struct {
+	entered chan struct{}
+	release chan struct{}
+	ended   atomic.Int32
+}
+
+func (p *blockingSpanProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *blockingSpanProcessor) OnEnd(sdktrace.ReadOnlySpan) {
+	p.entered <- struct{}{}
+	<-p.release
+	p.ended.Add(1)
+}
+
+func (p *blockingSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (p *blockingSpanProcessor) ForceFlush(context.Context) error { return nil }
+
+func TestDroppingSpanProcessor(t *testing.T) {
+	const endpoint = "collector:4317"
+	next := &blockingSpanProcessor{entered: make(chan struct{}, 10), release: make(chan struct{})}
+	p := newDroppingSpanProcessor(endpoint, next, 1)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(p), sdktrace.WithSampler(sdktrace.AlwaysSample()))
+	tracer := provider.Tracer("")
+	before := testutil.ToFloat64(otelSpansDropped.WithLabelValues(endpoint))
+
+	// the first span blocks the batch span processor, the second one fills the queue and the third is dropped
+	_, first := tracer.Start(context.Background(), "first")
+	first.End()
+	<-next.entered
+	for _, name := range []string{"second", "third"} {
+		_, span := tracer.Start(context.Background(), name)
+		span.End()
+	}
+	if got := testutil.ToFloat64(otelSpansDropped.WithLabelValues(endpoint)) - before; got != 1 {
+		t.Fatalf("counted %v dropped spans, want 1", got)
+	}
+	// unsampled spans are neither queued nor counted
+	unsampled := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(p), sdktrace.WithSampler(sdktrace.NeverSample()))
+	_, span := unsampled.Tracer("").Start(context.Background(), "unsampled")
+	span.End()
+	if got := testutil.ToFloat64(otelSpansDropped.WithLabelValues(endpoint)) - before; got != 1 {
+		t.Fatalf("counted %v dropped spans after an unsampled span, want 1", got)
+	}
+
+	close(next.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := next.ended.Load(); got != 2 {
+		t.Fatalf("batch span processor received %d spans, want the 2 that were not dropped", got)
+	}
+	if err := provider.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// spans ended after the shutdown are ignored
+	p.OnEnd(first.(sdktrace.ReadOnlySpan))
+	if got := next.ended.Load(); got != 2 {
+		t.Fatalf("batch span processor received %d spans, a span ended after the shutdown was queued", got)
+	}
+}
+
+func TestOTelLogSinkFollowsLogLevel(t *testing.T) {
+	previous := log.GetLevel()
+	defer log.SetLevel(previous)
+	sink := &otelLogSink{}
+
+	log.SetLevel(loggers.InfoLevel)
+	for level, want := range map[int]bool{1: true, 4: true, 8: false} {
+		if got := sink.Enabled(level); got != want {
+			t.Errorf("at info, otel level %d enabled = %v, want %v", level, got, want)
+		}
+	}
+	log.SetLevel(loggers.ErrorLevel)
+	if sink.Enabled(1) {
+		t.Error("otel warnings are enabled at the error log level")
+	}
+}
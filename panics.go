@@ -0,0 +1,71 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"google.golang.org/grpc"
+)
+
+// PanicEvent describes a panic recovered in a gRPC handler
+type PanicEvent struct {
+	// Method is the full gRPC method of the call that panicked
+	Method string
+	// Value is the value passed to panic
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+	// Time is the time at which the panic was recovered
+	Time time.Time
+}
+
+// PanicChannel returns the channel panics recovered in gRPC handlers are delivered to
+// it is nil unless PanicChannelSize is set, events are dropped when the channel is full
+func (c *cb) PanicChannel() <-chan PanicEvent {
+	return c.panics
+}
+
+// reportPanic delivers a panic event without blocking the call
+func (c *cb) reportPanic(ctx context.Context, method string, value interface{}) {
+	e := PanicEvent{
+		Method: method,
+		Value:  value,
+		Stack:  debug.Stack(),
+		Time:   time.Now(),
+	}
+	select {
+	case c.panics <- e:
+	default:
+		log.Warn(ctx, "msg", "panic channel is full, dropping panic event", "grpc_method", method, "panic", fmt.Sprint(value))
+	}
+}
+
+// panicChannelInterceptor reports panics to the panic channel and panics again
+// so that they are still logged and notified by the recovery interceptor
+func (c *cb) panicChannelInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		defer func() {
+			if r := recover(); r != nil {
+				c.reportPanic(ctx, info.FullMethod, r)
+				panic(r)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// panicChannelStreamInterceptor is the stream equivalent of panicChannelInterceptor
+func (c *cb) panicChannelStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		defer func() {
+			if r := recover(); r != nil {
+				c.reportPanic(stream.Context(), info.FullMethod, r)
+				panic(r)
+			}
+		}()
+		return handler(srv, stream)
+	}
+}
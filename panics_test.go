@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestPanicChannel(t *testing.T) {
+	if New(testConfig()).(*cb).PanicChannel() != nil {
+		t.Fatal("panic channel exists although PanicChannelSize is not set")
+	}
+
+	cfg := testConfig()
+	cfg.PanicChannelSize = 1
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&panicServiceDesc, struct{}{})
+		return nil
+	}})
+	runTestServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the second panic is dropped as the channel is full, the call is not blocked
+	for i := 0; i < 2; i++ {
+		err := conn.Invoke(context.Background(), panicMethod, &emptypb.Empty{}, &emptypb.Empty{})
+		if status.Code(err) != codes.Internal {
+			t.Fatalf("call of a panicking handler returned %v, want the Internal error of the recovery interceptor", err)
+		}
+	}
+	select {
+	case e := <-c.PanicChannel():
+		if e.Method != panicMethod || e.Value != "boom" || len(e.Stack) == 0 || e.Time.IsZero() {
+			t.Errorf("panic event = %+v", e)
+		}
+	default:
+		t.Fatal("no panic event was delivered")
+	}
+	select {
+	case e := <-c.PanicChannel():
+		t.Errorf("panic event %+v was delivered although the channel was full", e)
+	default:
+	}
+}
@@ -0,0 +1,429 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-coldbrew/errors/notifier"
+	"github.com/go-coldbrew/log"
+	"github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/zipkin"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// PropagatorB3 is the Zipkin B3 multi header propagation format
+	PropagatorB3 = "b3"
+	// PropagatorTraceContext is the W3C tracecontext (traceparent/tracestate) propagation format
+	PropagatorTraceContext = "tracecontext"
+	// PropagatorBaggage is the W3C baggage propagation format, it is only supported by OpenTelemetry
+	PropagatorBaggage = "baggage"
+	// PropagatorXRay is the AWS X-Ray (X-Amzn-Trace-Id) propagation format
+	PropagatorXRay = "xray"
+)
+
+// defaultPropagators are used by the jaeger and OpenTelemetry tracers when no propagator is configured
+// so that traces started by Zipkin/Jaeger (B3) and by OpenTelemetry (traceparent) clients are both continued
+var defaultPropagators = []string{PropagatorB3, PropagatorTraceContext, PropagatorBaggage}
+
+var (
+	inboundMu sync.RWMutex
+	// inboundTextMap extracts the trace context of incoming requests, it is set up by SetupTracePropagators
+	inboundTextMap, _ = newTextMapPropagator(defaultPropagators)
+)
+
+// inboundPropagator returns the propagator extracting the trace context of incoming requests
+func inboundPropagator() propagation.TextMapPropagator {
+	inboundMu.RLock()
+	defer inboundMu.RUnlock()
+	return inboundTextMap
+}
+
+// SetupTracePropagators sets up the OpenTelemetry propagators
+// inbound are the formats used to extract the trace context from incoming requests
+// outbound are the formats used to inject the trace context into outgoing requests
+// Supported formats are b3, tracecontext (or w3c), baggage and xray, b3, tracecontext and baggage are used when empty
+func SetupTracePropagators(inbound, outbound []string) error {
+	if len(inbound) == 0 {
+		inbound = defaultPropagators
+	}
+	if len(outbound) == 0 {
+		outbound = defaultPropagators
+	}
+	in, err := newTextMapPropagator(inbound)
+	if err != nil {
+		log.Error(context.Background(), "msg", "could not setup inbound trace propagators", "err", err)
+		return err
+	}
+	out, err := newTextMapPropagator(outbound)
+	if err != nil {
+		log.Error(context.Background(), "msg", "could not setup outbound trace propagators", "err", err)
+		return err
+	}
+	inboundMu.Lock()
+	inboundTextMap = in
+	inboundMu.Unlock()
+	otel.SetTextMapPropagator(directionalPropagator{inbound: in, outbound: out})
+	return nil
+}
+
+// normalizePropagator returns the canonical name of a propagation format
+func normalizePropagator(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "w3c" {
+		return PropagatorTraceContext
+	}
+	return name
+}
+
+// newTextMapPropagator returns a composite OpenTelemetry propagator for the provided formats
+func newTextMapPropagator(names []string) (propagation.TextMapPropagator, error) {
+	propagators := make([]propagation.TextMapPropagator, 0, len(names))
+	for _, name := range names {
+		switch normalizePropagator(name) {
+		case "":
+			continue
+		case PropagatorB3:
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		case PropagatorTraceContext:
+			propagators = append(propagators, propagation.TraceContext{})
+		case PropagatorBaggage:
+			propagators = append(propagators, propagation.Baggage{})
+		case PropagatorXRay:
+			propagators = append(propagators, xray.Propagator{})
+		default:
+			return nil, fmt.Errorf("unknown trace propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+// directionalPropagator extracts with the inbound propagator and injects with the outbound propagator
+type directionalPropagator struct {
+	inbound  propagation.TextMapPropagator
+	outbound propagation.TextMapPropagator
+}
+
+func (d directionalPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	d.outbound.Inject(ctx, carrier)
+}
+
+func (d directionalPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return d.inbound.Extract(ctx, carrier)
+}
+
+func (d directionalPropagator) Fields() []string {
+	seen := make(map[string]struct{})
+	fields := make([]string, 0)
+	for _, f := range append(d.inbound.Fields(), d.outbound.Fields()...) {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// jaegerPropagators returns the jaeger injector and extractor for the provided formats
+// the extractor uses the first format that finds a trace context and the injector injects all of them
+func jaegerPropagators(inbound, outbound []string) (jaeger.Injector, jaeger.Extractor, error) {
+	if len(inbound) == 0 {
+		inbound = defaultPropagators
+	}
+	if len(outbound) == 0 {
+		outbound = defaultPropagators
+	}
+	injectors := compositeJaegerInjector{}
+	for _, name := range outbound {
+		p, err := jaegerPropagator(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p != nil {
+			injectors = append(injectors, p)
+		}
+	}
+	extractors := compositeJaegerExtractor{}
+	for _, name := range inbound {
+		p, err := jaegerPropagator(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p != nil {
+			extractors = append(extractors, p)
+		}
+	}
+	return injectors, extractors, nil
+}
+
+// jaegerPropagatorImpl is implemented by jaeger propagators supporting both directions
+type jaegerPropagatorImpl interface {
+	jaeger.Injector
+	jaeger.Extractor
+}
+
+// jaegerPropagator returns the jaeger propagator for the format, baggage is carried by the other formats in jaeger and is ignored
+func jaegerPropagator(name string) (jaegerPropagatorImpl, error) {
+	switch normalizePropagator(name) {
+	case "", PropagatorBaggage:
+		return nil, nil
+	case PropagatorB3:
+		return zipkin.NewZipkinB3HTTPHeaderPropagator(), nil
+	case PropagatorTraceContext:
+		return w3cJaegerPropagator{}, nil
+	case PropagatorXRay:
+		return xrayJaegerPropagator{}, nil
+	}
+	return nil, fmt.Errorf("unknown trace propagator %q", name)
+}
+
+// compositeJaegerInjector injects the span context using all injectors
+type compositeJaegerInjector []jaeger.Injector
+
+func (c compositeJaegerInjector) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	for _, i := range c {
+		if err := i.Inject(sc, carrier); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compositeJaegerExtractor returns the span context found by the first extractor that finds one
+type compositeJaegerExtractor []jaeger.Extractor
+
+func (c compositeJaegerExtractor) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	for _, e := range c {
+		sc, err := e.Extract(carrier)
+		if err == nil && sc.IsValid() {
+			return sc, nil
+		}
+	}
+	return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+}
+
+const traceparentHeader = "traceparent"
+
+// w3cJaegerPropagator implements W3C tracecontext propagation for the jaeger tracer
+// https://www.w3.org/TR/trace-context/#traceparent-header
+type w3cJaegerPropagator struct{}
+
+func (w3cJaegerPropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	flags := "00"
+	if sc.IsSampled() {
+		flags = "01"
+	}
+	tid := sc.TraceID()
+	writer.Set(traceparentHeader, fmt.Sprintf("00-%016x%016x-%016x-%s", tid.High, tid.Low, uint64(sc.SpanID()), flags))
+	return nil
+}
+
+func (w3cJaegerPropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+	traceparent := ""
+	err := reader.ForeachKey(func(key, val string) error {
+		if strings.ToLower(key) == traceparentHeader {
+			traceparent = val
+		}
+		return nil
+	})
+	if err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if traceparent == "" {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	traceID, err := jaeger.TraceIDFromString(parts[1])
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	spanID, err := jaeger.SpanIDFromString(parts[2])
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	return jaeger.NewSpanContext(traceID, spanID, 0, flags[0]&0x01 == 0x01, nil), nil
+}
+
+const xrayHeader = "X-Amzn-Trace-Id"
+
+// xrayJaegerPropagator implements AWS X-Ray propagation for the jaeger tracer
+// the header looks like Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1
+// https://docs.aws.amazon.com/xray/latest/devguide/xray-concepts.html#xray-concepts-tracingheader
+type xrayJaegerPropagator struct{}
+
+func (xrayJaegerPropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	tid := fmt.Sprintf("%016x%016x", sc.TraceID().High, sc.TraceID().Low)
+	writer.Set(xrayHeader, fmt.Sprintf("Root=1-%s-%s;Parent=%016x;Sampled=%s", tid[:8], tid[8:], uint64(sc.SpanID()), sampled))
+	return nil
+}
+
+func (xrayJaegerPropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+	header := ""
+	err := reader.ForeachKey(func(key, val string) error {
+		if strings.EqualFold(key, xrayHeader) {
+			header = val
+		}
+		return nil
+	})
+	if err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if header == "" {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+	var root, parent string
+	sampled := false
+	for _, part := range strings.Split(header, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "Root":
+			root = v
+		case "Parent":
+			parent = v
+		case "Sampled":
+			sampled = v == "1"
+		}
+	}
+	rootParts := strings.Split(root, "-")
+	if len(rootParts) != 3 || rootParts[0] != "1" || len(rootParts[1]) != 8 || len(rootParts[2]) != 24 || len(parent) != 16 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	traceID, err := jaeger.TraceIDFromString(rootParts[1] + rootParts[2])
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	spanID, err := jaeger.SpanIDFromString(parent)
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+	return jaeger.NewSpanContext(traceID, spanID, 0, sampled, nil), nil
+}
+
+// traceMetadataKeys are the metadata keys carrying trace context or baggage in the supported propagation formats
+var traceMetadataKeys = map[string]struct{}{
+	traceparentHeader: {},
+	"tracestate":      {},
+	"baggage":         {},
+	"uber-trace-id":   {},
+	"b3":              {},
+	"x-amzn-trace-id": {},
+}
+
+// traceMetadataPrefixes are the prefixes of metadata keys carrying trace context or baggage
+var traceMetadataPrefixes = []string{"x-b3-", "uberctx-", "ot-baggage-", "ot-tracer-"}
+
+// TracePropagationDialOptions returns the dial options removing trace context and baggage from calls to targets
+// targets are host or host:port values matched against the target of the client connection,
+// the options must be used after the coldbrew client interceptors which inject the trace context
+// e.g. grpc.NewClient(target, append([]grpc.DialOption{grpc.WithUnaryInterceptor(interceptors.DefaultClientInterceptor())}, core.TracePropagationDialOptions(targets...)...)...)
+func TracePropagationDialOptions(targets ...string) []grpc.DialOption {
+	var suppressed []string
+	for _, t := range targets {
+		if t = strings.TrimSpace(t); t != "" {
+			suppressed = append(suppressed, t)
+		}
+	}
+	if len(suppressed) == 0 {
+		return nil
+	}
+	targets = suppressed
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if isSuppressedTarget(cc.Target(), targets) {
+				ctx = withoutTraceMetadata(ctx)
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			if isSuppressedTarget(cc.Target(), targets) {
+				ctx = withoutTraceMetadata(ctx)
+			}
+			return streamer(ctx, desc, cc, method, opts...)
+		}),
+	}
+}
+
+// isSuppressedTarget reports whether the target of a client connection matches one of targets, by host or host:port
+func isSuppressedTarget(target string, targets []string) bool {
+	if i := strings.Index(target, ":///"); i >= 0 {
+		// strip the resolver scheme, e.g. dns:///
+		target = target[i+len(":///"):]
+	}
+	for _, t := range targets {
+		if target == t || strings.HasPrefix(target, t+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutTraceMetadata returns a context whose outgoing metadata does not carry trace context or baggage
+func withoutTraceMetadata(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	md = md.Copy()
+	traceHeader := strings.ToLower(notifier.GetTraceHeaderName())
+	for k := range md {
+		if isTraceMetadataKey(k) || k == traceHeader {
+			delete(md, k)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// isTraceMetadataKey reports whether the metadata key carries trace context or baggage
+func isTraceMetadataKey(key string) bool {
+	if _, ok := traceMetadataKeys[key]; ok {
+		return true
+	}
+	for _, p := range traceMetadataPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	for _, f := range otel.GetTextMapPropagator().Fields() {
+		if strings.EqualFold(key, f) {
+			return true
+		}
+	}
+	return false
+}
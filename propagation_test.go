@@ -0,0 +1,258 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	otelBridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracePropagationSuppressedTargets(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan metadata.MD, 1)
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		received <- md
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+	port := lis.Addr().(*net.TCPAddr).Port
+
+	cfg := testConfig()
+	cfg.TracePropagationSuppressedTargets = []string{"localhost"}
+	c := newTestCB(t, cfg)
+	// stands for the coldbrew client interceptors injecting the trace context
+	inject := grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, "traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "x-request", "kept"), method, req, reply, cc, opts...)
+	})
+
+	for _, tc := range []struct {
+		host       string
+		suppressed bool
+	}{
+		{host: "127.0.0.1"},
+		{host: "localhost", suppressed: true},
+	} {
+		target := net.JoinHostPort(tc.host, strconv.Itoa(port))
+		conn, err := grpc.NewClient(target, append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), inject}, c.TracePropagationDialOptions()...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		md := <-received
+		if got := len(md.Get("traceparent")) > 0; got == tc.suppressed {
+			t.Errorf("%s: traceparent sent = %v, want %v", target, got, !tc.suppressed)
+		}
+		if len(md.Get("x-request")) == 0 {
+			t.Errorf("%s: metadata unrelated to tracing was removed", target)
+		}
+	}
+}
+
+// incomingTraceparent is the trace context sent by the client in the tracingWrapper tests
+const incomingTraceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+// setupTestTracing sets up the global tracers like SetupOpenTelemetryExporters does for mode, tracingBridge or tracingNative
+// the spans are exported synchronously to the returned exporter, with the values of the redact attributes redacted
+func setupTestTracing(t *testing.T, mode tracingMode, redact ...string) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(newRedactingExporter(exporter, redact)))
+	prevProvider, prevTracer := otel.GetTracerProvider(), opentracing.GlobalTracer()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		opentracing.SetGlobalTracer(prevTracer)
+		SetupTracePropagators(nil, nil)
+	})
+	if mode == tracingNative {
+		otel.SetTracerProvider(provider)
+	} else {
+		bridgeTracer, wrapperProvider := otelBridge.NewTracerPair(provider.Tracer(""))
+		otel.SetTracerProvider(wrapperProvider)
+		opentracing.SetGlobalTracer(bridgeTracer)
+	}
+	return exporter
+}
+
+func TestTracingWrapperExtractsInboundTraceContext(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    tracingMode
+		inbound []string
+		joins   bool
+	}{
+		{name: "bridge", mode: tracingBridge, joins: true},
+		{name: "native", mode: tracingNative, joins: true},
+		{name: "bridge without tracecontext inbound", mode: tracingBridge, inbound: []string{PropagatorB3}},
+		{name: "native without tracecontext inbound", mode: tracingNative, inbound: []string{PropagatorB3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter := setupTestTracing(t, tc.mode)
+			if err := SetupTracePropagators(tc.inbound, nil); err != nil {
+				t.Fatal(err)
+			}
+			c := &cb{tracing: tc.mode}
+			var handlerSpan trace.SpanContext
+			h := c.tracingWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerSpan = trace.SpanContextFromContext(r.Context())
+				if tc.mode == tracingBridge && opentracing.SpanFromContext(r.Context()) == nil {
+					t.Error("the OpenTracing span of the request is missing from the context")
+				}
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/v1/example", nil)
+			req.Header.Set("traceparent", incomingTraceparent)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			span := spans[0]
+			if span.SpanContext.SpanID() != handlerSpan.SpanID() {
+				t.Errorf("the handler saw span %s, want the request span %s", handlerSpan.SpanID(), span.SpanContext.SpanID())
+			}
+			joined := span.SpanContext.TraceID().String() == "0af7651916cd43dd8448eb211c80319c" &&
+				span.Parent.SpanID().String() == "b7ad6b7169203331"
+			if joined != tc.joins {
+				t.Errorf("span joined the incoming trace: %v, want %v (trace %s, parent %s)", joined, tc.joins, span.SpanContext.TraceID(), span.Parent.SpanID())
+			}
+			if span.SpanKind != trace.SpanKindServer {
+				t.Errorf("span kind is %s, want server", span.SpanKind)
+			}
+		})
+	}
+}
+
+func TestDirectionalPropagatorFieldsAreUnique(t *testing.T) {
+	d := directionalPropagator{
+		inbound:  propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		outbound: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}),
+	}
+	seen := map[string]bool{}
+	for _, f := range d.Fields() {
+		if seen[f] {
+			t.Fatalf("field %s is listed twice in %v", f, d.Fields())
+		}
+		seen[f] = true
+	}
+	if !seen["traceparent"] || !seen["baggage"] {
+		t.Fatalf("fields %v miss traceparent or baggage", d.Fields())
+	}
+}
+
+func TestSetupTracePropagatorsRejectsUnknownFormat(t *testing.T) {
+	if err := SetupTracePropagators([]string{"unknown"}, nil); err == nil {
+		t.Fatal("unknown propagation format was accepted")
+	}
+	cfg := testConfig()
+	cfg.TracePropagatorsInbound = []string{"unknown"}
+	if c := newTestCB(t, cfg); c.setupErr == nil {
+		t.Fatal("New accepted an unknown propagation format")
+	}
+}
+
+func TestDirectionalPropagatorSplitsDirections(t *testing.T) {
+	inbound, err := newTextMapPropagator([]string{PropagatorB3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := newTextMapPropagator([]string{PropagatorTraceContext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := directionalPropagator{inbound: inbound, outbound: outbound}
+
+	// a traceparent header is not extracted when only b3 is accepted inbound
+	ctx := d.Extract(context.Background(), propagation.HeaderCarrier{"Traceparent": []string{incomingTraceparent}})
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("trace context extracted with the outbound propagator")
+	}
+	ctx = d.Extract(context.Background(), propagation.HeaderCarrier{"B3": []string{"0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1"}})
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatalf("b3 trace context was not extracted, got %v", sc.TraceID())
+	}
+
+	carrier := propagation.HeaderCarrier{}
+	d.Inject(trace.ContextWithRemoteSpanContext(context.Background(), sc), carrier)
+	if carrier.Get("traceparent") == "" || carrier.Get("x-b3-traceid") != "" {
+		t.Fatalf("injected %v, want only the outbound traceparent", carrier)
+	}
+}
+
+func TestXRayJaegerPropagator(t *testing.T) {
+	const header = "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+	p, err := jaegerPropagator(PropagatorXRay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := p.Extract(opentracing.TextMapCarrier{"x-amzn-trace-id": header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sc.TraceID().String(); got != "5759e988bd862e3fe1be46a994272793" {
+		t.Errorf("trace id = %s", got)
+	}
+	if got := sc.SpanID().String(); got != "53995c3f42cd8ad8" {
+		t.Errorf("span id = %s", got)
+	}
+	if !sc.IsSampled() {
+		t.Error("sampled flag was not extracted")
+	}
+
+	out := opentracing.TextMapCarrier{}
+	if err := p.Inject(sc, out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out[xrayHeader]; got != header {
+		t.Errorf("injected %s = %q, want %q", xrayHeader, got, header)
+	}
+
+	for value, want := range map[string]error{
+		"": opentracing.ErrSpanContextNotFound,
+		"Root=1-5759e988-bd862e3f;Parent=53995c3f42cd8ad8": opentracing.ErrSpanContextCorrupted,
+		"Root=1-5759e988-bd862e3fe1be46a994272793":         opentracing.ErrSpanContextCorrupted,
+	} {
+		carrier := opentracing.TextMapCarrier{}
+		if value != "" {
+			carrier[xrayHeader] = value
+		}
+		if _, err := p.Extract(carrier); err != want {
+			t.Errorf("extracting %q returned %v, want %v", value, err, want)
+		}
+	}
+}
+
+func TestXRayTextMapPropagator(t *testing.T) {
+	p, err := newTextMapPropagator([]string{PropagatorXRay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := p.Extract(context.Background(), propagation.HeaderCarrier{xrayHeader: []string{"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"}})
+	sc := trace.SpanContextFromContext(ctx)
+	if got := sc.TraceID().String(); got != "5759e988bd862e3fe1be46a994272793" || !sc.IsSampled() {
+		t.Errorf("extracted trace %s sampled %v from the X-Ray header", got, sc.IsSampled())
+	}
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// readinessCheck is a named check that has to pass for the service to be ready
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks returns the checks evaluated by the readiness endpoint
+func (c *cb) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "shutdown", check: c.checkShutdown},
+		{name: "health", check: c.health.check},
+	}
+	checks = append(checks, c.warmupChecks()...)
+	for _, d := range c.dependencies {
+		checks = append(checks, readinessCheck{
+			name:  "dependency " + d.target,
+			check: d.check,
+		})
+	}
+	return checks
+}
+
+// warmupChecks returns a check for every service implementing CBWarmup
+func (c *cb) warmupChecks() []readinessCheck {
+	var checks []readinessCheck
+	for _, svc := range c.svc {
+		if w, ok := svc.(CBWarmup); ok {
+			checks = append(checks, readinessCheck{
+				name:  fmt.Sprintf("warmup %T", svc),
+				check: checkWarmup(w),
+			})
+		}
+	}
+	return checks
+}
+
+// checkShutdown fails once Stop has been called
+func (c *cb) checkShutdown(context.Context) error {
+	if c.shuttingDown.Load() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// checkWarmup returns a check that fails until the warmup of the service is complete
+func checkWarmup(w CBWarmup) func(context.Context) error {
+	return func(context.Context) error {
+		select {
+		case <-w.Warmed():
+			return nil
+		default:
+			return errors.New("warmup in progress")
+		}
+	}
+}
+
+// readinessResult is the outcome of a readiness check
+type readinessResult struct {
+	name string
+	err  error
+}
+
+// ready runs all readiness checks and reports whether they all passed
+func (c *cb) ready(ctx context.Context) ([]readinessResult, bool) {
+	checks := c.readinessChecks()
+	results := make([]readinessResult, 0, len(checks))
+	ok := true
+	for _, rc := range checks {
+		err := rc.check(ctx)
+		if err != nil {
+			ok = false
+		}
+		results = append(results, readinessResult{name: rc.name, err: err})
+	}
+	return results, ok
+}
+
+// readyzHandler serves the readiness state, 200 when ready and 503 otherwise
+// the body lists the checks in the Kubernetes verbose format ([+]name ok / [-]name failed: reason),
+// failing checks are always listed and passing ones only with ?verbose
+func (c *cb) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	results, ok := c.ready(r.Context())
+	writeCheckResults(w, r, "readyz", results, ok)
+}
+
+// startupChecks returns the checks evaluated by the startup endpoint
+func (c *cb) startupChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "initialized", check: c.checkInitialized},
+	}
+	checks = append(checks, c.warmupChecks()...)
+	return checks
+}
+
+// checkInitialized fails until Run has initialized and started the servers
+func (c *cb) checkInitialized(context.Context) error {
+	if !c.initialized.Load() {
+		return errors.New("initialization in progress")
+	}
+	return nil
+}
+
+// startupzHandler serves the startup state, 503 until the servers are initialized and all warmups are complete
+// and 200 from then on, runtime health is left to /readyz, the body has the same format as /readyz
+func (c *cb) startupzHandler(w http.ResponseWriter, r *http.Request) {
+	if c.started.Load() {
+		writeCheckResults(w, r, "startupz", nil, true)
+		return
+	}
+	checks := c.startupChecks()
+	results := make([]readinessResult, 0, len(checks))
+	ok := true
+	for _, sc := range checks {
+		err := sc.check(r.Context())
+		if err != nil {
+			ok = false
+		}
+		results = append(results, readinessResult{name: sc.name, err: err})
+	}
+	if ok {
+		c.started.Store(true)
+	}
+	writeCheckResults(w, r, "startupz", results, ok)
+}
+
+// writeCheckResults writes the results of the checks of endpoint, 200 when ok and 503 otherwise
+func writeCheckResults(w http.ResponseWriter, r *http.Request, endpoint string, results []readinessResult, ok bool) {
+	_, verbose := r.URL.Query()["verbose"]
+	var b strings.Builder
+	for _, res := range results {
+		if res.err != nil {
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", res.name, res.err)
+		} else if verbose {
+			fmt.Fprintf(&b, "[+]%s ok\n", res.name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(&b, "%s check failed\n", endpoint)
+		w.Write([]byte(b.String()))
+		return
+	}
+	if verbose {
+		fmt.Fprintf(&b, "%s check passed\n", endpoint)
+		w.Write([]byte(b.String()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
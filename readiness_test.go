@@ -0,0 +1,286 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// warmupService is a testService implementing CBWarmup, it is warmed once warmed is closed
+type warmupService struct {
+	testService
+	warmed chan struct{}
+}
+
+func (s *warmupService) Warmed() <-chan struct{} {
+	return s.warmed
+}
+
+// getReadyz returns the status code and body of /readyz
+func getReadyz(t *testing.T, c *cb) (int, string) {
+	t.Helper()
+	return getProbe(t, c, "/readyz")
+}
+
+// getProbe returns the status code and body of the probe endpoint at path
+func getProbe(t *testing.T, c *cb, path string) (int, string) {
+	t.Helper()
+	resp, err := http.Get("http://" + c.httpAddr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestReadyzGatedOnWarmup(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	svc := &warmupService{warmed: make(chan struct{})}
+	c.SetService(svc)
+	runTestServer(t, c)
+
+	if code, body := getReadyz(t, c); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]warmup") {
+		t.Fatalf("/readyz returned %d %q while the service is warming up", code, body)
+	}
+	close(svc.warmed)
+	if code, body := getReadyz(t, c); code != http.StatusOK {
+		t.Fatalf("/readyz returned %d %q once the service is warmed up", code, body)
+	}
+	// stands for Stop having been called, the servers keep serving until they drain
+	c.shuttingDown.Store(true)
+	if code, body := getReadyz(t, c); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]shutdown") {
+		t.Fatalf("/readyz returned %d %q once shutdown started", code, body)
+	}
+}
+
+func TestReadyzDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.DisableReadyz = true
+	c := newTestCB(t, cfg)
+	c.SetService(&warmupService{warmed: make(chan struct{})})
+	runTestServer(t, c)
+
+	if code, _ := getReadyz(t, c); code == http.StatusServiceUnavailable || code == http.StatusOK {
+		t.Fatalf("/readyz returned %d although it is disabled", code)
+	}
+}
+
+func TestReadyzGatedOnDependencies(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dependency := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("orders.Orders", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(dependency, healthServer)
+	go dependency.Serve(lis)
+	defer dependency.Stop()
+
+	cfg := testConfig()
+	cfg.DependencyHealthTargets = []string{lis.Addr().String() + "/orders.Orders"}
+	cfg.DependencyHealthIntervalSeconds = 1
+	c := newTestCB(t, cfg)
+	runTestServer(t, c)
+
+	// waitReadyz polls /readyz until it returns code, dependencies are checked every interval
+	waitReadyz := func(code int, contains string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, body := getReadyz(t, c)
+			if got == code && strings.Contains(body, contains) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("/readyz returned %d %q, want %d containing %q", got, body, code, contains)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitReadyz(http.StatusServiceUnavailable, "[-]dependency "+cfg.DependencyHealthTargets[0]+" failed: status NOT_SERVING")
+	healthServer.SetServingStatus("orders.Orders", healthpb.HealthCheckResponse_SERVING)
+	waitReadyz(http.StatusOK, "")
+}
+
+func TestHealthManagerSharedWithReadyz(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	c.SetService(&testService{})
+	runTestServer(t, c)
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	grpcStatus := func() healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetStatus()
+	}
+
+	if s := grpcStatus(); s != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("gRPC health = %v once started", s)
+	}
+	c.Health().SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	if s := grpcStatus(); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("gRPC health = %v after the status was set to NOT_SERVING", s)
+	}
+	if code, body := getReadyz(t, c); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]health failed: status NOT_SERVING") {
+		t.Errorf("/readyz returned %d %q while the server is NOT_SERVING", code, body)
+	}
+	c.Health().SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if code, body := getReadyz(t, c); code != http.StatusOK {
+		t.Errorf("/readyz returned %d %q once the server is SERVING again", code, body)
+	}
+
+	// shutdown sets every service NOT_SERVING and ignores later updates
+	c.health.shutdown()
+	c.Health().SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	if s := c.Health().Status(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("status = %v after shutdown", s)
+	}
+}
+
+func TestStartupz(t *testing.T) {
+	c := &cb{config: testConfig()}
+	rec := httptest.NewRecorder()
+	c.startupzHandler(rec, httptest.NewRequest(http.MethodGet, "/startupz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "[-]initialized failed") {
+		t.Errorf("/startupz returned %d %q before the servers were initialized", rec.Code, rec.Body.String())
+	}
+
+	c = newTestCB(t, testConfig())
+	svc := &warmupService{warmed: make(chan struct{})}
+	c.SetService(svc)
+	runTestServer(t, c)
+
+	if code, body := getProbe(t, c, "/startupz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]warmup") {
+		t.Fatalf("/startupz returned %d %q while the service is warming up", code, body)
+	}
+	close(svc.warmed)
+	if code, body := getProbe(t, c, "/startupz?verbose"); code != http.StatusOK || !strings.Contains(body, "[+]initialized ok") {
+		t.Fatalf("/startupz returned %d %q once the service is warmed up", code, body)
+	}
+	// runtime health is left to /readyz, once started the service stays started
+	c.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	c.shuttingDown.Store(true)
+	if code, body := getProbe(t, c, "/startupz"); code != http.StatusOK {
+		t.Fatalf("/startupz returned %d %q for a started service that is not ready", code, body)
+	}
+	if code, _ := getReadyz(t, c); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz returned %d for a service that is shutting down", code)
+	}
+}
+
+func TestStartupzDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.DisableStartupz = true
+	c := newTestCB(t, cfg)
+	runTestServer(t, c)
+
+	if code, _ := getProbe(t, c, "/startupz"); code == http.StatusOK || code == http.StatusServiceUnavailable {
+		t.Fatalf("/startupz returned %d although it is disabled", code)
+	}
+}
+
+// healthReporterService is a testService implementing CBHealthReporter
+type healthReporterService struct {
+	testService
+	health *HealthManager
+}
+
+func (s *healthReporterService) SetHealth(h *HealthManager) {
+	s.health = h
+}
+
+func TestGRPCHealthPerService(t *testing.T) {
+	echoService := echoServiceDesc.ServiceName
+	check := func(t *testing.T, c *cb, service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		t.Helper()
+		conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		return resp.GetStatus(), err
+	}
+
+	t.Run("registered services are serving", func(t *testing.T) {
+		c := newTestCB(t, testConfig())
+		runEchoServer(t, c)
+		if s, err := check(t, c, echoService); err != nil || s != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("health of %s = %v, %v, want SERVING", echoService, s, err)
+		}
+		if _, err := check(t, c, "coldbrew.test.Missing"); status.Code(err) != codes.NotFound {
+			t.Errorf("health of an unregistered service returned %v, want NotFound", err)
+		}
+	})
+
+	t.Run("reported status is kept", func(t *testing.T) {
+		c := newTestCB(t, testConfig())
+		svc := &healthReporterService{}
+		svc.initGRPC = func(ctx context.Context, server *grpc.Server) error {
+			if svc.health == nil {
+				return errors.New("SetHealth was not called before InitGRPC")
+			}
+			svc.health.SetServingStatus(echoService, healthpb.HealthCheckResponse_NOT_SERVING)
+			server.RegisterService(&echoServiceDesc, &echoServer{})
+			return nil
+		}
+		c.SetService(svc)
+		runTestServer(t, c)
+		if s, err := check(t, c, echoService); err != nil || s != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("health of %s = %v, %v, want the NOT_SERVING set by the service", echoService, s, err)
+		}
+		svc.health.SetServingStatus(echoService, healthpb.HealthCheckResponse_SERVING)
+		if s, err := check(t, c, echoService); err != nil || s != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("health of %s = %v, %v after the service set it SERVING", echoService, s, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.DisableGRPCHealth = true
+		c := newTestCB(t, cfg)
+		runEchoServer(t, c)
+		if _, err := check(t, c, ""); status.Code(err) != codes.Unimplemented {
+			t.Errorf("health check returned %v although the health service is disabled, want Unimplemented", err)
+		}
+	})
+
+	t.Run("registered by a service", func(t *testing.T) {
+		c := newTestCB(t, testConfig())
+		own := health.NewServer()
+		own.SetServingStatus("", healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+		c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+			healthpb.RegisterHealthServer(server, own)
+			return nil
+		}})
+		runTestServer(t, c)
+		if s, err := check(t, c, ""); err != nil || s != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+			t.Errorf("health check = %v, %v, want the answer of the health service registered by the service", s, err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// redactValue replaces a value with a short hash, so that equal values can still be correlated
+func redactValue(value interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+	return "redacted:" + hex.EncodeToString(sum[:8])
+}
+
+// redactKeys is a set of lower cased keys to redact
+type redactKeys map[string]struct{}
+
+func newRedactKeys(keys []string) redactKeys {
+	r := make(redactKeys, len(keys))
+	for _, k := range keys {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			r[k] = struct{}{}
+		}
+	}
+	return r
+}
+
+func (r redactKeys) has(key string) bool {
+	_, ok := r[strings.ToLower(key)]
+	return ok
+}
+
+// redactingTracer wraps a tracer and redacts the values of the configured tags on all spans it creates
+type redactingTracer struct {
+	opentracing.Tracer
+	keys redactKeys
+}
+
+// newRedactingTracer returns tracer wrapped so that the values of tags in keys are redacted
+// tracer is returned as is when keys is empty
+func newRedactingTracer(tracer opentracing.Tracer, keys []string) opentracing.Tracer {
+	rk := newRedactKeys(keys)
+	if len(rk) == 0 {
+		return tracer
+	}
+	return &redactingTracer{Tracer: tracer, keys: rk}
+}
+
+func (t *redactingTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sso := opentracing.StartSpanOptions{}
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	for k, v := range sso.Tags {
+		if t.keys.has(k) {
+			sso.Tags[k] = redactValue(v)
+		}
+	}
+	span := t.Tracer.StartSpan(operationName, startSpanOptions(sso))
+	return &redactingSpan{Span: span, tracer: t}
+}
+
+// ContextWithSpanHook forwards the hook to the wrapped tracer (e.g. the OpenTelemetry bridge) with the wrapped span
+func (t *redactingTracer) ContextWithSpanHook(ctx context.Context, span opentracing.Span) context.Context {
+	if rs, ok := span.(*redactingSpan); ok {
+		span = rs.Span
+	}
+	if h, ok := t.Tracer.(opentracing.TracerContextWithSpanExtension); ok {
+		return h.ContextWithSpanHook(ctx, span)
+	}
+	return ctx
+}
+
+// startSpanOptions applies already resolved start span options
+type startSpanOptions opentracing.StartSpanOptions
+
+func (s startSpanOptions) Apply(o *opentracing.StartSpanOptions) {
+	*o = opentracing.StartSpanOptions(s)
+}
+
+// redactingSpan redacts the values of the configured tags set after the span is started
+type redactingSpan struct {
+	opentracing.Span
+	tracer *redactingTracer
+}
+
+func (s *redactingSpan) SetTag(key string, value interface{}) opentracing.Span {
+	if s.tracer.keys.has(key) {
+		value = redactValue(value)
+	}
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s *redactingSpan) SetOperationName(operationName string) opentracing.Span {
+	s.Span.SetOperationName(operationName)
+	return s
+}
+
+func (s *redactingSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.Span.SetBaggageItem(restrictedKey, value)
+	return s
+}
+
+func (s *redactingSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+// redactingExporter redacts the values of the configured attributes of the spans before they are exported
+// it covers the OpenTelemetry spans whatever set their attributes, e.g. otelhttp, otelgrpc or the OpenTracing bridge
+type redactingExporter struct {
+	sdktrace.SpanExporter
+	keys redactKeys
+}
+
+// newRedactingExporter returns exporter wrapped so that the values of attributes in keys are redacted
+func newRedactingExporter(exporter sdktrace.SpanExporter, keys []string) sdktrace.SpanExporter {
+	rk := newRedactKeys(keys)
+	if len(rk) == 0 {
+		return exporter
+	}
+	return &redactingExporter{SpanExporter: exporter, keys: rk}
+}
+
+func (e *redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	redacted := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		redacted[i] = e.redact(s)
+	}
+	return e.SpanExporter.ExportSpans(ctx, redacted)
+}
+
+// redact returns the span with the values of the configured attributes redacted, spans without them are returned as is
+func (e *redactingExporter) redact(s sdktrace.ReadOnlySpan) sdktrace.ReadOnlySpan {
+	var attrs []attribute.KeyValue
+	for i, kv := range s.Attributes() {
+		if !e.keys.has(string(kv.Key)) {
+			continue
+		}
+		if attrs == nil {
+			attrs = append([]attribute.KeyValue(nil), s.Attributes()...)
+		}
+		attrs[i] = attribute.String(string(kv.Key), redactValue(kv.Value.Emit()))
+	}
+	if attrs == nil {
+		return s
+	}
+	return redactedSpan{ReadOnlySpan: s, attributes: attrs}
+}
+
+// redactedSpan is an ended span whose attributes were redacted
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	attributes []attribute.KeyValue
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return s.attributes
+}
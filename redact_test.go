@@ -0,0 +1,42 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestRedactingTracer(t *testing.T) {
+	mock := mocktracer.New()
+	tracer := newRedactingTracer(mock, []string{" HTTP.URL ", ""})
+
+	span := tracer.StartSpan("op", opentracing.Tag{Key: "http.url", Value: "/v1/users/secret"}, opentracing.Tag{Key: "http.method", Value: "GET"})
+	span.SetTag("Http.Url", "/v1/users/secret")
+	span.SetTag("component", "coldbrew")
+	if span.Tracer() != tracer {
+		t.Error("span started by the redacting tracer does not report it as its tracer")
+	}
+	span.Finish()
+
+	finished := mock.FinishedSpans()
+	if len(finished) != 1 {
+		t.Fatalf("finished %d spans, want 1", len(finished))
+	}
+	tags := finished[0].Tags()
+	redacted, ok := tags["http.url"].(string)
+	if !ok || !strings.HasPrefix(redacted, "redacted:") || strings.Contains(redacted, "secret") {
+		t.Errorf("http.url start tag = %v, want it redacted", tags["http.url"])
+	}
+	if got := tags["Http.Url"]; got != redacted {
+		t.Errorf("tag set after start = %v, want the same hash %q for the same value", got, redacted)
+	}
+	if tags["http.method"] != "GET" || tags["component"] != "coldbrew" {
+		t.Errorf("tags not configured for redaction were changed: %v", tags)
+	}
+
+	if newRedactingTracer(mock, []string{" "}) != opentracing.Tracer(mock) {
+		t.Error("tracer was wrapped although no key is configured")
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-coldbrew/log"
+)
+
+// listenFDsEnv lists the addresses of the listeners passed to a restarted process, in the order of their file descriptors
+// the first listener is file descriptor 3, the ones before are stdin, stdout and stderr
+const listenFDsEnv = "COLDBREW_LISTEN_FDS"
+
+// firstListenFD is the file descriptor of the first inherited listener
+const firstListenFD = 3
+
+// restartListeners tracks the listeners of a cb so that they can be passed to a new process on a graceful restart
+type restartListeners struct {
+	mu sync.Mutex
+	// inherited are the listeners passed by the parent process that have not been adopted yet, keyed by address
+	inherited map[string]net.Listener
+	// active are the listeners in use, keyed by address, they are passed to the new process on a graceful restart
+	active map[string]*net.TCPListener
+}
+
+// newRestartListeners returns an empty set of listeners, the inherited ones are loaded on first use
+func newRestartListeners() *restartListeners {
+	return &restartListeners{
+		active: map[string]*net.TCPListener{},
+	}
+}
+
+// load loads the listeners passed in listenFDsEnv, mu must be held
+func (r *restartListeners) load() {
+	if r.inherited != nil {
+		return
+	}
+	r.inherited = map[string]net.Listener{}
+	env := os.Getenv(listenFDsEnv)
+	if env == "" {
+		return
+	}
+	// children of this process must not inherit the listeners through the environment
+	os.Unsetenv(listenFDsEnv)
+	for i, addr := range strings.Split(env, ",") {
+		f := os.NewFile(uintptr(firstListenFD+i), addr)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Error(context.Background(), "msg", "could not use inherited listener", "address", addr, "err", err)
+			continue
+		}
+		log.Info(context.Background(), "msg", "using inherited listener", "address", addr)
+		r.inherited[addr] = lis
+	}
+}
+
+// adopt returns the listener inherited for addr and tracks it as active, nil if there is none
+func (r *restartListeners) adopt(addr string) net.Listener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+	lis, ok := r.inherited[addr]
+	if !ok {
+		return nil
+	}
+	delete(r.inherited, addr)
+	r.trackLocked(addr, lis)
+	return lis
+}
+
+// track records lis as the active listener for addr
+func (r *restartListeners) track(addr string, lis net.Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trackLocked(addr, lis)
+}
+
+// trackLocked records lis as the active listener for addr, mu must be held
+func (r *restartListeners) trackLocked(addr string, lis net.Listener) {
+	if tl, ok := lis.(*net.TCPListener); ok {
+		r.active[addr] = tl
+	}
+}
+
+// closeUnused closes the inherited listeners that were not adopted, e.g. after a port change
+// connections accepted by the kernel on them would otherwise never be served
+func (r *restartListeners) closeUnused() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+	for addr, lis := range r.inherited {
+		log.Info(context.Background(), "msg", "closing unused inherited listener", "address", addr)
+		lis.Close()
+		delete(r.inherited, addr)
+	}
+}
+
+// startNewProcess starts a copy of the current process with the same arguments and environment
+// passing it the active listeners, connections keep being accepted on them while this process drains
+func (r *restartListeners) startNewProcess() (*os.Process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// makes sure listenFDsEnv is no longer set before the environment is copied
+	r.load()
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	addrs := make([]string, 0, len(r.active))
+	for addr, lis := range r.active {
+		// File returns a duplicate of the descriptor, it stays valid after the listener is closed
+		f, err := lis.File()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", addr, err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, addr)
+	}
+	env := append(os.Environ(), listenFDsEnv+"="+strings.Join(addrs, ","))
+	return os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+}
+
+// restartWatcher starts a new process on SIGHUP and stops this one gracefully once it is started
+// it returns when ctx is done, Stop cancels it
+func restartWatcher(ctx context.Context, c *cb, dur time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+		if c.shuttingDown.Load() {
+			log.Info(ctx, "msg", "graceful restart: shutdown already in progress")
+			return
+		}
+		p, err := c.listeners.startNewProcess()
+		if err != nil {
+			log.Error(ctx, "msg", "graceful restart: could not start new process", "err", err)
+			continue
+		}
+		log.Info(ctx, "msg", "graceful restart: new process started, shutting down", "pid", p.Pid)
+		err = c.Stop(dur)
+		log.Info(ctx, "msg", "graceful restart: shutdown completed", "err", err)
+		return
+	}
+}
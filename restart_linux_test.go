@@ -0,0 +1,122 @@
+//go:build linux
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restartHelperEnv makes the test binary run TestRestartListenersHelper as the restarted process
+const restartHelperEnv = "COLDBREW_TEST_RESTART_HELPER"
+
+// TestRestartListenersHelper is the restarted process of TestRestartListenersInherited
+// it adopts the first inherited listener, closes the other one and answers a single connection
+func TestRestartListenersHelper(t *testing.T) {
+	addr := os.Getenv(restartHelperEnv)
+	if addr == "" {
+		t.Skip("only runs as the restarted process")
+	}
+	r := newRestartListeners()
+	lis := r.adopt(addr)
+	if lis == nil {
+		t.Fatalf("listener %s was not inherited", addr)
+	}
+	r.closeUnused()
+	lis.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	os.Stdout.WriteString("ready\n")
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("adopted\n"))
+	conn.Close()
+}
+
+func TestRestartListenersInherited(t *testing.T) {
+	adopted, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*os.File
+	var addrs []string
+	for _, lis := range []net.Listener{adopted, unused} {
+		f, err := lis.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, lis.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestartListenersHelper$")
+	cmd.Env = append(os.Environ(), restartHelperEnv+"="+addrs[0], listenFDsEnv+"="+strings.Join(addrs, ","))
+	// ExtraFiles start at file descriptor 3 like the listeners passed by startNewProcess
+	cmd.ExtraFiles = files
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	// only the restarted process holds the listeners from now on
+	adopted.Close()
+	unused.Close()
+	for _, f := range files {
+		f.Close()
+	}
+	// the logs of the restarted process are written to stdout as well
+	lines := bufio.NewScanner(out)
+	for lines.Scan() && lines.Text() != "ready" {
+	}
+	if lines.Text() != "ready" {
+		t.Fatal("restarted process did not adopt the listener")
+	}
+
+	if conn, err := net.DialTimeout("tcp", addrs[1], time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("unused inherited listener %s is still accepting connections", addrs[1])
+	}
+	conn, err := net.DialTimeout("tcp", addrs[0], time.Second)
+	if err != nil {
+		t.Fatalf("adopted listener %s is not accepting connections: %v", addrs[0], err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "adopted\n" {
+		t.Fatalf("unexpected reply from the adopted listener: %q, %v", reply, err)
+	}
+}
+
+func TestRestartWatcherStoppedByStop(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopRestartWatcher = cancel
+	go func() {
+		restartWatcher(ctx, c, time.Millisecond)
+		close(done)
+	}()
+	c.Stop(time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("restart watcher is still running after Stop")
+	}
+}
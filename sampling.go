@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// adjustableSampler is an OpenTelemetry sampler whose ratio can be temporarily overridden at runtime
+type adjustableSampler struct {
+	mu            sync.RWMutex
+	base          sdktrace.Sampler
+	baseRatio     float64
+	current       sdktrace.Sampler
+	currentRatio  float64
+	overrideUntil time.Time
+	revert        *time.Timer
+	// generation identifies the current override so that a stale revert timer does not end a newer override
+	generation uint64
+}
+
+// newAdjustableSampler returns a parent based sampler sampling ratio of the root spans
+func newAdjustableSampler(ratio float64) *adjustableSampler {
+	base := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	return &adjustableSampler{
+		base:         base,
+		baseRatio:    ratio,
+		current:      base,
+		currentRatio: ratio,
+	}
+}
+
+func (s *adjustableSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	s.mu.RLock()
+	current := s.current
+	s.mu.RUnlock()
+	return current.ShouldSample(p)
+}
+
+func (s *adjustableSampler) Description() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fmt.Sprintf("AdjustableSampler{%s}", s.current.Description())
+}
+
+// override samples ratio of the root spans for d, after which the configured ratio is restored
+func (s *adjustableSampler) override(ratio float64, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revert != nil {
+		s.revert.Stop()
+	}
+	s.current = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	s.currentRatio = ratio
+	s.overrideUntil = time.Now().Add(d)
+	s.generation++
+	generation := s.generation
+	s.revert = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.generation == generation {
+			s.restore()
+		}
+	})
+	log.Info(context.Background(), "msg", "trace sampling ratio overridden", "ratio", ratio, "duration", d)
+}
+
+// reset restores the configured ratio
+func (s *adjustableSampler) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restore()
+}
+
+// restore restores the configured ratio, s.mu must be held
+func (s *adjustableSampler) restore() {
+	s.generation++
+	if s.revert != nil {
+		s.revert.Stop()
+		s.revert = nil
+	}
+	s.current = s.base
+	s.currentRatio = s.baseRatio
+	s.overrideUntil = time.Time{}
+	log.Info(context.Background(), "msg", "trace sampling ratio restored", "ratio", s.baseRatio)
+}
+
+// samplingState is the state reported by the sampling admin endpoint
+type samplingState struct {
+	Ratio         float64    `json:"ratio"`
+	BaseRatio     float64    `json:"base_ratio"`
+	OverrideUntil *time.Time `json:"override_until,omitempty"`
+}
+
+func (s *adjustableSampler) state() samplingState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := samplingState{Ratio: s.currentRatio, BaseRatio: s.baseRatio}
+	if !s.overrideUntil.IsZero() {
+		until := s.overrideUntil
+		st.OverrideUntil = &until
+	}
+	return st
+}
+
+// tracingSampler is the sampler of the OpenTelemetry tracer provider set up by SetupOpenTelemetry
+var tracingSampler *adjustableSampler
+
+// forceSamplingKey is the header, span attribute and baggage key that forces the sampling decision, empty when disabled
+var forceSamplingKey string
+
+// forceSampleValueKey is the context key of the force sampling value of a request traced without the OpenTracing bridge
+type forceSampleValueKey struct{}
+
+// withForceSample returns a context forcing the sampling decision of the spans started from it, see forceSampler
+func withForceSample(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, forceSampleValueKey{}, value)
+}
+
+// forceSampler samples or drops spans carrying key, as a span attribute, context value or baggage member, regardless of the sampling ratio
+// the value is parsed with strconv.ParseBool, true forces sampling and false drops the span
+// spans without key, or with an invalid value, are sampled by base
+type forceSampler struct {
+	base sdktrace.Sampler
+	key  string
+}
+
+// newForceSampler returns a sampler forcing the decision of the spans carrying key and delegating the others to base
+func newForceSampler(base sdktrace.Sampler, key string) sdktrace.Sampler {
+	return forceSampler{base: base, key: strings.ToLower(key)}
+}
+
+func (s forceSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	sample, ok := s.forced(p)
+	if !ok {
+		return s.base.ShouldSample(p)
+	}
+	decision := sdktrace.Drop
+	if sample {
+		decision = sdktrace.RecordAndSample
+	}
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+// forced returns the decision forced by the span attributes or the baggage, ok is false when there is none
+func (s forceSampler) forced(p sdktrace.SamplingParameters) (sample bool, ok bool) {
+	value := ""
+	for _, attr := range p.Attributes {
+		if strings.ToLower(string(attr.Key)) == s.key {
+			value = attr.Value.Emit()
+			break
+		}
+	}
+	if value == "" {
+		value, _ = p.ParentContext.Value(forceSampleValueKey{}).(string)
+	}
+	if value == "" {
+		value = baggage.FromContext(p.ParentContext).Member(s.key).Value()
+	}
+	if value == "" {
+		return false, false
+	}
+	sample, err := strconv.ParseBool(value)
+	return sample, err == nil
+}
+
+func (s forceSampler) Description() string {
+	return fmt.Sprintf("ForceSampler{key:%s,%s}", s.key, s.base.Description())
+}
+
+// samplingHandler serves the sampling admin endpoint
+// GET reports the current ratio, POST with ratio and an optional duration (e.g. ratio=1&duration=10m) overrides it temporarily
+// and DELETE restores the configured ratio
+func samplingHandler(defaultDuration time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := tracingSampler
+		if s == nil {
+			http.Error(w, "OpenTelemetry tracing is not configured", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			ratio, err := strconv.ParseFloat(r.FormValue("ratio"), 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				http.Error(w, "ratio must be a number between 0 and 1", http.StatusBadRequest)
+				return
+			}
+			d := defaultDuration
+			if v := r.FormValue("duration"); v != "" {
+				if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+					http.Error(w, "duration must be a positive duration, e.g. 10m", http.StatusBadRequest)
+					return
+				}
+			}
+			s.override(ratio, d)
+		case http.MethodDelete:
+			s.reset()
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.state())
+	})
+}
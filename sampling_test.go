@@ -0,0 +1,193 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	previous := tracingSampler
+	t.Cleanup(func() { tracingSampler = previous })
+	h := samplingHandler(time.Minute)
+
+	serve := func(method, form string) (*httptest.ResponseRecorder, samplingState) {
+		t.Helper()
+		r := httptest.NewRequest(method, "/admin/sampling", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var st samplingState
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, st
+	}
+
+	tracingSampler = nil
+	if w, _ := serve(http.MethodGet, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("GET without OpenTelemetry returned %d, want 404", w.Code)
+	}
+
+	tracingSampler = newAdjustableSampler(0.1)
+	defer tracingSampler.reset()
+	if _, st := serve(http.MethodGet, ""); st.Ratio != 0.1 || st.BaseRatio != 0.1 || st.OverrideUntil != nil {
+		t.Errorf("GET returned %+v before any override", st)
+	}
+	for _, form := range []string{"ratio=2", "ratio=abc", "ratio=1&duration=-1m", "ratio=1&duration=soon"} {
+		if w, _ := serve(http.MethodPost, form); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s returned %d, want 400", form, w.Code)
+		}
+	}
+
+	before := time.Now()
+	w, st := serve(http.MethodPost, url.Values{"ratio": {"1"}, "duration": {"10m"}}.Encode())
+	if w.Code != http.StatusOK || st.Ratio != 1 || st.BaseRatio != 0.1 || st.OverrideUntil == nil || st.OverrideUntil.Before(before.Add(10*time.Minute)) {
+		t.Fatalf("POST returned %d %+v, want the ratio overridden for 10m", w.Code, st)
+	}
+	if _, st := serve(http.MethodPost, "ratio=0.5"); st.OverrideUntil == nil || st.OverrideUntil.After(time.Now().Add(time.Minute)) {
+		t.Errorf("POST without duration returned %+v, want the default duration of 1m", st)
+	}
+
+	if w, _ := serve(http.MethodPut, ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST, DELETE" {
+		t.Errorf("PUT returned %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	if _, st := serve(http.MethodDelete, ""); st.Ratio != 0.1 || st.OverrideUntil != nil {
+		t.Errorf("DELETE returned %+v, want the configured ratio restored", st)
+	}
+}
+
+func TestSamplingOverrideExpires(t *testing.T) {
+	s := newAdjustableSampler(0)
+	s.override(1, 50*time.Millisecond)
+	if st := s.state(); st.Ratio != 1 {
+		t.Fatalf("ratio = %v after the override", st.Ratio)
+	}
+	// a newer override is not ended by the timer of the previous one
+	s.override(0.5, time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if st := s.state(); st.Ratio != 0.5 {
+		t.Fatalf("ratio = %v, the newer override was ended by the timer of the previous one", st.Ratio)
+	}
+	s.override(1, 50*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.state().Ratio != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the configured ratio was not restored once the override expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSamplingAdminRequiresToken(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminAuthToken = "secret"
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	for token, want := range map[string]bool{"": false, "wrong": false, "secret": true} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+c.httpAddr+"/admin/sampling", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if authorized := resp.StatusCode != http.StatusUnauthorized; authorized != want {
+			t.Errorf("token %q returned %d", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestForceSampler(t *testing.T) {
+	withBaggage := func(value string) context.Context {
+		member, err := baggage.NewMember("x-force-sample", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := baggage.New(member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return baggage.ContextWithBaggage(context.Background(), b)
+	}
+	tests := []struct {
+		name  string
+		base  sdktrace.Sampler
+		ctx   context.Context
+		attrs []attribute.KeyValue
+		want  sdktrace.SamplingDecision
+	}{
+		{name: "attribute forces sampling", base: sdktrace.NeverSample(), attrs: []attribute.KeyValue{attribute.String("X-Force-Sample", "true")}, want: sdktrace.RecordAndSample},
+		{name: "attribute forces dropping", base: sdktrace.AlwaysSample(), attrs: []attribute.KeyValue{attribute.String("x-force-sample", "false")}, want: sdktrace.Drop},
+		{name: "baggage forces sampling", base: sdktrace.NeverSample(), ctx: withBaggage("1"), want: sdktrace.RecordAndSample},
+		{name: "invalid value", base: sdktrace.NeverSample(), attrs: []attribute.KeyValue{attribute.String("x-force-sample", "please")}, want: sdktrace.Drop},
+		{name: "no value", base: sdktrace.AlwaysSample(), want: sdktrace.RecordAndSample},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			sampler := newForceSampler(tt.base, "X-Force-Sample")
+			got := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: ctx, Name: "ServeHTTP", Attributes: tt.attrs})
+			if got.Decision != tt.want {
+				t.Errorf("decision = %v, want %v", got.Decision, tt.want)
+			}
+		})
+	}
+}
+
+func TestForceSampleHeader(t *testing.T) {
+	prevKey, prevProvider := forceSamplingKey, otel.GetTracerProvider()
+	t.Cleanup(func() {
+		forceSamplingKey = prevKey
+		otel.SetTracerProvider(prevProvider)
+	})
+	forceSamplingKey = "X-Force-Sample"
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(newForceSampler(sdktrace.NeverSample(), forceSamplingKey)),
+	))
+	h := otelHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		value string
+		spans int
+	}{
+		{value: "", spans: 0},
+		{value: "true", spans: 1},
+		{value: "false", spans: 0},
+	} {
+		exporter.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/v1/items", nil)
+		if tt.value != "" {
+			r.Header.Set("x-force-sample", tt.value)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got := len(exporter.GetSpans()); got != tt.spans {
+			t.Errorf("request with x-force-sample %q exported %d spans, want %d", tt.value, got, tt.spans)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/go-coldbrew/log"
+
+	"google.golang.org/grpc"
+)
+
+// ShutdownReport is a summary of a graceful shutdown performed by Stop
+type ShutdownReport struct {
+	// StartedAt is the time at which Stop was called
+	StartedAt time.Time
+	// Duration is the total time spent in Stop
+	Duration time.Duration
+	// HealthcheckWait is the time spent waiting for the failing healthcheck to propagate
+	HealthcheckWait time.Duration
+	// DrainDuration is the time spent draining the servers
+	DrainDuration time.Duration
+	// InFlightAtStart is the number of gRPC calls in progress when Stop was called
+	InFlightAtStart int64
+	// ForcedStop is true when the gRPC server did not drain before the deadline and had to be stopped forcefully
+	ForcedStop bool
+}
+
+// logFields returns the report as key value pairs for logging
+func (r ShutdownReport) logFields() []interface{} {
+	return []interface{}{
+		"msg", "shutdown report",
+		"started_at", r.StartedAt,
+		"duration", r.Duration,
+		"healthcheck_wait", r.HealthcheckWait,
+		"drain_duration", r.DrainDuration,
+		"in_flight_at_start", r.InFlightAtStart,
+		"forced_stop", r.ForcedStop,
+	}
+}
+
+// writeShutdownReport writes the report to path for the next process, see loadShutdownReport
+func writeShutdownReport(path string, r ShutdownReport) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// loadShutdownReport records the report of the previous process written to path in the shutdown metrics and removes the file
+// a missing file is not an error, the previous process did not shut down gracefully or this is the first start
+func loadShutdownReport(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		var r ShutdownReport
+		if err = json.Unmarshal(data, &r); err == nil {
+			observeShutdown(r)
+			log.Info(context.Background(), "msg", "recorded the shutdown report of the previous process", "started_at", r.StartedAt, "duration", r.Duration)
+		}
+	}
+	if err != nil {
+		log.Error(context.Background(), "msg", "could not read the shutdown report of the previous process", "file", path, "err", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error(context.Background(), "msg", "could not remove the shutdown report of the previous process", "file", path, "err", err)
+	}
+}
+
+// ShutdownReport returns the report of the last graceful shutdown, nil if Stop has not completed yet
+func (c *cb) ShutdownReport() *ShutdownReport {
+	return c.shutdownReport.Load()
+}
+
+// inFlightInterceptor tracks the number of unary calls in progress
+func (c *cb) inFlightInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		c.inFlight.Add(1)
+		defer c.inFlight.Add(-1)
+		return handler(ctx, req)
+	}
+}
+
+// inFlightStreamInterceptor tracks the number of streams in progress
+func (c *cb) inFlightStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		c.inFlight.Add(1)
+		defer c.inFlight.Add(-1)
+		return handler(srv, stream)
+	}
+}
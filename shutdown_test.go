@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// waitIdle waits for the calls still running after a forced stop to return
+// so that they do not log while the next test replaces the logger
+func waitIdle(t *testing.T, c *cb) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.inFlight.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("calls are still running after the server stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	for _, inFlight := range []bool{false, true} {
+		name := map[bool]string{false: "drained", true: "forced"}[inFlight]
+		t.Run(name, func(t *testing.T) {
+			c := newTestCB(t, testConfig())
+			srv := newBlockingServer()
+			c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+				server.RegisterService(&blockingServiceDesc, srv)
+				return nil
+			}})
+			errs := make(chan error, 1)
+			go func() {
+				errs <- c.Run()
+			}()
+			select {
+			case <-c.Started():
+			case <-time.After(10 * time.Second):
+				t.Fatal("server did not start")
+			}
+			if c.ShutdownReport() != nil {
+				t.Fatal("a shutdown report exists before Stop was called")
+			}
+			if inFlight {
+				conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				go conn.Invoke(context.Background(), blockingMethod, &emptypb.Empty{}, &emptypb.Empty{})
+				srv.waitEntered(t)
+			}
+
+			drainTimeout := 100 * time.Millisecond
+			// the held call returns once the drain deadline passed, the gRPC server waits for it when it is stopped
+			time.AfterFunc(2*drainTimeout, func() { close(srv.release) })
+			c.Stop(drainTimeout)
+			<-errs
+			waitIdle(t, c)
+			report := c.ShutdownReport()
+			if report == nil {
+				t.Fatal("no shutdown report after Stop")
+			}
+			wantInFlight := map[bool]int64{false: 0, true: 1}[inFlight]
+			if report.InFlightAtStart != wantInFlight {
+				t.Errorf("InFlightAtStart = %d, want %d", report.InFlightAtStart, wantInFlight)
+			}
+			if report.ForcedStop != inFlight {
+				t.Errorf("ForcedStop = %v, want %v", report.ForcedStop, inFlight)
+			}
+			if inFlight && report.DrainDuration < drainTimeout {
+				t.Errorf("DrainDuration = %v, the forced stop must wait for the %v deadline", report.DrainDuration, drainTimeout)
+			}
+			if report.Duration < report.DrainDuration || report.StartedAt.IsZero() {
+				t.Errorf("inconsistent report %+v", report)
+			}
+		})
+	}
+}
+
+func TestForceStopGrace(t *testing.T) {
+	cfg := testConfig()
+	cfg.ForceStopGraceMs = 1000
+	c := newTestCB(t, cfg)
+	srv := newBlockingServer()
+	c.SetService(&testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&blockingServiceDesc, srv)
+		return nil
+	}})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run()
+	}()
+	select {
+	case <-c.Started():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not start")
+	}
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	called := make(chan error, 1)
+	go func() {
+		called <- conn.Invoke(context.Background(), blockingMethod, &emptypb.Empty{}, &emptypb.Empty{})
+	}()
+	srv.waitEntered(t)
+
+	// the call completes after the shutdown deadline but within the grace delay
+	drainTimeout := 100 * time.Millisecond
+	time.AfterFunc(3*drainTimeout, func() { close(srv.release) })
+	c.Stop(drainTimeout)
+	<-errs
+	waitIdle(t, c)
+	if err := <-called; err != nil {
+		t.Fatalf("call completing within the grace delay failed: %v", err)
+	}
+	if report := c.ShutdownReport(); report.ForcedStop {
+		t.Fatal("the gRPC server was forcefully stopped although the call completed within the grace delay")
+	}
+}
+
+func TestStopWaitsForHTTPDrain(t *testing.T) {
+	c := newTestCB(t, testConfig())
+	entered, release := make(chan struct{}), make(chan struct{})
+	var completed atomic.Bool
+	c.SetHTTPHandler("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		completed.Store(true)
+	}))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Run()
+	}()
+	select {
+	case <-c.Started():
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not start")
+	}
+	resps := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + c.httpAddr + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		resps <- err
+	}()
+	<-entered
+
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	c.Stop(5 * time.Second)
+	if !completed.Load() {
+		t.Error("Stop returned before the in-flight HTTP request completed")
+	}
+	<-errs
+	if err := <-resps; err != nil {
+		t.Errorf("in-flight HTTP request failed during the shutdown: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-coldbrew/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
+)
+
+// tlsHandshakeErrors counts failed server side TLS handshakes by reason
+var tlsHandshakeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tls_handshake_errors_total",
+	Help: "Total number of failed server side TLS handshakes",
+}, []string{"reason"})
+
+// handshakeMetricsCredentials wraps transport credentials and counts failed server handshakes
+type handshakeMetricsCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (h handshakeMetricsCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c, info, err := h.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		tlsHandshakeErrors.WithLabelValues(tlsHandshakeErrorReason(err)).Inc()
+	}
+	return c, info, err
+}
+
+func (h handshakeMetricsCredentials) Clone() credentials.TransportCredentials {
+	return handshakeMetricsCredentials{h.TransportCredentials.Clone()}
+}
+
+// tlsHandshakeErrorReason classifies a handshake error into a low cardinality reason
+func tlsHandshakeErrorReason(err error) string {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthErr):
+		return "bad_certificate"
+	case errors.As(err, &alertErr):
+		return "alert_" + strings.ReplaceAll(strings.TrimPrefix(alertErr.Error(), "tls: "), " ", "_")
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "unsupported versions"), strings.Contains(err.Error(), "protocol version"):
+		return "protocol_version"
+	case strings.Contains(err.Error(), "cipher"):
+		return "cipher_suite"
+	case strings.Contains(err.Error(), "certificate"):
+		return "bad_certificate"
+	}
+	return "other"
+}
+
+// sessionTicketRotator rotates the TLS session ticket keys of server configs
+// new tickets are encrypted with the current key, tickets encrypted with the previous key can still be resumed
+// so a ticket is valid for at most two rotation intervals
+type sessionTicketRotator struct {
+	// keys holds the ticket keys, the server configs encrypt and decrypt tickets with it
+	// through WrapSession and UnwrapSession which, unlike the keys, are kept when the configs are cloned
+	keys     *tls.Config
+	previous [32]byte
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// newSessionTicketRotator returns a rotator with a fresh key that rotates keys every interval until it is closed
+func newSessionTicketRotator(interval time.Duration) (*sessionTicketRotator, error) {
+	r := &sessionTicketRotator{
+		keys:     &tls.Config{},
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// add makes config use the rotated session ticket keys
+func (r *sessionTicketRotator) add(config *tls.Config) {
+	config.WrapSession = r.keys.EncryptTicket
+	config.UnwrapSession = r.keys.DecryptTicket
+}
+
+// rotate generates a new current key and keeps the previous one to decrypt existing tickets
+func (r *sessionTicketRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	keys := [][32]byte{key}
+	if r.previous != ([32]byte{}) {
+		keys = append(keys, r.previous)
+	}
+	// safe to call while the servers are running
+	r.keys.SetSessionTicketKeys(keys)
+	r.previous = key
+	return nil
+}
+
+func (r *sessionTicketRotator) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := r.rotate(); err != nil {
+				log.Error(context.Background(), "msg", "could not rotate TLS session ticket keys", "err", err)
+			}
+		}
+	}
+}
+
+func (r *sessionTicketRotator) Close() error {
+	close(r.stop)
+	return nil
+}
+
+// configureSessionTickets applies the session ticket configuration to a server TLS config
+func (c *cb) configureSessionTickets(config *tls.Config) error {
+	if c.config.TLSDisableSessionTickets {
+		config.SessionTicketsDisabled = true
+		return nil
+	}
+	if c.config.TLSSessionTicketKeyRotationSeconds <= 0 {
+		// the keys are managed by crypto/tls
+		return nil
+	}
+	if c.ticketRotator == nil {
+		r, err := newSessionTicketRotator(time.Duration(c.config.TLSSessionTicketKeyRotationSeconds) * time.Second)
+		if err != nil {
+			return err
+		}
+		c.ticketRotator = r
+		c.closers = append(c.closers, r)
+	}
+	c.ticketRotator.add(config)
+	return nil
+}
+
+// configureClientAuth makes a server TLS config verify the client certificates against GRPCTLSClientCAFile (mTLS)
+// the certificate is required unless GRPCTLSClientCertOptional is set
+func (c *cb) configureClientAuth(config *tls.Config) error {
+	if c.config.GRPCTLSClientCAFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(c.config.GRPCTLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", c.config.GRPCTLSClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.config.GRPCTLSClientCertOptional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the certificate of a key pair and loads it again when its files change, e.g. when they are renewed
+// the files are checked at most once per certReloadInterval, the current certificate is kept when loading fails
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+// newCertReloader loads the key pair, it returns an error when it can not be loaded
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the modification time of the most recently changed file
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load loads the key pair, modTime is the modification time of the files it is loaded from
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// certificate returns the current certificate, loading it again first when its files changed
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certReloadInterval {
+		return r.cert
+	}
+	r.checked = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil || modTime.Equal(r.modTime) {
+		return r.cert
+	}
+	if err := r.load(modTime); err != nil {
+		log.Error(context.Background(), "msg", "could not reload TLS certificate, keeping the current one", "cert_file", r.certFile, "err", err)
+		return r.cert
+	}
+	log.Info(context.Background(), "msg", "reloaded TLS certificate", "cert_file", r.certFile)
+	return r.cert
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
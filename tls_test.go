@@ -0,0 +1,461 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-coldbrew/log/loggers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 with the serial number to cert.pem and key.pem in dir
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "coldbrew-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestHTTPGatewayTLS(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTPTLSCertFile, cfg.HTTPTLSKeyFile = writeTestCert(t, t.TempDir(), 1)
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + c.httpAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil {
+		t.Fatal("gateway did not answer over TLS")
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/metrics returned %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPGatewayTLSRequiresCertAndKey(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTPTLSCertFile, _ = writeTestCert(t, t.TempDir(), 1)
+	c := newTestCB(t, cfg)
+	if c.setupErr == nil {
+		t.Fatal("a cert file without a key file must be rejected")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, _ := r.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("serial = %d, want 1", got)
+	}
+
+	writeTestCert(t, dir, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if got := serial(); got != 1 {
+		t.Fatalf("certificate reloaded before certReloadInterval: serial = %d", got)
+	}
+	r.mu.Lock()
+	r.checked = time.Time{}
+	r.mu.Unlock()
+	if got := serial(); got != 2 {
+		t.Fatalf("renewed certificate was not reloaded: serial = %d", got)
+	}
+
+	// a broken renewal keeps the current certificate
+	os.WriteFile(keyFile, []byte("broken"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	r.mu.Lock()
+	r.checked = time.Time{}
+	r.mu.Unlock()
+	if got := serial(); got != 2 {
+		t.Fatalf("broken renewal replaced the certificate: serial = %d", got)
+	}
+}
+
+func TestTLSHandshakeErrorsCounted(t *testing.T) {
+	cfg := testConfig()
+	cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile = writeTestCert(t, t.TempDir(), 1)
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	// waitCounted waits for the server to count the failed handshake, it is counted after the client gave up
+	waitCounted := func(reason string, before float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(tlsHandshakeErrors.WithLabelValues(reason)) == before {
+			if time.Now().After(deadline) {
+				t.Fatalf("failed handshake was not counted as %s", reason)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	before := testutil.ToFloat64(tlsHandshakeErrors.WithLabelValues("not_tls"))
+	conn, err := net.Dial("tcp", c.grpcAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	waitCounted("not_tls", before)
+	conn.Close()
+
+	// the client does not trust the self signed certificate and aborts the handshake with a bad certificate alert
+	before = testutil.ToFloat64(tlsHandshakeErrors.WithLabelValues("bad_certificate"))
+	if tlsConn, err := tls.Dial("tcp", c.grpcAddr, &tls.Config{NextProtos: []string{"h2"}}); err == nil {
+		tlsConn.Close()
+		t.Fatal("client trusted the self signed certificate")
+	}
+	waitCounted("bad_certificate", before)
+}
+
+func TestTLSHandshakeErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, want: "not_tls"},
+		{err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, want: "bad_certificate"},
+		{err: fmt.Errorf("handshake: %w", io.EOF), want: "eof"},
+		{err: context.DeadlineExceeded, want: "timeout"},
+		{err: errors.New("tls: client offered only unsupported versions: [301]"), want: "protocol_version"},
+		{err: errors.New("tls: no cipher suite supported by both client and server"), want: "cipher_suite"},
+		{err: errors.New("something else"), want: "other"},
+	}
+	for _, tt := range tests {
+		if got := tlsHandshakeErrorReason(tt.err); got != tt.want {
+			t.Errorf("tlsHandshakeErrorReason(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHTTP2Settings(t *testing.T) {
+	cfg := testConfig()
+	cfg.HTTPTLSCertFile, cfg.HTTPTLSKeyFile = writeTestCert(t, t.TempDir(), 1)
+	cfg.HTTP2MaxConcurrentStreams = 7
+	cfg.HTTP2MaxReadFrameSize = 1 << 20
+	c := newTestCB(t, cfg)
+	c.SetService(&testService{})
+	runTestServer(t, c)
+
+	conn, err := tls.Dial("tcp", c.httpAddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		t.Fatal("gateway did not negotiate HTTP/2")
+	}
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the server starts the connection with its settings
+	frame, err := http2.NewFramer(nil, conn).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("first frame is a %T, want the settings of the server", frame)
+	}
+	if v, _ := settings.Value(http2.SettingMaxConcurrentStreams); v != cfg.HTTP2MaxConcurrentStreams {
+		t.Errorf("SETTINGS_MAX_CONCURRENT_STREAMS = %d, want %d", v, cfg.HTTP2MaxConcurrentStreams)
+	}
+	if v, _ := settings.Value(http2.SettingMaxFrameSize); v != cfg.HTTP2MaxReadFrameSize {
+		t.Errorf("SETTINGS_MAX_FRAME_SIZE = %d, want %d", v, cfg.HTTP2MaxReadFrameSize)
+	}
+}
+
+func TestSetTransportCredentials(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), 1)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the credentials are used by the server and by the gateway to dial it
+	creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	c := newTestCB(t, testConfig())
+	c.SetTransportCredentials(creds)
+	svc := &dialService{testService: testService{initGRPC: func(ctx context.Context, server *grpc.Server) error {
+		server.RegisterService(&echoServiceDesc, &echoServer{})
+		return nil
+	}}}
+	c.SetService(svc)
+	runTestServer(t, c)
+	defer svc.conn.Close()
+
+	reply := &wrapperspb.StringValue{}
+	if err := svc.conn.Invoke(context.Background(), echoMethod, wrapperspb.String("coldbrew"), reply); err != nil || reply.GetValue() != "coldbrew" {
+		t.Fatalf("call through the gateway connection returned %q, %v", reply.GetValue(), err)
+	}
+
+	conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := conn.Invoke(ctx, echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{}); err == nil {
+		t.Fatal("plaintext call succeeded although the server uses the TLS credentials")
+	}
+}
+
+func TestClientCertificateVerification(t *testing.T) {
+	tests := []struct {
+		name       string
+		optional   bool
+		clientCert bool
+		identity   string
+		fails      bool
+	}{
+		{name: "required with certificate", clientCert: true, identity: "coldbrew-test"},
+		{name: "required without certificate", fails: true},
+		{name: "optional without certificate", optional: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			// the self signed certificate is its own CA
+			cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile = writeTestCert(t, t.TempDir(), 1)
+			cfg.GRPCTLSClientCAFile = cfg.GRPCTLSCertFile
+			cfg.GRPCTLSClientCertOptional = tt.optional
+			cfg.GRPCTLSInsecureSkipVerify = true
+			cfg.LogPeerIdentity = true
+			c := newTestCB(t, cfg)
+			srv := runEchoServer(t, c)
+
+			tlsConfig := &tls.Config{InsecureSkipVerify: true}
+			if tt.clientCert {
+				cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tlsConfig.Certificates = []tls.Certificate{cert}
+			}
+			conn, err := grpc.NewClient(c.grpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = conn.Invoke(ctx, echoMethod, wrapperspb.String("coldbrew"), &wrapperspb.StringValue{})
+			if tt.fails {
+				if err == nil {
+					t.Fatal("call without a client certificate succeeded although one is required")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity := ""
+			if fields := loggers.FromContext(srv.lastContext()); fields != nil {
+				if v, ok := fields.Load("peer_identity"); ok {
+					identity = v.(string)
+				}
+			}
+			if identity != tt.identity {
+				t.Errorf("peer_identity = %q, want %q", identity, tt.identity)
+			}
+		})
+	}
+}
+
+func TestSessionTickets(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), 1)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(t *testing.T, c *cb) *tls.Config {
+		t.Helper()
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		started := c.ticketRotator != nil
+		if err := c.configureSessionTickets(config); err != nil {
+			t.Fatal(err)
+		}
+		if !started && c.ticketRotator != nil {
+			t.Cleanup(func() { c.ticketRotator.Close() })
+		}
+		return config
+	}
+	// the client keeps the sessions of the previous handshakes, TLS 1.2 delivers the ticket within the handshake
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "coldbrew-test",
+		MaxVersion:         tls.VersionTLS12,
+	}
+	resumed := func(t *testing.T, server *tls.Config) bool {
+		t.Helper()
+		sc, cc := net.Pipe()
+		defer sc.Close()
+		defer cc.Close()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- tls.Server(sc, server).Handshake()
+		}()
+		conn := tls.Client(cc, client)
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState().DidResume
+	}
+
+	t.Run("default", func(t *testing.T) {
+		client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		server := newServer(t, &cb{config: testConfig()})
+		resumed(t, server)
+		if !resumed(t, server) {
+			t.Error("session was not resumed with the default ticket keys")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		cfg := testConfig()
+		cfg.TLSDisableSessionTickets = true
+		server := newServer(t, &cb{config: cfg})
+		resumed(t, server)
+		if resumed(t, server) {
+			t.Error("session was resumed although session tickets are disabled")
+		}
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		cfg := testConfig()
+		cfg.TLSSessionTicketKeyRotationSeconds = 3600
+		c := &cb{config: cfg}
+		server := newServer(t, c)
+		// the gRPC and HTTP servers share the rotated keys
+		other := newServer(t, c)
+		resumed(t, server)
+		if !resumed(t, other) {
+			t.Error("session was not resumed by another server config sharing the rotated keys")
+		}
+		if err := c.ticketRotator.rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if !resumed(t, server) {
+			t.Error("ticket encrypted with the previous key was not resumed")
+		}
+		for i := 0; i < 2; i++ {
+			if err := c.ticketRotator.rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if resumed(t, server) {
+			t.Error("ticket older than two rotations was resumed")
+		}
+	})
+}
+
+func TestTLSNextProtos(t *testing.T) {
+	for _, tt := range []struct {
+		nextProtos []string
+		http       string
+		grpc       string
+	}{
+		{nextProtos: nil, http: "h2", grpc: "h2"},
+		// gRPC always advertises h2 after the configured protocols
+		{nextProtos: []string{"http/1.1"}, http: "http/1.1", grpc: "http/1.1"},
+	} {
+		t.Run(fmt.Sprint(tt.nextProtos), func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := testConfig()
+			cfg.HTTPTLSCertFile, cfg.HTTPTLSKeyFile = writeTestCert(t, dir, 1)
+			cfg.GRPCTLSCertFile, cfg.GRPCTLSKeyFile = cfg.HTTPTLSCertFile, cfg.HTTPTLSKeyFile
+			cfg.TLSNextProtos = tt.nextProtos
+			c := newTestCB(t, cfg)
+			c.SetService(&testService{})
+			runTestServer(t, c)
+
+			negotiated := func(addr string) string {
+				t.Helper()
+				conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				return conn.ConnectionState().NegotiatedProtocol
+			}
+			if got := negotiated(c.httpAddr); got != tt.http {
+				t.Errorf("HTTP server negotiated %q, want %q", got, tt.http)
+			}
+			if got := negotiated(c.grpcAddr); got != tt.grpc {
+				t.Errorf("gRPC server negotiated %q, want %q", got, tt.grpc)
+			}
+		})
+	}
+}
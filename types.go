@@ -7,6 +7,7 @@ import (
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // CBService is the interface that wraps service methods used in ColdBrew.
@@ -24,6 +25,15 @@ type CBService interface {
 	InitGRPC(ctx context.Context, server *grpc.Server) error
 }
 
+// CBServeMuxOptioner is the interface implemented by services that need their own grpc-gateway ServeMux options.
+// Services implementing it get a dedicated ServeMux, passed to InitHTTP, which is created with the default options
+// followed by the ones returned here. This allows services to use different marshalers for the same content type.
+type CBServeMuxOptioner interface {
+	// ServeMuxOptions returns the options used to create the ServeMux of the service.
+	// ServeMuxOptions is called by the core package.
+	ServeMuxOptions() []runtime.ServeMuxOption
+}
+
 // CBGracefulStopper is the interface that wraps the graceful stop method.
 type CBGracefulStopper interface {
 	// FailCheck set if the service is ready to stop.
@@ -31,6 +41,22 @@ type CBGracefulStopper interface {
 	FailCheck(bool)
 }
 
+// CBWarmup is the interface implemented by services that need to warm up before serving traffic.
+// The readiness endpoint reports not ready until the warmup of all services is complete.
+type CBWarmup interface {
+	// Warmed returns a channel that is closed once the warmup of the service is complete.
+	// Warmed is called by the core package.
+	Warmed() <-chan struct{}
+}
+
+// CBHealthReporter is the interface implemented by services that report their own serving status.
+// The status of each service is served by the grpc.health.v1 service, all services are set as NOT_SERVING when Stop is called.
+type CBHealthReporter interface {
+	// SetHealth is called with the health manager of the server before InitGRPC.
+	// SetHealth is called by the core package.
+	SetHealth(*HealthManager)
+}
+
 // CBStopper is the interface that wraps the stop method.
 type CBStopper interface {
 	// Stop stops the service.
@@ -38,6 +64,14 @@ type CBStopper interface {
 	Stop()
 }
 
+// CBContextStopper is the interface implemented by services that stop within the shutdown deadline.
+// It is an alternative to CBStopper, a service implements one or the other as both methods are named Stop.
+type CBContextStopper interface {
+	// Stop stops the service, ctx is cancelled when the shutdown deadline is reached.
+	// Stop is called by the core package.
+	Stop(ctx context.Context)
+}
+
 // CB is the interface that wraps coldbrew methods.
 type CB interface {
 	// SetService sets the service.
@@ -45,10 +79,50 @@ type CB interface {
 	// Run runs the service.
 	// Run is blocking. It returns an error if the service fails. Otherwise, it returns nil.
 	Run() error
+	// RunWithContext runs the service like Run, cancelling ctx shuts the service down gracefully.
+	// ctx is the parent of the context passed to InitGRPC and InitHTTP.
+	RunWithContext(ctx context.Context) error
 	// SetOpenAPIHandler sets the OpenAPI handler.
 	SetOpenAPIHandler(http.Handler)
+	// SetNotFoundHandler sets the handler for gateway requests that do not match any route.
+	SetNotFoundHandler(http.Handler)
+	// SetMethodNotAllowedHandler sets the handler for gateway requests that match a route with a different method.
+	SetMethodNotAllowedHandler(http.Handler)
+	// SetTransportCredentials sets the credentials of the gRPC server, used instead of the file based TLS configuration.
+	SetTransportCredentials(credentials.TransportCredentials)
+	// SetGRPCServerOptions sets additional gRPC server options, they are applied after the options derived from the config.
+	SetGRPCServerOptions(...grpc.ServerOption)
+	// SetUnknownServiceHandler sets the handler for calls to services that are not registered, instead of returning Unimplemented.
+	SetUnknownServiceHandler(grpc.StreamHandler)
+	// Health returns the health manager, the single source of truth for the gRPC health service and /readyz.
+	Health() *HealthManager
+	// SetServeMuxOptions sets additional grpc-gateway ServeMux options, they are applied after the options derived from the config.
+	SetServeMuxOptions(...runtime.ServeMuxOption)
+	// GRPCServer returns the gRPC server created by Run, nil until ServersReady is closed.
+	GRPCServer() *grpc.Server
+	// HTTPServer returns the HTTP gateway server created by Run, nil until ServersReady is closed.
+	HTTPServer() *http.Server
+	// ServersReady returns a channel that is closed once Run has initialized the gRPC and HTTP servers, or has failed to.
+	ServersReady() <-chan struct{}
+	// Started returns a channel that is closed once the gRPC and HTTP servers are listening on their ports, or Run has failed to.
+	Started() <-chan struct{}
+	// GRPCAddr returns the address the gRPC server listens on, with the port assigned by the OS when GRPCPort is 0, empty until Started is closed.
+	GRPCAddr() string
+	// HTTPAddr returns the address the HTTP server listens on, with the port assigned by the OS when HTTPPort is 0, empty until Started is closed.
+	HTTPAddr() string
+	// SetHTTPHandler registers an additional route on the HTTP gateway server, checked before the gateway mux.
+	SetHTTPHandler(pattern string, handler http.Handler)
 	// Stop stops the service.
 	// Stop is blocking. It returns an error if the service fails. Otherwise, it returns nil.
 	// duration is the duration to wait for the service to stop.
 	Stop(time.Duration) error
+	// Subscribe registers a function that is called for every lifecycle event (starting, ready, shutting-down, stopped).
+	// Subscribers are called synchronously and should not block.
+	Subscribe(func(Event))
+	// ShutdownReport returns a summary of the last graceful shutdown, it returns nil until Stop has completed.
+	ShutdownReport() *ShutdownReport
+	// PanicChannel returns the channel panics recovered in gRPC handlers are delivered to, nil unless PanicChannelSize is set.
+	PanicChannel() <-chan PanicEvent
+	// TracePropagationDialOptions returns the dial options removing trace context and baggage from calls to TracePropagationSuppressedTargets.
+	TracePropagationDialOptions() []grpc.DialOption
 }